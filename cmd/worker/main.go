@@ -2,33 +2,88 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"strings"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
 
 	"transcode-worker/internal/client"
 	"transcode-worker/internal/config"
+	"transcode-worker/internal/journal"
 	"transcode-worker/internal/monitor"
+	"transcode-worker/internal/storage"
 	"transcode-worker/internal/transcoder"
 	"transcode-worker/pkg/models"
 )
 
+// errJobCancelled is the cause of a job context cancelled by the orchestrator
+var errJobCancelled = errors.New("job cancelled by orchestrator")
+
+// errShuttingDown is the cause of a job context cancelled by a worker shutdown
+var errShuttingDown = errors.New("worker shutting down")
+
+// errLeaseLost is the cause of a job context cancelled because its lease
+// couldn't be renewed, after which the orchestrator may reassign the job
+var errLeaseLost = errors.New("job lease lost")
+
+// errWorkerRestarted is reported for a job the journal shows was running when
+// the worker died
+var errWorkerRestarted = errors.New("worker restarted while running the job")
+
+// errInputMissing is returned by resolveJobPaths for an input that doesn't exist
+var errInputMissing = errors.New("input file does not exist")
+
+// Job slot types, see config.SlotsConfig
+const (
+	slotCPU = "cpu"
+	slotGPU = "gpu"
+)
+
+// runningJob is a job holding a slot, from its assignment until it is finalized
+type runningJob struct {
+	spec   *models.JobSpec
+	slot   string
+	cancel context.CancelCauseFunc // nil until the job starts
+	lease  string                  // Lease ID once accepted
+	
+	// Disk space set aside by the preflight, so jobs starting side by side
+	// don't count the same free space
+	tempBytes   uint64
+	outputBytes uint64
+}
+
+// rejection is why an assigned job isn't started
+type rejection struct {
+	reason    string // One of the models.RejectReason* codes
+	retryable bool
+	err       error
+}
+
 type Worker struct {
 	cfg          *config.Config
 	client       *client.OrchestratorClient
+	outbox       *client.Outbox   // Finalize and reject calls, delivered until acknowledged
+	journal      *journal.Journal // nil when disabled
 	monitor      *monitor.SystemMonitor
 	transcoder   *transcoder.FFmpegTranscoder
+	store        storage.Backend
+	paths        *storage.PathPolicy
+	nasHealth    *monitor.MountHealth // nil when the check is disabled
+	nasHealthy   bool                 // Last state seen by the sync loop
 	capabilities []string
 	
-	currentJob *models.JobSpec
-	jobMutex   sync.Mutex
-	cancelJob  context.CancelFunc
+	jobs     map[string]*runningJob // By job ID
+	jobMutex sync.Mutex
+	
+	drainCh   chan struct{} // Closed when drain mode starts
+	drainOnce sync.Once
 	
 	shutdownCh chan struct{}
 	wg         sync.WaitGroup
@@ -64,21 +119,68 @@ func main() {
 		"worker_id", cfg.WorkerID,
 		"orchestrator_url", cfg.OrchestratorURL,
 		"nas_mount_path", cfg.NasMountPath,
+		"storage_backend", cfg.Storage.Backend,
 		"temp_dir", cfg.TempDir,
+		"cpu_slots", cfg.Slots.CPU,
+		"gpu_slots", cfg.Slots.GPU,
 		"log_level", cfg.LogLevel)
 
 	// Initialize components
+	store, err := storage.New(cfg)
+	if err != nil {
+		slog.Error("Failed to initialize storage backend", "error", err)
+		os.Exit(1)
+	}
 	orchestratorClient := client.NewOrchestratorClient(cfg)
-	systemMonitor := monitor.NewSystemMonitor()
-	ffmpegTranscoder := transcoder.NewTranscoder(cfg.TempDir)
+	systemMonitor := monitor.NewSystemMonitor(cfg)
+	ffmpegTranscoder := transcoder.NewTranscoder(cfg, store)
 
 	worker := &Worker{
 		cfg:        cfg,
 		client:     orchestratorClient,
+		outbox:     client.NewOutbox(cfg, orchestratorClient),
 		monitor:    systemMonitor,
 		transcoder: ffmpegTranscoder,
+		store:      store,
+		paths:      storage.NewPathPolicy(cfg),
+		nasHealthy: true,
+		jobs:       make(map[string]*runningJob),
+		drainCh:    make(chan struct{}),
 		shutdownCh: make(chan struct{}),
 	}
+	
+	// Check the NAS mount before taking jobs, then keep checking in the background
+	if cfg.NASHealth.Enabled {
+		worker.nasHealth = monitor.NewMountHealth(cfg)
+		if err := worker.nasHealth.Check(); err != nil {
+			slog.Warn("NAS mount unhealthy, not taking jobs until it recovers", "error", err)
+			worker.nasHealthy = false
+		}
+		worker.wg.Add(1)
+		go func() {
+			defer worker.wg.Done()
+			worker.nasHealth.Run(worker.shutdownCh)
+		}()
+	}
+
+	// Report and clean up the jobs an earlier run was running when it died
+	if cfg.Journal.Enabled {
+		jobJournal, unfinished, err := journal.Open(cfg.Journal.Path)
+		if err != nil {
+			slog.Error("Failed to open job journal", "error", err)
+			os.Exit(1)
+		}
+		worker.journal = jobJournal
+		worker.recoverJobs(unfinished)
+	}
+	ffmpegTranscoder.OnRenditionDone(worker.renditionDone)
+
+	// Remove staging dirs left on the NAS by a commit that was interrupted
+	if removed, err := ffmpegTranscoder.CleanupStaleStaging(); err != nil {
+		slog.Warn("Failed to clean up stale staging dirs", "error", err)
+	} else if removed > 0 {
+		slog.Info("Cleaned up stale staging dirs", "count", removed)
+	}
 
 	// Discover capabilities once at startup
 	ctx := context.Background()
@@ -100,16 +202,32 @@ func main() {
 
 	// Handle graceful shutdown
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, drainSignals...)...)
 
 	// Start sync loop (replaces heartbeat + job polling)
 	worker.wg.Add(1)
 	go worker.syncLoop()
+	
+	// Deliver finalize and reject calls, including those left by an earlier run.
+	// A call that finds the orchestrator lost the worker's state registers it again.
+	worker.outbox.OnStateLost(func(ctx context.Context) error {
+		return worker.client.Register(ctx, worker.capabilities)
+	})
+	worker.wg.Add(1)
+	go func() {
+		defer worker.wg.Done()
+		worker.outbox.Run(worker.shutdownCh)
+	}()
 
-	// Wait for shutdown signal
-	<-sigCh
-	slog.Info("Shutdown signal received, cleaning up...")
+	// Wait for a signal, or for the orchestrator to ask for a drain
+	select {
+	case sig := <-sigCh:
+		worker.startDrain(sig.String() + " received")
+		worker.warnStopTimeout()
+	case <-worker.drainCh:
+	}
 	
+	worker.waitForJobs(sigCh)
 	worker.shutdown()
 	
 	slog.Info("Worker stopped gracefully")
@@ -157,24 +275,44 @@ func (w *Worker) performSync() error {
 		return fmt.Errorf("failed to get stats: %w", err)
 	}
 	
+	// A dropped NAS share would fail every job it is given
+	healthErr := w.checkNASHealth()
+	
 	// Determine current status
 	w.jobMutex.Lock()
+	runningJobIDs := slices.Sorted(maps.Keys(w.jobs))
+	free := w.freeSlots()
+	w.jobMutex.Unlock()
+	
 	status := "IDLE"
 	currentJobID := ""
-	if w.currentJob != nil {
+	if len(runningJobIDs) > 0 {
+		currentJobID = runningJobIDs[0]
+	}
+	if free[slotCPU] <= 0 && free[slotGPU] <= 0 {
 		status = "BUSY"
-		currentJobID = w.currentJob.JobID
-	} else if stats.IsBusy {
+	} else if len(runningJobIDs) == 0 && stats.IsBusy {
 		status = "BUSY" // System under load from other processes
 	}
-	w.jobMutex.Unlock()
+	
+	statusReason := ""
+	switch {
+	case w.draining():
+		status = "DRAINING"
+	case healthErr != nil:
+		status = "UNHEALTHY"
+		statusReason = healthErr.Error()
+	}
 	
 	// Build sync payload
 	payload := models.SyncPayload{
 		WorkerID:      w.cfg.WorkerID,
 		Status:        status,
+		StatusReason:  statusReason,
 		HardwareStats: stats,
 		CurrentJobID:  currentJobID,
+		RunningJobIDs: runningJobIDs,
+		FreeSlots:     models.SlotCounts{CPU: free[slotCPU], GPU: free[slotGPU]},
 	}
 	
 	// Send sync request
@@ -196,129 +334,551 @@ func (w *Worker) performSync() error {
 		}
 	}
 	
-	// Handle job assignment if worker is IDLE
+	for _, jobID := range syncResp.CancelJobIDs {
+		w.stopRunningJob(jobID, errJobCancelled)
+	}
+	
+	if syncResp.Drain {
+		w.startDrain("requested by orchestrator")
+	}
+	
 	if syncResp.AssignedJob != nil {
-		w.jobMutex.Lock()
-		isIdle := w.currentJob == nil
-		w.jobMutex.Unlock()
-		
-		if !isIdle {
-			slog.Warn("Rejecting job assignment - already processing",
-				"assigned_job", syncResp.AssignedJob.JobID,
-				"current_job", w.currentJob.JobID)
-			return nil
+		w.handleAssignment(ctx, syncResp.AssignedJob, healthErr)
+	}
+	
+	return nil
+}
+
+// handleAssignment starts an assigned job, or rejects it if it can't run here.
+// A slot of the job's type is claimed before anything else, so assignments
+// arriving while this one is still being checked can't take the same slot.
+func (w *Worker) handleAssignment(ctx context.Context, job *models.JobSpec, healthErr error) {
+	slot := w.slotFor(job)
+	slog.Info("Received job assignment", "job_id", job.JobID, "slot", slot)
+	
+	if w.draining() {
+		w.rejectJob(job, &rejection{
+			reason:    models.RejectReasonDraining,
+			retryable: true,
+			err:       errors.New("worker is draining"),
+		})
+		return
+	}
+	
+	w.jobMutex.Lock()
+	_, running := w.jobs[job.JobID]
+	free := w.freeSlots()[slot]
+	if !running && free > 0 {
+		w.jobs[job.JobID] = &runningJob{spec: job, slot: slot}
+	}
+	w.jobMutex.Unlock()
+	
+	if running {
+		slog.Warn("Ignoring assignment of a job that is already running", "job_id", job.JobID)
+		return
+	}
+	if free <= 0 {
+		w.rejectJob(job, &rejection{
+			reason:    models.RejectReasonBusy,
+			retryable: true,
+			err:       fmt.Errorf("no free %s slot", slot),
+		})
+		return
+	}
+	
+	if rej := w.checkAssignment(ctx, job, healthErr); rej != nil {
+		w.releaseJob(job.JobID)
+		w.rejectJob(job, rej)
+		return
+	}
+	
+	w.record(journal.Record{JobID: job.JobID, Event: journal.EventAssigned, Job: job})
+	
+	// Tracked so shutdown waits for the job to be finalized
+	w.wg.Add(1)
+	go w.executeJob(job)
+}
+
+// slotFor returns the slot type a job runs in: GPU when one of its renditions
+// uses a hardware encoder and GPU slots are configured, otherwise CPU
+func (w *Worker) slotFor(job *models.JobSpec) string {
+	if w.cfg.Slots.GPU > 0 {
+		for _, output := range job.Outputs {
+			if transcoder.IsHardwareCodec(output.Codec) {
+				return slotGPU
+			}
 		}
+	}
+	return slotCPU
+}
+
+// freeSlots counts the slots of each type no job holds. Call with jobMutex held.
+func (w *Worker) freeSlots() map[string]int {
+	free := map[string]int{slotCPU: w.cfg.Slots.CPU, slotGPU: w.cfg.Slots.GPU}
+	for _, running := range w.jobs {
+		free[running.slot]--
+	}
+	return free
+}
+
+// checkAssignment runs the checks that don't depend on the job's size: NAS
+// health, paths and encoders. Disk space is checked when the job starts.
+func (w *Worker) checkAssignment(ctx context.Context, job *models.JobSpec, healthErr error) *rejection {
+	if healthErr != nil {
+		return &rejection{reason: models.RejectReasonNASUnhealthy, retryable: true, err: healthErr}
+	}
+	
+	if err := w.resolveJobPaths(ctx, job); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrPathIsRoot):
+			return &rejection{reason: models.RejectReasonPathIsRoot, err: err}
+		case errors.Is(err, storage.ErrPathNotAllowed):
+			return &rejection{reason: models.RejectReasonPathNotAllowed, err: err}
+		case errors.Is(err, errInputMissing):
+			return &rejection{reason: models.RejectReasonInputMissing, err: err}
+		default:
+			return &rejection{reason: models.RejectReasonInvalidJob, err: err}
+		}
+	}
+	
+	for i := range job.Outputs {
+		for _, codec := range []string{job.Outputs[i].Codec, job.GetAudioCodec(&job.Outputs[i])} {
+			if !w.monitor.HasEncoder(codec) {
+				return &rejection{
+					reason: models.RejectReasonUnsupportedCodec,
+					err:    fmt.Errorf("rendition %s: encoder %q is not available", job.Outputs[i].Resolution, codec),
+				}
+			}
+		}
+	}
+	
+	return nil
+}
+
+// recoverJobs reports the jobs the journal shows were running when the worker
+// died and cleans up after them. Reports go through the outbox, which delivers
+// them once the worker runs. A job that wasn't accepted yet is rejected, one
+// whose outputs were all committed is finalized as COMPLETED, and any other is
+// finalized as INTERRUPTED so the orchestrator can requeue it.
+func (w *Worker) recoverJobs(unfinished []journal.JobState) {
+	for _, state := range unfinished {
+		job := state.Job
+		slog.Warn("Recovering job left unfinished by an earlier run",
+			"job_id", job.JobID,
+			"last_event", state.Last,
+			"renditions_done", len(state.Renditions))
 		
-		slog.Info("Received job assignment", "job_id", syncResp.AssignedJob.JobID)
-		
-		// Resolve paths and execute job
-		if err := w.resolveJobPaths(syncResp.AssignedJob); err != nil {
-			slog.Error("Failed to resolve job paths", "error", err)
-			return nil
+		switch state.Last {
+		case journal.EventAssigned:
+			w.rejectJob(job, &rejection{
+				reason:    models.RejectReasonWorkerRestarted,
+				retryable: true,
+				err:       errWorkerRestarted,
+			})
+			w.record(journal.Record{JobID: job.JobID, Event: journal.EventReleased})
+		case journal.EventCommitted:
+			w.finalizeJob(job, &transcoder.Result{Outputs: state.Outputs, Roots: state.Roots, Playlists: state.Playlists}, nil, 0)
+		default:
+			w.finalizeJob(job, nil, errWorkerRestarted, 0)
 		}
 		
-		go w.executeJob(syncResp.AssignedJob)
+		resumable, err := w.transcoder.CleanupJobTemp(job.JobID)
+		if err != nil {
+			slog.Warn("Failed to clean up temp dir of recovered job", "job_id", job.JobID, "error", err)
+		} else if resumable {
+			slog.Info("Keeping checkpoint of recovered job for a resume", "job_id", job.JobID)
+		}
 	}
+}
+
+// renditionDone journals a committed rendition and tells the orchestrator
+// through the outbox, so the news survives an outage and arrives before the
+// job's finalize
+func (w *Worker) renditionDone(jobID, rendition string) {
+	w.record(journal.Record{JobID: jobID, Event: journal.EventRenditionDone, Rendition: rendition})
 	
-	return nil
+	w.jobMutex.Lock()
+	var lease string
+	if running, ok := w.jobs[jobID]; ok {
+		lease = running.lease
+	}
+	w.jobMutex.Unlock()
+	
+	payload := models.JobStatusPayload{
+		Status:        "PROCESSING",
+		LeaseID:       lease,
+		RenditionDone: rendition,
+	}
+	if err := w.outbox.UpdateJobStatus(jobID, payload); err != nil {
+		slog.Error("Failed to queue rendition update", "job_id", jobID, "rendition", rendition, "error", err)
+	}
+}
+
+// record appends to the job journal. Failing to do so doesn't stop the job,
+// it only makes recovery after a crash less complete.
+func (w *Worker) record(rec journal.Record) {
+	if w.journal == nil {
+		return
+	}
+	if err := w.journal.Record(rec); err != nil {
+		slog.Warn("Failed to record job event", "job_id", rec.JobID, "event", rec.Event, "error", err)
+	}
+}
+
+// checkNASHealth returns the last NAS mount check result, logging changes
+func (w *Worker) checkNASHealth() error {
+	if w.nasHealth == nil {
+		return nil
+	}
+	
+	err := w.nasHealth.Healthy()
+	if healthy := err == nil; healthy != w.nasHealthy {
+		w.nasHealthy = healthy
+		if healthy {
+			slog.Info("NAS mount recovered, taking jobs again")
+		} else {
+			slog.Warn("NAS mount unhealthy, not taking jobs until it recovers", "error", err)
+		}
+	}
+	return err
 }
 
-// resolveJobPaths converts relative paths to absolute NAS paths
-func (w *Worker) resolveJobPaths(job *models.JobSpec) error {
+// resolveJobPaths converts paths sent by the orchestrator into storage backend
+// locations (absolute NAS paths for the filesystem backend). Paths outside the
+// allowed roots fail with storage.ErrPathNotAllowed before anything is created.
+func (w *Worker) resolveJobPaths(ctx context.Context, job *models.JobSpec) error {
+	// The job ID names the job temp dir
+	if err := w.paths.CheckName(job.JobID); err != nil {
+		return err
+	}
+	
 	// Resolve input source
 	inputSource := job.GetInputSource()
 	if inputSource == "" {
 		return fmt.Errorf("job has no input source specified")
 	}
 	
-	resolvedInput := w.resolveNASPath(inputSource)
-	job.SetInputSource(resolvedInput)
-	
-	slog.Debug("Resolved input path", "path", resolvedInput)
-	
-	// Verify input file exists
-	if _, err := os.Stat(resolvedInput); os.IsNotExist(err) {
-		return fmt.Errorf("input file does not exist: %s", resolvedInput)
+	// http(s) sources must be below an allowed input URL; the transcoder
+	// fetches them and checks every redirect on the way
+	var err error
+	if storage.IsURL(inputSource) {
+		if err := w.paths.CheckURL(inputSource); err != nil {
+			return err
+		}
+	} else {
+		if err := w.paths.CheckRaw(inputSource); err != nil {
+			return err
+		}
+		resolvedInput, err := w.store.Resolve(inputSource)
+		if err != nil {
+			return fmt.Errorf("invalid input path %s: %w", inputSource, err)
+		}
+		if err := w.paths.CheckInput(resolvedInput); err != nil {
+			return err
+		}
+		job.SetInputSource(resolvedInput)
+		
+		slog.Debug("Resolved input path", "path", resolvedInput)
+		
+		// Verify input file exists
+		if _, err := w.store.Stat(ctx, resolvedInput); errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %s", errInputMissing, resolvedInput)
+		}
 	}
 	
 	// Resolve output base path if present
 	if job.OutputBase != "" {
-		job.OutputBase = w.resolveNASPath(job.OutputBase)
+		if err := w.paths.CheckRaw(job.OutputBase); err != nil {
+			return err
+		}
+		job.OutputBase, err = w.store.Resolve(job.OutputBase)
+		if err != nil {
+			return fmt.Errorf("invalid output base: %w", err)
+		}
+		if err := w.paths.CheckOutput(job.OutputBase); err != nil {
+			return err
+		}
 		slog.Debug("Resolved output base", "path", job.OutputBase)
 	}
 	
-	// Resolve each output rendition path
+	// Check every output before creating any of them
+	for i := range job.Outputs {
+		if err := w.paths.CheckRaw(job.Outputs[i].DestPath); err != nil {
+			return err
+		}
+		job.Outputs[i].DestPath, err = w.store.Resolve(job.Outputs[i].DestPath)
+		if err != nil {
+			return fmt.Errorf("invalid output path: %w", err)
+		}
+		if err := w.paths.CheckOutput(job.Outputs[i].DestPath); err != nil {
+			return err
+		}
+	}
+	
+	// Destinations are created by the commit, after the transcoder applied the overwrite policy
 	for i := range job.Outputs {
-		job.Outputs[i].DestPath = w.resolveNASPath(job.Outputs[i].DestPath)
 		slog.Debug("Resolved output path",
 			"resolution", job.Outputs[i].Resolution,
 			"path", job.Outputs[i].DestPath)
-		
-		// Ensure output directory exists
-		if err := os.MkdirAll(job.Outputs[i].DestPath, 0755); err != nil {
-			return fmt.Errorf("failed to create output directory %s: %w", job.Outputs[i].DestPath, err)
-		}
 	}
 	
 	return nil
 }
 
-// resolveNASPath prepends NAS mount path if the given path is relative
-func (w *Worker) resolveNASPath(path string) string {
-	if filepath.IsAbs(path) {
-		return path
-	}
-	
-	cleanPath := filepath.Clean(path)
-	cleanPath = strings.TrimPrefix(cleanPath, "/")
-	
-	return filepath.Join(w.cfg.NasMountPath, cleanPath)
-}
-
-// executeJob runs the transcoding process
+// executeJob accepts and runs a job that handleAssignment gave a slot
 func (w *Worker) executeJob(job *models.JobSpec) {
+	defer w.wg.Done()
+	defer w.releaseJob(job.JobID)
+	
+	// Create cancellable context. A shutdown that began before the job had one
+	// has already cancelled the other jobs, so this one is cancelled here.
+	jobCtx, cancel := context.WithCancelCause(context.Background())
 	w.jobMutex.Lock()
-	w.currentJob = job
+	w.jobs[job.JobID].cancel = cancel
+	select {
+	case <-w.shutdownCh:
+		cancel(errShuttingDown)
+	default:
+	}
 	w.jobMutex.Unlock()
+	defer cancel(nil)
 	
-	defer func() {
-		w.jobMutex.Lock()
-		w.currentJob = nil
-		w.cancelJob = nil
-		w.jobMutex.Unlock()
-	}()
+	startTime := time.Now()
 	
-	// Create cancellable context
-	jobCtx, cancel := context.WithCancel(context.Background())
-	w.cancelJob = cancel
-	defer cancel()
+	// Don't start a job that would run out of disk part way through
+	var diskRetry bool
+	var diskErr error
+	if w.cfg.DiskSpace.Enabled {
+		diskRetry, diskErr = w.checkDiskSpace(jobCtx, job)
+	}
 	
-	startTime := time.Now()
+	// The job may have been stopped while it was checked
+	switch cause := context.Cause(jobCtx); {
+	case errors.Is(cause, errShuttingDown):
+		w.rejectJob(job, &rejection{reason: models.RejectReasonDraining, retryable: true, err: cause})
+		w.record(journal.Record{JobID: job.JobID, Event: journal.EventReleased})
+		return
+	case errors.Is(cause, errJobCancelled):
+		w.finalizeJob(job, nil, cause, time.Since(startTime))
+		return
+	case diskErr != nil:
+		w.rejectJob(job, &rejection{reason: models.RejectReasonInsufficientDisk, retryable: diskRetry, err: diskErr})
+		w.record(journal.Record{JobID: job.JobID, Event: journal.EventReleased})
+		return
+	}
+	
+	// Without an accepted lease the orchestrator may give the job to someone else.
+	// The accept may still have reached it, so the job is handed back explicitly
+	// rather than left leased to a worker that isn't running it.
+	lease, err := w.acceptJob(job)
+	if err != nil {
+		w.rejectJob(job, &rejection{
+			reason:    models.RejectReasonAcceptFailed,
+			retryable: true,
+			err:       fmt.Errorf("failed to accept job: %w", err),
+		})
+		w.record(journal.Record{JobID: job.JobID, Event: journal.EventReleased})
+		return
+	}
+	w.record(journal.Record{JobID: job.JobID, Event: journal.EventStarted})
+	w.jobMutex.Lock()
+	if running, ok := w.jobs[job.JobID]; ok {
+		running.lease = lease.LeaseID
+	}
+	w.jobMutex.Unlock()
 	
 	// Progress channel
 	progressCh := make(chan models.JobProgress, 10)
 	
 	// Start progress reporter
 	progressDone := make(chan struct{})
-	go w.reportProgress(jobCtx, job.JobID, progressCh, progressDone)
+	go w.reportProgress(jobCtx, job.JobID, lease, progressCh, progressDone)
 	
 	// Execute transcoding
-	err := w.transcoder.Execute(jobCtx, job, progressCh)
+	result, err := w.transcoder.Execute(jobCtx, job, progressCh)
 	
 	// Signal progress reporter to stop
 	close(progressCh)
 	<-progressDone
 	
+	if err == nil {
+		w.record(journal.Record{
+			JobID:     job.JobID,
+			Event:     journal.EventCommitted,
+			Outputs:   result.Outputs,
+			Roots:     result.Roots,
+			Playlists: result.Playlists,
+		})
+	}
+	
+	// A cancelled job won't be reassigned, so nothing is kept for a resume.
+	// One that finished before the cancellation got through is reported as is.
+	if err != nil && errors.Is(context.Cause(jobCtx), errJobCancelled) {
+		if discardErr := w.transcoder.DiscardJob(job); discardErr != nil {
+			slog.Warn("Failed to clean up cancelled job", "job_id", job.JobID, "error", discardErr)
+		}
+		err = errJobCancelled
+	}
+	
+	// Interrupted by a shutdown, the job keeps its checkpoint, so it can be
+	// requeued right away and resumed if it comes back here
+	if err != nil && errors.Is(context.Cause(jobCtx), errShuttingDown) {
+		err = errShuttingDown
+	}
+	
+	// A job whose lease was lost may already run on another worker, which the
+	// result of this run must not override. Its staging dirs on the NAS may be
+	// that worker's now too, so the checkpoint is kept rather than discarded.
+	if err != nil && errors.Is(context.Cause(jobCtx), errLeaseLost) {
+		slog.Warn("Job stopped after losing its lease, not finalizing", "job_id", job.JobID)
+		w.record(journal.Record{JobID: job.JobID, Event: journal.EventReleased})
+		return
+	}
+	
 	// Finalize job
 	duration := time.Since(startTime)
-	w.finalizeJob(job, err, duration)
+	w.finalizeJob(job, result, err, duration)
+}
+
+// checkDiskSpace compares the space a job is estimated to need with the free
+// space on the temp and NAS disks, keeping min_free_gb free on both. Space set
+// aside by other running jobs doesn't count as free; this job's estimate is set
+// aside before checking, so two jobs starting together can't both take the same
+// space. A job that can never fit is an error; retry is set when it only has to
+// wait for space.
+func (w *Worker) checkDiskSpace(ctx context.Context, job *models.JobSpec) (retry bool, err error) {
+	estimate, err := w.transcoder.EstimateSpace(ctx, job)
+	if err != nil {
+		// The job itself reports a missing or unreadable input
+		slog.Warn("Failed to estimate disk space, starting job anyway", "job_id", job.JobID, "error", err)
+		return false, nil
+	}
+	
+	margin := w.cfg.DiskSpace.Margin
+	tempNeeded := uint64(float64(estimate.TempBytes) * margin)
+	outputNeeded := uint64(float64(estimate.OutputBytes) * margin)
+	
+	slog.Info("Estimated disk space",
+		"job_id", job.JobID,
+		"temp_bytes", tempNeeded,
+		"output_bytes", outputNeeded)
+	
+	if quota := uint64(w.cfg.DiskSpace.TempQuotaGB) << 30; quota > 0 && tempNeeded > quota {
+		return false, fmt.Errorf("job needs %s of temp space, above the %s quota", formatBytes(tempNeeded), formatBytes(quota))
+	}
+	
+	// Set aside before checking; released with the job's slot
+	var tempReserved, outputReserved uint64
+	w.jobMutex.Lock()
+	for id, running := range w.jobs {
+		if id == job.JobID {
+			running.tempBytes, running.outputBytes = tempNeeded, outputNeeded
+			continue
+		}
+		tempReserved += running.tempBytes
+		outputReserved += running.outputBytes
+	}
+	w.jobMutex.Unlock()
+	
+	if retry, err := w.checkFreeSpace(ctx, "temp_dir", w.cfg.TempDir, tempNeeded, tempReserved); err != nil {
+		return retry, err
+	}
+	if w.cfg.Storage.Backend == "filesystem" {
+		return w.checkFreeSpace(ctx, "nas_mount_path", w.cfg.NasMountPath, outputNeeded, outputReserved)
+	}
+	return false, nil
+}
+
+// checkFreeSpace checks that needed bytes fit on the disk holding path, next to
+// the reserved bytes other running jobs still expect to write there
+func (w *Worker) checkFreeSpace(ctx context.Context, name, path string, needed, reserved uint64) (retry bool, err error) {
+	free, total, err := monitor.DiskSpace(ctx, path)
+	if err != nil {
+		return true, err
+	}
+	
+	reserve := uint64(w.cfg.DiskSpace.MinFreeGB) << 30
+	switch {
+	case needed+reserve > total:
+		return false, fmt.Errorf("job needs %s on %s (%s), which only holds %s", formatBytes(needed), name, path, formatBytes(total))
+	case needed+reserve+reserved > free && reserved > 0:
+		return true, fmt.Errorf("job needs %s on %s (%s), only %s free and %s of it reserved by running jobs", formatBytes(needed), name, path, formatBytes(free), formatBytes(reserved))
+	case needed+reserve > free:
+		return true, fmt.Errorf("job needs %s on %s (%s), only %s free", formatBytes(needed), name, path, formatBytes(free))
+	}
+	return false, nil
+}
+
+// formatBytes renders a byte count in GiB for log and error messages
+func formatBytes(bytes uint64) string {
+	return fmt.Sprintf("%.1f GB", float64(bytes)/(1<<30))
+}
+
+// releaseJob frees a job's slot once it has finished or wasn't started
+func (w *Worker) releaseJob(jobID string) {
+	w.jobMutex.Lock()
+	delete(w.jobs, jobID)
+	w.jobMutex.Unlock()
+}
+
+// acceptJob tells the orchestrator the job is starting and returns its lease
+func (w *Worker) acceptJob(job *models.JobSpec) (*models.JobLease, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	
+	lease, err := w.client.AcceptJob(ctx, job.JobID)
+	if err != nil {
+		return nil, err
+	}
+	
+	slog.Info("Accepted job", "job_id", job.JobID, "lease_id", lease.LeaseID, "ttl_sec", lease.TTLSec)
+	return lease, nil
 }
 
-// reportProgress sends periodic progress updates
-func (w *Worker) reportProgress(ctx context.Context, jobID string, progressCh <-chan models.JobProgress, done chan<- struct{}) {
+// rejectJob hands an assigned job back to the orchestrator without starting it
+func (w *Worker) rejectJob(job *models.JobSpec, rej *rejection) {
+	slog.Warn("Rejecting job",
+		"job_id", job.JobID,
+		"reason", rej.reason,
+		"retryable", rej.retryable,
+		"error", rej.err)
+	
+	payload := models.JobRejectPayload{
+		Reason:    rej.reason,
+		Message:   rej.err.Error(),
+		Retryable: rej.retryable,
+	}
+	if err := w.outbox.RejectJob(job.JobID, payload); err != nil {
+		slog.Error("Failed to reject job", "job_id", job.JobID, "error", err)
+	}
+}
+
+// stopRunningJob stops a job, with cause telling executeJob why. ffmpeg is
+// killed and nothing more is committed.
+func (w *Worker) stopRunningJob(jobID string, cause error) {
+	w.jobMutex.Lock()
+	defer w.jobMutex.Unlock()
+	
+	running, ok := w.jobs[jobID]
+	if !ok || running.cancel == nil {
+		slog.Debug("Ignoring stop of a job that isn't running", "job_id", jobID, "reason", cause)
+		return
+	}
+	
+	slog.Warn("Stopping job", "job_id", jobID, "reason", cause)
+	running.cancel(cause)
+}
+
+// reportProgress sends periodic progress updates, which also renew the job
+// lease. While there is no progress to report an update is still sent once a
+// third of the TTL has passed. If the orchestrator refuses the lease, or it
+// couldn't be renewed for a whole TTL, the job is stopped.
+func (w *Worker) reportProgress(ctx context.Context, jobID string, lease *models.JobLease, progressCh <-chan models.JobProgress, done chan<- struct{}) {
 	defer close(done)
 	
 	var lastProgress models.JobProgress
+	ttl := time.Duration(lease.TTLSec) * time.Second
+	lastRenewal := time.Now()
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 	
@@ -331,7 +891,8 @@ func (w *Worker) reportProgress(ctx context.Context, jobID string, progressCh <-
 			lastProgress = progress
 			
 		case <-ticker.C:
-			if lastProgress.Percent > 0 {
+			renewDue := ttl > 0 && time.Since(lastRenewal) >= ttl/3
+			if lastProgress.Percent > 0 || renewDue {
 				updateCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 				
 				payload := models.JobStatusPayload{
@@ -340,10 +901,25 @@ func (w *Worker) reportProgress(ctx context.Context, jobID string, progressCh <-
 					Progress:   lastProgress.Percent,
 					CurrentFPS: int(lastProgress.FPS),
 					ETASec:     lastProgress.ETA,
+					LeaseID:    lease.LeaseID,
 				}
 				
-				if err := w.client.UpdateJobStatus(updateCtx, jobID, payload); err != nil {
+				statusResp, err := w.client.UpdateJobStatus(updateCtx, jobID, payload)
+				switch {
+				case errors.Is(err, client.ErrJobConflict):
+					slog.Error("Orchestrator refused the job lease", "job_id", jobID)
+					w.stopRunningJob(jobID, errLeaseLost)
+				case err != nil:
 					slog.Warn("Failed to send progress update", "error", err)
+					if ttl > 0 && time.Since(lastRenewal) >= ttl {
+						slog.Error("Job lease expired without renewal", "job_id", jobID, "ttl_sec", lease.TTLSec)
+						w.stopRunningJob(jobID, errLeaseLost)
+					}
+				default:
+					lastRenewal = time.Now()
+					if statusResp.Cancel {
+						w.stopRunningJob(jobID, errJobCancelled)
+					}
 				}
 				cancel()
 			}
@@ -355,23 +931,41 @@ func (w *Worker) reportProgress(ctx context.Context, jobID string, progressCh <-
 }
 
 // finalizeJob reports completion or failure
-func (w *Worker) finalizeJob(job *models.JobSpec, jobErr error, duration time.Duration) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	
+func (w *Worker) finalizeJob(job *models.JobSpec, result *transcoder.Result, jobErr error, duration time.Duration) {
 	payload := models.JobResultPayload{
 		Metrics: models.JobMetrics{
 			TotalTimeMS: duration.Milliseconds(),
 		},
 	}
 	
-	if jobErr != nil {
+	if result != nil {
+		payload.Metrics.Renditions = result.Renditions
+		payload.Warnings = result.Warnings
+		payload.Complexity = result.Complexity
+		payload.Metrics.Upload = result.Upload
+	}
+	
+	if errors.Is(jobErr, errJobCancelled) {
+		slog.Info("Job cancelled",
+			"job_id", job.JobID,
+			"duration_ms", duration.Milliseconds())
+		payload.Status = "CANCELLED"
+	} else if errors.Is(jobErr, errShuttingDown) || errors.Is(jobErr, errWorkerRestarted) {
+		slog.Warn("Job interrupted",
+			"job_id", job.JobID,
+			"duration_ms", duration.Milliseconds())
+		payload.Status = "INTERRUPTED"
+		payload.ErrorMsg = jobErr.Error()
+	} else if jobErr != nil {
 		slog.Error("Job failed",
 			"job_id", job.JobID,
 			"error", jobErr,
 			"duration_ms", duration.Milliseconds())
 		payload.Status = "FAILED"
 		payload.ErrorMsg = jobErr.Error()
+		if errors.Is(jobErr, transcoder.ErrOutputExists) {
+			payload.ErrorCode = models.ErrorCodeOutputExists
+		}
 	} else {
 		slog.Info("Job completed",
 			"job_id", job.JobID,
@@ -379,39 +973,145 @@ func (w *Worker) finalizeJob(job *models.JobSpec, jobErr error, duration time.Du
 			"duration_ms", duration.Milliseconds())
 		payload.Status = "COMPLETED"
 		
-		// Construct manifest URL
+		// Construct manifest URL. A master playlist belongs in the destination
+		// root, which differs from dest_path when the output was versioned. Without
+		// one, the first rendition's media playlist is in its rendition dir.
 		if len(job.Outputs) > 0 {
 			outputPath := job.Outputs[0].DestPath
-			relativeOutputPath := strings.TrimPrefix(outputPath, w.cfg.NasMountPath)
-			relativeOutputPath = strings.TrimPrefix(relativeOutputPath, "/")
-			
 			playlistName := job.GetMasterPlaylistName()
-			payload.ManifestURL = fmt.Sprintf("/%s/%s", relativeOutputPath, playlistName)
+			if result != nil && len(result.Outputs) > 0 {
+				if job.HLSSettings.MasterPlaylistName != "" && len(result.Roots) > 0 {
+					outputPath = result.Roots[0]
+				} else if job.HLSSettings.MasterPlaylistName == "" && len(result.Playlists) > 0 {
+					outputPath = result.Outputs[0]
+					playlistName = result.Playlists[0] // Named by the output playlist template
+				}
+			}
+			// Relative to the NAS mount, or to the bucket prefix on object storage
+			payload.ManifestURL = fmt.Sprintf("/%s/%s", w.store.Rel(outputPath), playlistName)
+			
+			// Only a rendition dir holds a checksum manifest, a destination root above it doesn't
+			if result != nil && len(result.Outputs) > 0 && outputPath == result.Outputs[0] && len(result.Renditions) > 0 {
+				payload.ManifestSHA256 = result.Renditions[0].ManifestSHA256
+			}
 			
 			slog.Info("Generated manifest", "url", payload.ManifestURL)
 		}
 	}
 	
-	if err := w.client.FinalizeJob(ctx, job.JobID, payload); err != nil {
+	if err := w.outbox.FinalizeJob(job.JobID, payload); err != nil {
 		slog.Error("Failed to finalize job", "job_id", job.JobID, "error", err)
+		return // Left open in the journal, so the next start reports it again
+	}
+	w.record(journal.Record{JobID: job.JobID, Event: journal.EventFinalized, Status: payload.Status})
+}
+
+// startDrain enters drain mode: no new jobs are taken, and the worker exits
+// once the running ones have finished
+func (w *Worker) startDrain(reason string) {
+	w.drainOnce.Do(func() {
+		slog.Info("Entering drain mode, taking no new jobs", "reason", reason)
+		close(w.drainCh)
+	})
+}
+
+// warnStopTimeout warns when the worker appears to run under a service manager
+// whose default stop timeout is shorter than drain.timeout. The manager kills
+// the worker once its own timeout passes, and jobs still running then are
+// neither finalized nor is the worker deregistered.
+func (w *Worker) warnStopTimeout() {
+	supervisor, timeout, hint := "", time.Duration(0), ""
+	if os.Getenv("INVOCATION_ID") != "" {
+		supervisor, timeout, hint = "systemd", 90*time.Second, "TimeoutStopSec= in the unit"
+	} else if _, err := os.Stat("/.dockerenv"); err == nil {
+		supervisor, timeout, hint = "docker", 10*time.Second, "docker run --stop-timeout or stop_grace_period in compose"
+	}
+	if supervisor == "" || w.cfg.Drain.Timeout <= timeout {
+		return
+	}
+	
+	slog.Warn("Drain timeout is longer than the default stop timeout of the service manager, running jobs may be killed before they finish",
+		"supervisor", supervisor,
+		"default_stop_timeout", timeout,
+		"drain_timeout", w.cfg.Drain.Timeout,
+		"raise_with", hint)
+}
+
+// draining reports whether drain mode has started
+func (w *Worker) draining() bool {
+	select {
+	case <-w.drainCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitForJobs lets running jobs finish, for at most drain.timeout. A shutdown
+// signal stops the wait early; jobs still running are then cancelled by shutdown.
+func (w *Worker) waitForJobs(sigCh <-chan os.Signal) {
+	deadline := time.NewTimer(w.cfg.Drain.Timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	
+	for {
+		w.jobMutex.Lock()
+		running := len(w.jobs)
+		w.jobMutex.Unlock()
+		
+		if running == 0 {
+			slog.Info("Drained, no jobs running")
+			return
+		}
+		
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			slog.Warn("Drain timeout reached", "running_jobs", running, "timeout", w.cfg.Drain.Timeout)
+			return
+		case sig := <-sigCh:
+			if slices.Contains(drainSignals, sig) {
+				continue // Already draining
+			}
+			slog.Warn("Signal received while draining, not waiting for running jobs", "signal", sig.String(), "running_jobs", running)
+			return
+		}
 	}
 }
 
 // shutdown gracefully stops the worker
 func (w *Worker) shutdown() {
-	// Cancel current job if any
+	// Cancel running jobs if any, and signal all goroutines to stop. Both
+	// happen under the lock so a job starting now sees the shutdown.
 	w.jobMutex.Lock()
-	if w.cancelJob != nil {
-		slog.Warn("Cancelling current job due to shutdown")
-		w.cancelJob()
+	for jobID, running := range w.jobs {
+		if running.cancel != nil {
+			slog.Warn("Cancelling job due to shutdown", "job_id", jobID)
+			running.cancel(errShuttingDown)
+		}
 	}
-	w.jobMutex.Unlock()
-	
-	// Signal all goroutines to stop
 	close(w.shutdownCh)
+	w.jobMutex.Unlock()
 	
-	// Wait for goroutines to finish
+	// Wait for goroutines to finish, including jobs reporting INTERRUPTED
 	w.wg.Wait()
 	
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	
+	// One last try at queued calls, whatever is left is sent on the next start
+	if pending := w.outbox.Flush(ctx); pending > 0 {
+		slog.Warn("Exiting with undelivered orchestrator calls in the outbox", "count", pending, "dir", w.cfg.Outbox.Dir)
+	}
+	
+	if err := w.client.Deregister(ctx); err != nil {
+		slog.Error("Failed to deregister worker", "error", err)
+	}
+	
+	if w.journal != nil {
+		w.journal.Close()
+	}
+	
 	slog.Info("Shutdown complete")
 }
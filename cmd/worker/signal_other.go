@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// drainSignals start drain mode without a shutdown having been asked for.
+// Other platforms have no SIGUSR1; drain mode is still entered on shutdown
+// signals and at the orchestrator's request.
+var drainSignals = []os.Signal{}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignals start drain mode without a shutdown having been asked for
+var drainSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"transcode-worker/internal/config"
+)
+
+// Signature headers, set on signed requests and expected on their responses
+const (
+	headerTimestamp = "X-Signature-Timestamp" // Unix seconds
+	headerNonce     = "X-Signature-Nonce"     // Random per request, echoed into the response signature
+	headerSignature = "X-Signature"           // Hex HMAC-SHA256
+)
+
+// maxSignedResponse bounds the response body read for verification
+const maxSignedResponse = 10 << 20
+
+// ErrBadSignature is returned for orchestrator responses that aren't signed
+// with the shared secret, or whose signature is stale
+var ErrBadSignature = errors.New("orchestrator response signature invalid")
+
+// authTransport authenticates every attempt of a request to the orchestrator.
+// A bearer token is sent when configured. With an HMAC secret, each attempt
+// gets a fresh timestamp and nonce and is signed over
+//
+//	METHOD \n REQUEST-URI \n WORKER-ID \n TIMESTAMP \n NONCE \n HEX(SHA256(BODY))
+//
+// and the response must be signed over
+//
+//	STATUS \n NONCE \n TIMESTAMP \n HEX(SHA256(BODY))
+//
+// with the request's nonce, so a response can't be replayed for another request.
+type authTransport struct {
+	base     http.RoundTripper
+	workerID string
+	token    string
+	secret   []byte // nil when signing is off
+	verify   bool
+	maxSkew  time.Duration
+}
+
+// newAuthTransport wraps base, or returns it unchanged when no auth is configured
+func newAuthTransport(base http.RoundTripper, cfg *config.Config) http.RoundTripper {
+	auth := cfg.Auth
+	if auth.Token == "" && auth.HMACSecret == "" {
+		return base
+	}
+
+	t := &authTransport{
+		base:     base,
+		workerID: cfg.WorkerID,
+		token:    auth.Token,
+		maxSkew:  auth.MaxSkew,
+	}
+	if auth.HMACSecret != "" {
+		t.secret = []byte(auth.HMACSecret)
+		t.verify = auth.VerifyResponses
+	}
+	return t
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	if t.secret == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonceHex := hex.EncodeToString(nonce)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerNonce, nonceHex)
+	req.Header.Set(headerSignature, t.sign(req.Method, req.URL.RequestURI(), t.workerID, timestamp, nonceHex, bodyHash(body)))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !t.verify {
+		return resp, err
+	}
+
+	if err := t.verifyResponse(resp, nonceHex); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// verifyResponse checks the signature of a response, leaving its body readable
+func (t *authTransport) verifyResponse(resp *http.Response, nonce string) error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSignedResponse))
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	timestamp := resp.Header.Get(headerTimestamp)
+	signature := resp.Header.Get(headerSignature)
+	if timestamp == "" || signature == "" {
+		return fmt.Errorf("%w: status %d response is not signed", ErrBadSignature, resp.StatusCode)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad timestamp %q", ErrBadSignature, timestamp)
+	}
+	if skew := time.Since(time.Unix(seconds, 0)).Abs(); skew > t.maxSkew {
+		return fmt.Errorf("%w: timestamp off by %s", ErrBadSignature, skew.Round(time.Second))
+	}
+
+	expected := t.sign(strconv.Itoa(resp.StatusCode), nonce, timestamp, bodyHash(body))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("%w: status %d response signature mismatch", ErrBadSignature, resp.StatusCode)
+	}
+	return nil
+}
+
+// sign returns the hex HMAC-SHA256 of the fields joined by newlines
+func (t *authTransport) sign(fields ...string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	for i, field := range fields {
+		if i > 0 {
+			mac.Write([]byte("\n"))
+		}
+		mac.Write([]byte(field))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
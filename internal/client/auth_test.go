@@ -0,0 +1,193 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+
+	"transcode-worker/internal/config"
+)
+
+const testSecret = "shared-secret"
+
+func newTestAuthTransport(verify bool) *authTransport {
+	return newAuthTransport(http.DefaultTransport, &config.Config{
+		WorkerID: "worker-1",
+		Auth: config.AuthConfig{
+			Token:           "token-1",
+			HMACSecret:      testSecret,
+			VerifyResponses: verify,
+			MaxSkew:         time.Minute,
+		},
+	}).(*authTransport)
+}
+
+// The expected signatures were computed independently of this package
+func TestAuthSignedString(t *testing.T) {
+	auth := newTestAuthTransport(false)
+	tests := []struct {
+		fields []string
+		want   string
+	}{
+		{
+			[]string{"POST", "/api/v1/jobs/job-1/finalize", "worker-1", "1700000000",
+				"00112233445566778899aabbccddeeff", bodyHash([]byte(`{"status":"COMPLETED"}`))},
+			"6510edc177163b6dc6498109e0a68f117a2730dd045c751da58a8ae695d3460a",
+		},
+		{
+			[]string{"GET", "/api/v1/jobs?limit=1", "worker-1", "1700000000",
+				"ffeeddccbbaa99887766554433221100", bodyHash(nil)},
+			"0b8e2ddb729554cdae3a7101ef9ae6b869161b7421758e7ebbb544597fa9e8e9",
+		},
+		{
+			[]string{"200", "00112233445566778899aabbccddeeff", "1700000005", bodyHash([]byte(`{"ok":true}`))},
+			"09b290b66c31ea05268a93a9a7afe47611367c498fbd8b72af231a1f0e18c895",
+		},
+	}
+	for _, tt := range tests {
+		if got := auth.sign(tt.fields...); got != tt.want {
+			t.Errorf("sign(%q) = %s, want %s", strings.Join(tt.fields, `\n`), got, tt.want)
+		}
+	}
+	if got := bodyHash(nil); got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("bodyHash(nil) = %s", got)
+	}
+}
+
+// signingServer checks each request's signature and answers it through respond
+func signingServer(t *testing.T, respond func(w http.ResponseWriter, r *http.Request, body []byte)) *httptest.Server {
+	t.Helper()
+	auth := newTestAuthTransport(false)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := auth.sign(r.Method, r.URL.RequestURI(), r.Header.Get("X-Worker-ID"),
+			r.Header.Get(headerTimestamp), r.Header.Get(headerNonce), bodyHash(body))
+		if r.Header.Get(headerSignature) != want || r.Header.Get("Authorization") != "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		respond(w, r, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// signResponse signs a response the way the orchestrator does
+func signResponse(w http.ResponseWriter, status int, nonce string, timestamp time.Time, body string) {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	w.Header().Set(headerTimestamp, ts)
+	w.Header().Set(headerSignature, newTestAuthTransport(false).sign(strconv.Itoa(status), nonce, ts, bodyHash([]byte(body))))
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
+
+func TestAuthVerifiesResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter, r *http.Request)
+		wantErr bool
+	}{
+		{"signed", func(w http.ResponseWriter, r *http.Request) {
+			signResponse(w, http.StatusOK, r.Header.Get(headerNonce), time.Now(), `{"ok":true}`)
+		}, false},
+		{"unsigned", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, `{"ok":true}`)
+		}, true},
+		{"bad signature", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerTimestamp, strconv.FormatInt(time.Now().Unix(), 10))
+			w.Header().Set(headerSignature, strings.Repeat("0", 64))
+			io.WriteString(w, `{"ok":true}`)
+		}, true},
+		{"other request's nonce", func(w http.ResponseWriter, r *http.Request) {
+			signResponse(w, http.StatusOK, "00112233445566778899aabbccddeeff", time.Now(), `{"ok":true}`)
+		}, true},
+		{"skewed timestamp", func(w http.ResponseWriter, r *http.Request) {
+			signResponse(w, http.StatusOK, r.Header.Get(headerNonce), time.Now().Add(-5*time.Minute), `{"ok":true}`)
+		}, true},
+		{"status changed in transit", func(w http.ResponseWriter, r *http.Request) {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			w.Header().Set(headerTimestamp, ts)
+			w.Header().Set(headerSignature, newTestAuthTransport(false).sign("200", r.Header.Get(headerNonce), ts, bodyHash([]byte(`{"ok":true}`))))
+			w.WriteHeader(http.StatusConflict)
+			io.WriteString(w, `{"ok":true}`)
+		}, true},
+	}
+	for _, tt := range tests {
+		server := signingServer(t, func(w http.ResponseWriter, r *http.Request, _ []byte) { tt.respond(w, r) })
+		client := &http.Client{Transport: newTestAuthTransport(true)}
+
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v1/jobs/job-1/finalize", strings.NewReader(`{"status":"COMPLETED"}`))
+		req.Header.Set("X-Worker-ID", "worker-1")
+		resp, err := client.Do(req)
+		if tt.wantErr {
+			if !errors.Is(err, ErrBadSignature) {
+				t.Errorf("%s: err = %v, want ErrBadSignature", tt.name, err)
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != `{"ok":true}` {
+			t.Errorf("%s: got %d %q", tt.name, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestAuthResignsRetries(t *testing.T) {
+	var mu sync.Mutex
+	var nonces, timestamps []string
+	server := signingServer(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		nonces = append(nonces, r.Header.Get(headerNonce))
+		timestamps = append(timestamps, r.Header.Get(headerTimestamp))
+		if string(body) != `{"status":"COMPLETED"}` {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// Fail long enough for the last attempt to land in a later second
+		if len(nonces) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// The same layering as NewOrchestratorClient, with short waits
+	retryClient := retryablehttp.NewClient()
+	retryClient.RetryMax = 3
+	retryClient.RetryWaitMin = 600 * time.Millisecond
+	retryClient.RetryWaitMax = 600 * time.Millisecond
+	retryClient.Logger = nil
+	retryClient.HTTPClient.Transport = newTestAuthTransport(false)
+	client := &OrchestratorClient{baseURL: server.URL, workerID: "worker-1", httpClient: retryClient.StandardClient()}
+
+	if err := client.send(t.Context(), http.MethodPost, "/api/v1/jobs/job-1/finalize", []byte(`{"status":"COMPLETED"}`), "", nil); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if len(nonces) != 3 {
+		t.Fatalf("%d attempts reached the server signed, want 3", len(nonces))
+	}
+	if nonces[0] == nonces[1] || nonces[1] == nonces[2] || nonces[0] == nonces[2] {
+		t.Errorf("retries reused a nonce: %v", nonces)
+	}
+	if timestamps[0] == timestamps[2] {
+		t.Errorf("retry 1.2s later kept the first attempt's timestamp %s", timestamps[0])
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -29,6 +30,9 @@ func NewOrchestratorClient(cfg *config.Config) *OrchestratorClient {
 	retryClient.RetryWaitMax = 5 * time.Second
 	retryClient.Logger = nil // Silence default debug logger
 
+	// Under the retry layer, so every attempt is signed anew
+	retryClient.HTTPClient.Transport = newAuthTransport(retryClient.HTTPClient.Transport, cfg)
+
 	return &OrchestratorClient{
 		baseURL:    cfg.OrchestratorURL,
 		workerID:   cfg.WorkerID,
@@ -38,15 +42,25 @@ func NewOrchestratorClient(cfg *config.Config) *OrchestratorClient {
 
 // doRequest is the core HTTP request handler with error interception
 func (c *OrchestratorClient) doRequest(ctx context.Context, method, path string, payload interface{}, response interface{}) error {
-	url := fmt.Sprintf("%s%s", c.baseURL, path)
-
-	var body io.Reader
+	var jsonBytes []byte
 	if payload != nil {
-		jsonBytes, err := json.Marshal(payload)
+		var err error
+		jsonBytes, err = json.Marshal(payload)
 		if err != nil {
 			return fmt.Errorf("failed to marshal payload: %w", err)
 		}
-		body = bytes.NewBuffer(jsonBytes)
+	}
+	return c.send(ctx, method, path, jsonBytes, "", response)
+}
+
+// send makes one request with an already encoded body. An idempotency key lets
+// the orchestrator recognize a call it has already applied.
+func (c *OrchestratorClient) send(ctx context.Context, method, path string, jsonBytes []byte, idempotencyKey string, response interface{}) error {
+	url := fmt.Sprintf("%s%s", c.baseURL, path)
+
+	var body io.Reader
+	if jsonBytes != nil {
+		body = bytes.NewReader(jsonBytes)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, method, url, body)
@@ -56,6 +70,9 @@ func (c *OrchestratorClient) doRequest(ctx context.Context, method, path string,
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Worker-ID", c.workerID)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -68,13 +85,18 @@ func (c *OrchestratorClient) doRequest(ctx context.Context, method, path string,
 		return &OrchestratorStateError{StatusCode: resp.StatusCode}
 	}
 
+	// Handle 409 - The job is no longer this worker's (lease expired, reassigned or cancelled)
+	if resp.StatusCode == http.StatusConflict {
+		return ErrJobConflict
+	}
+
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("API returned error status: %d", resp.StatusCode)
+		return &APIError{StatusCode: resp.StatusCode}
 	}
 
-	// Decode response if expected
+	// Decode response if expected, an empty body leaves it unchanged
 	if response != nil && resp.StatusCode != http.StatusNoContent {
-		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil && !errors.Is(err, io.EOF) {
 			return fmt.Errorf("failed to decode response: %w", err)
 		}
 	}
@@ -82,6 +104,18 @@ func (c *OrchestratorClient) doRequest(ctx context.Context, method, path string,
 	return nil
 }
 
+// ErrJobConflict is returned when the orchestrator no longer assigns the job to this worker
+var ErrJobConflict = errors.New("job is no longer assigned to this worker")
+
+// APIError is returned for error statuses without a more specific error
+type APIError struct {
+	StatusCode int
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API returned error status: %d", e.StatusCode)
+}
+
 // OrchestratorStateError indicates the orchestrator lost worker state
 type OrchestratorStateError struct {
 	StatusCode int
@@ -110,6 +144,18 @@ func (c *OrchestratorClient) Register(ctx context.Context, capabilities []string
 	return nil
 }
 
+// Deregister tells the orchestrator the worker is going away, so it doesn't
+// wait for its next sync
+func (c *OrchestratorClient) Deregister(ctx context.Context) error {
+	payload := models.DeregistrationPayload{WorkerID: c.workerID}
+
+	slog.Info("Deregistering worker from orchestrator", "worker_id", c.workerID)
+	if err := c.doRequest(ctx, "POST", "/api/v1/workers/deregister", payload, nil); err != nil {
+		return fmt.Errorf("deregistration failed: %w", err)
+	}
+	return nil
+}
+
 // ===== Worker Sync (Bidirectional Heartbeat + Job Assignment) =====
 
 // Sync sends worker state and receives potential job assignment
@@ -130,14 +176,27 @@ func (c *OrchestratorClient) Sync(ctx context.Context, payload models.SyncPayloa
 
 // ===== Job Status Updates =====
 
-// UpdateJobStatus reports transcoding progress
-func (c *OrchestratorClient) UpdateJobStatus(ctx context.Context, jobID string, payload models.JobStatusPayload) error {
+// UpdateJobStatus reports transcoding progress. The response may ask the worker to cancel the job.
+func (c *OrchestratorClient) UpdateJobStatus(ctx context.Context, jobID string, payload models.JobStatusPayload) (*models.JobStatusResponse, error) {
+	var statusResp models.JobStatusResponse
+
 	path := fmt.Sprintf("/api/v1/jobs/%s", jobID)
-	return c.doRequest(ctx, "PATCH", path, payload, nil)
+	if err := c.doRequest(ctx, "PATCH", path, payload, &statusResp); err != nil {
+		return nil, err
+	}
+	return &statusResp, nil
 }
 
-// FinalizeJob reports job completion or failure
-func (c *OrchestratorClient) FinalizeJob(ctx context.Context, jobID string, payload models.JobResultPayload) error {
-	path := fmt.Sprintf("/api/v1/jobs/%s/finalize", jobID)
-	return c.doRequest(ctx, "POST", path, payload, nil)
+// ===== Job Acceptance =====
+
+// AcceptJob tells the orchestrator an assigned job is starting and returns its lease
+func (c *OrchestratorClient) AcceptJob(ctx context.Context, jobID string) (*models.JobLease, error) {
+	var lease models.JobLease
+
+	path := fmt.Sprintf("/api/v1/jobs/%s/accept", jobID)
+	payload := models.JobAcceptPayload{WorkerID: c.workerID}
+	if err := c.doRequest(ctx, "POST", path, payload, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
 }
@@ -0,0 +1,362 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"transcode-worker/internal/config"
+	"transcode-worker/pkg/models"
+)
+
+// outboxRetryMin is the wait before the first retry of an undelivered call
+const outboxRetryMin = time.Second
+
+// outboxSendTimeout bounds a single delivery attempt
+const outboxSendTimeout = 30 * time.Second
+
+// Outbox holds calls the orchestrator must eventually receive, finalize,
+// reject and status updates that mustn't be lost, until it acknowledges them.
+// Each call is written to its own file in the outbox dir before it is sent, so
+// calls made during an orchestrator outage survive a worker restart. The calls
+// of a job are delivered in the order they were made. Every call carries an
+// idempotency key, so one that was applied but not acknowledged is recognized
+// when it is sent again.
+type Outbox struct {
+	client     *OrchestratorClient
+	dir        string
+	maxBackoff time.Duration
+	maxAge     time.Duration
+
+	wake    chan struct{}
+	deliver sync.Mutex             // Held by a delivery pass
+	retries map[string]outboxRetry // By entry file name, guarded by deliver
+
+	reregister func(ctx context.Context) error // Called when the orchestrator lost the worker's state
+
+	seqMu   sync.Mutex
+	lastSeq int64 // Keeps entry names increasing even if calls share a timestamp
+}
+
+// outboxEntry is a call as stored in the outbox dir
+type outboxEntry struct {
+	Key       string          `json:"key"` // Idempotency key
+	JobID     string          `json:"job_id"`
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// outboxRetry tracks failed attempts of an entry. It isn't persisted, so after
+// a restart every entry is tried right away.
+type outboxRetry struct {
+	attempts int
+	next     time.Time
+}
+
+// NewOutbox creates the outbox in the configured dir, which config.Load created.
+// Entries left by an earlier run are delivered once Run starts.
+func NewOutbox(cfg *config.Config, c *OrchestratorClient) *Outbox {
+	return &Outbox{
+		client:     c,
+		dir:        cfg.Outbox.Dir,
+		maxBackoff: cfg.Outbox.MaxBackoff,
+		maxAge:     cfg.Outbox.MaxAge,
+		wake:       make(chan struct{}, 1),
+		retries:    make(map[string]outboxRetry),
+	}
+}
+
+// OnStateLost sets how the worker registers again when a call finds that the
+// orchestrator lost its state. The call is sent again once that succeeded.
+func (o *Outbox) OnStateLost(fn func(ctx context.Context) error) {
+	o.reregister = fn
+}
+
+// FinalizeJob queues the report of a job's completion or failure
+func (o *Outbox) FinalizeJob(jobID string, payload models.JobResultPayload) error {
+	path := fmt.Sprintf("/api/v1/jobs/%s/finalize", jobID)
+	return o.enqueue(jobID, "POST", path, payload)
+}
+
+// RejectJob queues handing an assigned job back with the reason it wasn't started
+func (o *Outbox) RejectJob(jobID string, payload models.JobRejectPayload) error {
+	payload.WorkerID = o.client.workerID
+
+	path := fmt.Sprintf("/api/v1/jobs/%s/reject", jobID)
+	return o.enqueue(jobID, "POST", path, payload)
+}
+
+// UpdateJobStatus queues a status update the orchestrator must see, such as a
+// rendition being committed. Routine progress is sent directly instead, a late
+// one is of no use.
+func (o *Outbox) UpdateJobStatus(jobID string, payload models.JobStatusPayload) error {
+	payload.WorkerID = o.client.workerID
+
+	path := fmt.Sprintf("/api/v1/jobs/%s", jobID)
+	return o.enqueue(jobID, "PATCH", path, payload)
+}
+
+// enqueue stores a call and wakes Run to deliver it
+func (o *Outbox) enqueue(jobID, method, path string, payload interface{}) error {
+	jsonBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return err
+	}
+	entry := outboxEntry{
+		Key:       key,
+		JobID:     jobID,
+		Method:    method,
+		Path:      path,
+		Payload:   jsonBytes,
+		CreatedAt: time.Now().UTC(),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox entry: %w", err)
+	}
+
+	// Names sort in the order calls were made
+	name := fmt.Sprintf("%020d-%s.json", o.nextSeq(entry.CreatedAt), key)
+	if err := writeFileSync(filepath.Join(o.dir, name), data); err != nil {
+		return fmt.Errorf("failed to store outbox entry: %w", err)
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// nextSeq returns the timestamp in nanoseconds, or one more than the last
+// returned if that isn't later
+func (o *Outbox) nextSeq(t time.Time) int64 {
+	o.seqMu.Lock()
+	defer o.seqMu.Unlock()
+
+	o.lastSeq = max(t.UnixNano(), o.lastSeq+1)
+	return o.lastSeq
+}
+
+// Run delivers stored calls as they are queued and retries failed ones with
+// exponential backoff, until stop is closed
+func (o *Outbox) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(outboxRetryMin)
+	defer ticker.Stop()
+
+	for {
+		o.deliverDue(ctx, false)
+
+		select {
+		case <-ticker.C:
+		case <-o.wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Flush tries every stored call once, ignoring backoff, and returns how many
+// are still undelivered. Those stay stored for the next run.
+func (o *Outbox) Flush(ctx context.Context) int {
+	return o.deliverDue(ctx, true)
+}
+
+// deliverDue sends the stored calls whose retry is due, oldest first, and
+// returns how many remain. While a call of a job is undelivered, the later
+// calls of that job wait behind it.
+func (o *Outbox) deliverDue(ctx context.Context, all bool) int {
+	o.deliver.Lock()
+	defer o.deliver.Unlock()
+
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		slog.Error("Failed to read outbox", "dir", o.dir, "error", err)
+		return 0
+	}
+
+	pending := 0
+	blocked := make(map[string]bool) // Jobs with an undelivered earlier call
+	reregistered := false            // At most once per pass
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		entry, err := readOutboxEntry(filepath.Join(o.dir, name))
+		if err != nil {
+			slog.Error("Dropping unreadable outbox entry", "file", name, "error", err)
+			o.remove(name)
+			continue
+		}
+
+		retry := o.retries[name]
+		if blocked[entry.JobID] || ctx.Err() != nil || (!all && time.Now().Before(retry.next)) {
+			o.block(blocked, entry)
+			pending++
+			continue
+		}
+
+		err = o.send(ctx, entry)
+
+		// An orchestrator that restarted has to learn about the worker again
+		// before it takes the worker's calls
+		var stateErr *OrchestratorStateError
+		if errors.As(err, &stateErr) && o.reregister != nil && !reregistered {
+			reregistered = true
+			slog.Warn("Orchestrator lost worker state, re-registering before redelivering", "path", entry.Path)
+			if regErr := o.reregister(ctx); regErr != nil {
+				slog.Error("Re-registration failed", "error", regErr)
+			} else {
+				err = o.send(ctx, entry)
+			}
+		}
+
+		switch {
+		case err == nil:
+			slog.Debug("Delivered outbox entry", "path", entry.Path, "key", entry.Key)
+			o.remove(name)
+		case refused(err):
+			slog.Error("Orchestrator refused outbox entry, dropping it", "path", entry.Path, "key", entry.Key, "error", err)
+			o.remove(name)
+		case time.Since(entry.CreatedAt) > o.maxAge:
+			slog.Error("Outbox entry undelivered for too long, dropping it", "path", entry.Path, "key", entry.Key, "created_at", entry.CreatedAt, "error", err)
+			o.remove(name)
+		default:
+			retry.attempts++
+			backoff := o.maxBackoff
+			if shift := retry.attempts - 1; shift < 32 && outboxRetryMin<<shift < backoff {
+				backoff = outboxRetryMin << shift
+			}
+			retry.next = time.Now().Add(backoff)
+			o.retries[name] = retry
+			slog.Warn("Failed to deliver outbox entry, will retry",
+				"path", entry.Path,
+				"attempts", retry.attempts,
+				"retry_in", backoff,
+				"error", err)
+			o.block(blocked, entry)
+			pending++
+		}
+	}
+	return pending
+}
+
+// send makes one delivery attempt of an entry
+func (o *Outbox) send(ctx context.Context, entry outboxEntry) error {
+	sendCtx, cancel := context.WithTimeout(ctx, outboxSendTimeout)
+	defer cancel()
+	return o.client.send(sendCtx, entry.Method, entry.Path, entry.Payload, entry.Key, nil)
+}
+
+// block holds back the later calls of an entry's job
+func (o *Outbox) block(blocked map[string]bool, entry outboxEntry) {
+	if entry.JobID != "" {
+		blocked[entry.JobID] = true
+	}
+}
+
+// remove deletes a delivered or dropped entry. Called with deliver held.
+func (o *Outbox) remove(name string) {
+	delete(o.retries, name)
+	if err := os.Remove(filepath.Join(o.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to remove outbox entry", "file", name, "error", err)
+	}
+}
+
+// refused reports whether the orchestrator rejected a call for good, so
+// sending it again can't succeed: the job isn't this worker's any more (409)
+// or is gone (410), or the call is invalid. A 404 means the orchestrator lost
+// the worker's state and 401/403 that auth is misconfigured or clocks are
+// skewed; those are what the outbox waits out, so they are retried.
+func refused(err error) bool {
+	if errors.Is(err, ErrJobConflict) {
+		return true
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return false
+		}
+		return apiErr.StatusCode < 500
+	}
+	return false
+}
+
+func readOutboxEntry(path string) (outboxEntry, error) {
+	var entry outboxEntry
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// writeFileSync writes a file so it is either complete or absent after a
+// crash: a temp file is synced, then renamed into place
+func writeFileSync(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func newIdempotencyKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate idempotency key: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,293 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"transcode-worker/pkg/models"
+)
+
+// recordedCall is a request as the test orchestrator received it
+type recordedCall struct {
+	method, path, key string
+	body              []byte
+}
+
+// testOrchestrator answers each call with the status status returns for its path
+type testOrchestrator struct {
+	mu     sync.Mutex
+	calls  []recordedCall
+	status func(path string) int
+}
+
+func (o *testOrchestrator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	o.mu.Lock()
+	o.calls = append(o.calls, recordedCall{r.Method, r.URL.Path, r.Header.Get("Idempotency-Key"), body})
+	status := http.StatusOK
+	if o.status != nil {
+		status = o.status(r.URL.Path)
+	}
+	o.mu.Unlock()
+	w.WriteHeader(status)
+}
+
+func (o *testOrchestrator) paths() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	paths := make([]string, len(o.calls))
+	for i, call := range o.calls {
+		paths[i] = call.path
+	}
+	return paths
+}
+
+func newTestOutbox(t *testing.T, dir string, orchestrator *testOrchestrator) *Outbox {
+	t.Helper()
+	server := httptest.NewServer(orchestrator)
+	t.Cleanup(server.Close)
+
+	return &Outbox{
+		client: &OrchestratorClient{
+			baseURL:    server.URL,
+			workerID:   "worker-1",
+			httpClient: server.Client(),
+		},
+		dir:        dir,
+		maxBackoff: time.Minute,
+		maxAge:     time.Hour,
+		wake:       make(chan struct{}, 1),
+		retries:    make(map[string]outboxRetry),
+	}
+}
+
+func TestOutboxDelivers(t *testing.T) {
+	orchestrator := &testOrchestrator{}
+	outbox := newTestOutbox(t, t.TempDir(), orchestrator)
+
+	if err := outbox.RejectJob("job-1", models.JobRejectPayload{Reason: models.RejectReasonBusy, Retryable: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.FinalizeJob("job-2", models.JobResultPayload{Status: "COMPLETED"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending := outbox.Flush(context.Background()); pending != 0 {
+		t.Fatalf("Flush left %d calls", pending)
+	}
+	want := []string{"/api/v1/jobs/job-1/reject", "/api/v1/jobs/job-2/finalize"}
+	if got := orchestrator.paths(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+
+	var reject models.JobRejectPayload
+	if err := json.Unmarshal(orchestrator.calls[0].body, &reject); err != nil {
+		t.Fatal(err)
+	}
+	if reject.WorkerID != "worker-1" || reject.Reason != models.RejectReasonBusy {
+		t.Errorf("reject payload = %+v", reject)
+	}
+
+	entries, _ := os.ReadDir(outbox.dir)
+	if len(entries) != 0 {
+		t.Errorf("outbox dir holds %d entries after delivery", len(entries))
+	}
+}
+
+func TestOutboxRetriesWithSameKey(t *testing.T) {
+	failing := true
+	orchestrator := &testOrchestrator{status: func(string) int {
+		if failing {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	outbox := newTestOutbox(t, t.TempDir(), orchestrator)
+
+	if err := outbox.FinalizeJob("job-1", models.JobResultPayload{Status: "COMPLETED"}); err != nil {
+		t.Fatal(err)
+	}
+	if pending := outbox.Flush(context.Background()); pending != 1 {
+		t.Fatalf("Flush during an outage left %d calls, want 1", pending)
+	}
+
+	// Not due again before its backoff passed
+	if pending := outbox.deliverDue(context.Background(), false); pending != 1 || len(orchestrator.paths()) != 1 {
+		t.Fatalf("retried before the backoff: pending %d, calls %d", pending, len(orchestrator.paths()))
+	}
+
+	orchestrator.mu.Lock()
+	failing = false
+	orchestrator.mu.Unlock()
+	if pending := outbox.Flush(context.Background()); pending != 0 {
+		t.Fatalf("Flush after the outage left %d calls", pending)
+	}
+
+	calls := orchestrator.calls
+	if len(calls) != 2 || calls[0].key == "" || calls[0].key != calls[1].key {
+		t.Errorf("idempotency keys %q and %q, want the same non-empty key", calls[0].key, calls[1].key)
+	}
+}
+
+func TestOutboxKeepsJobOrder(t *testing.T) {
+	down := map[string]bool{"/api/v1/jobs/job-1": true}
+	orchestrator := &testOrchestrator{status: func(path string) int {
+		if down[path] {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	outbox := newTestOutbox(t, t.TempDir(), orchestrator)
+
+	outbox.UpdateJobStatus("job-1", models.JobStatusPayload{Status: "PROCESSING", RenditionDone: "720p_2500k"})
+	outbox.FinalizeJob("job-1", models.JobResultPayload{Status: "COMPLETED"})
+	outbox.FinalizeJob("job-2", models.JobResultPayload{Status: "COMPLETED"})
+
+	// job-1's finalize waits behind its undelivered update, job-2 isn't held up
+	if pending := outbox.Flush(context.Background()); pending != 2 {
+		t.Fatalf("Flush left %d calls, want 2", pending)
+	}
+	want := []string{"/api/v1/jobs/job-1", "/api/v1/jobs/job-2/finalize"}
+	if got := orchestrator.paths(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+
+	orchestrator.mu.Lock()
+	down = nil
+	orchestrator.mu.Unlock()
+	if pending := outbox.Flush(context.Background()); pending != 0 {
+		t.Fatalf("Flush left %d calls", pending)
+	}
+	got := orchestrator.paths()[2:]
+	want = []string{"/api/v1/jobs/job-1", "/api/v1/jobs/job-1/finalize"}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+}
+
+func TestOutboxDropsRefusedCalls(t *testing.T) {
+	tests := []struct {
+		status int
+		kept   bool
+	}{
+		{http.StatusConflict, false},
+		{http.StatusGone, false},
+		{http.StatusBadRequest, false},
+		{http.StatusUnprocessableEntity, false},
+		{http.StatusNotFound, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusForbidden, true},
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		orchestrator := &testOrchestrator{status: func(string) int { return tt.status }}
+		outbox := newTestOutbox(t, t.TempDir(), orchestrator)
+
+		outbox.FinalizeJob("job-1", models.JobResultPayload{Status: "FAILED"})
+		outbox.FinalizeJob("job-1", models.JobResultPayload{Status: "FAILED"})
+
+		pending := outbox.Flush(context.Background())
+		if tt.kept && pending != 2 {
+			t.Errorf("status %d: %d calls kept, want 2", tt.status, pending)
+		}
+		// A dropped call doesn't hold up the job's later calls
+		if !tt.kept && (pending != 0 || len(orchestrator.paths()) != 2) {
+			t.Errorf("status %d: %d calls kept after %d attempts, want both tried and dropped", tt.status, pending, len(orchestrator.paths()))
+		}
+	}
+}
+
+func TestOutboxReregistersWhenStateIsLost(t *testing.T) {
+	registered := false
+	orchestrator := &testOrchestrator{status: func(path string) int {
+		if path == "/api/v1/workers/register" {
+			registered = true
+			return http.StatusOK
+		}
+		if !registered {
+			return http.StatusNotFound
+		}
+		return http.StatusOK
+	}}
+	outbox := newTestOutbox(t, t.TempDir(), orchestrator)
+	registrations := 0
+	outbox.OnStateLost(func(ctx context.Context) error {
+		registrations++
+		return outbox.client.Register(ctx, []string{"720p"})
+	})
+
+	outbox.FinalizeJob("job-1", models.JobResultPayload{Status: "COMPLETED"})
+	outbox.FinalizeJob("job-2", models.JobResultPayload{Status: "COMPLETED"})
+	if pending := outbox.Flush(context.Background()); pending != 0 {
+		t.Fatalf("Flush left %d calls", pending)
+	}
+
+	want := []string{"/api/v1/jobs/job-1/finalize", "/api/v1/workers/register", "/api/v1/jobs/job-1/finalize", "/api/v1/jobs/job-2/finalize"}
+	if got := orchestrator.paths(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("calls %v, want %v", got, want)
+	}
+	if registrations != 1 {
+		t.Errorf("registered %d times, want once", registrations)
+	}
+}
+
+func TestOutboxKeepsCallsWhileUnauthorized(t *testing.T) {
+	status := http.StatusUnauthorized
+	orchestrator := &testOrchestrator{status: func(string) int { return status }}
+	outbox := newTestOutbox(t, t.TempDir(), orchestrator)
+
+	outbox.FinalizeJob("job-1", models.JobResultPayload{Status: "COMPLETED"})
+	if pending := outbox.Flush(context.Background()); pending != 1 {
+		t.Fatalf("Flush while unauthorized left %d calls, want 1", pending)
+	}
+
+	// The token is fixed
+	orchestrator.mu.Lock()
+	status = http.StatusOK
+	orchestrator.mu.Unlock()
+	if pending := outbox.Flush(context.Background()); pending != 0 {
+		t.Fatalf("Flush once authorized left %d calls", pending)
+	}
+	if calls := orchestrator.paths(); len(calls) != 2 {
+		t.Errorf("sent %d calls, want the finalize twice", len(calls))
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	down := &testOrchestrator{status: func(string) int { return http.StatusBadGateway }}
+	before := newTestOutbox(t, dir, down)
+	before.FinalizeJob("job-1", models.JobResultPayload{Status: "COMPLETED"})
+	before.Flush(context.Background())
+
+	up := &testOrchestrator{}
+	after := newTestOutbox(t, dir, up)
+	if pending := after.Flush(context.Background()); pending != 0 {
+		t.Fatalf("Flush after restart left %d calls", pending)
+	}
+	if len(up.calls) != 1 || up.calls[0].key != down.calls[0].key {
+		t.Errorf("restarted outbox sent %d calls, want the stored one with its key", len(up.calls))
+	}
+}
+
+func TestOutboxDropsExpiredCalls(t *testing.T) {
+	orchestrator := &testOrchestrator{status: func(string) int { return http.StatusServiceUnavailable }}
+	outbox := newTestOutbox(t, t.TempDir(), orchestrator)
+	outbox.maxAge = time.Nanosecond
+
+	outbox.FinalizeJob("job-1", models.JobResultPayload{Status: "COMPLETED"})
+	time.Sleep(time.Millisecond)
+	if pending := outbox.Flush(context.Background()); pending != 0 {
+		t.Errorf("expired call kept, %d pending", pending)
+	}
+}
@@ -3,11 +3,17 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/viper"
+	"transcode-worker/pkg/models"
 )
 
 // Config holds all static configuration required by the worker.
@@ -16,8 +22,197 @@ type Config struct {
 	WorkerID        string        `mapstructure:"worker_id"`
 	NasMountPath    string        `mapstructure:"nas_mount_path"`
 	TempDir         string        `mapstructure:"temp_dir"`
+	StateDir        string        `mapstructure:"state_dir"` // Survives reboots, unlike temp_dir
 	SyncInterval    time.Duration `mapstructure:"sync_interval"`
 	LogLevel        string        `mapstructure:"log_level"`
+
+	ChunkedEncoding ChunkedEncodingConfig `mapstructure:"chunked_encoding"`
+	Quality         QualityConfig         `mapstructure:"quality"`
+	Validation      ValidationConfig      `mapstructure:"validation"`
+	Complexity      ComplexityConfig      `mapstructure:"complexity"`
+	Upload          UploadConfig          `mapstructure:"upload"`
+	Storage         StorageConfig         `mapstructure:"storage"`
+	HTTPInput       HTTPInputConfig       `mapstructure:"http_input"`
+	InputCache      InputCacheConfig      `mapstructure:"input_cache"`
+	DiskSpace       DiskSpaceConfig       `mapstructure:"disk_space"`
+	Paths           PathsConfig           `mapstructure:"paths"`
+	NASHealth       NASHealthConfig       `mapstructure:"nas_health"`
+	Output          OutputConfig          `mapstructure:"output"`
+	Slots           SlotsConfig           `mapstructure:"slots"`
+	Drain           DrainConfig           `mapstructure:"drain"`
+	Outbox          OutboxConfig          `mapstructure:"outbox"`
+	Journal         JournalConfig         `mapstructure:"journal"`
+	Auth            AuthConfig            `mapstructure:"auth"`
+}
+
+// ChunkedEncodingConfig controls splitting a software-encoded rendition into
+// keyframe-aligned time chunks that are encoded in parallel.
+type ChunkedEncodingConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	ChunkDuration time.Duration `mapstructure:"chunk_duration"`
+	MaxParallel   int           `mapstructure:"max_parallel"` // 0 = derive from CPU count
+}
+
+// QualityConfig controls the optional post-encode quality pass that compares each
+// rendition against the scaled source. A threshold of 0 disables that check.
+type QualityConfig struct {
+	Enabled     bool    `mapstructure:"enabled"`
+	VMAF        bool    `mapstructure:"vmaf"` // Also run libvmaf when ffmpeg provides it
+	MinPSNR     float64 `mapstructure:"min_psnr"`
+	MinSSIM     float64 `mapstructure:"min_ssim"`
+	MinVMAF     float64 `mapstructure:"min_vmaf"`
+	OnThreshold string  `mapstructure:"on_threshold"` // "flag" or "fail"
+}
+
+// ValidationConfig tunes the checks run on every rendition before it is committed
+type ValidationConfig struct {
+	DurationTolerance time.Duration `mapstructure:"duration_tolerance"` // Allowed playlist vs source duration drift
+}
+
+// ComplexityConfig controls the per-title analysis that scales requested bitrates.
+// Sampled scenes are probe-encoded at low resolution with a fixed CRF; the
+// resulting bitrate relative to ReferenceBitrate is the complexity score.
+type ComplexityConfig struct {
+	Enabled          bool          `mapstructure:"enabled"`
+	Samples          int           `mapstructure:"samples"`
+	SampleDuration   time.Duration `mapstructure:"sample_duration"`
+	ProbeHeight      int           `mapstructure:"probe_height"`
+	ProbeCRF         int           `mapstructure:"probe_crf"`
+	ReferenceBitrate string        `mapstructure:"reference_bitrate"` // Probe bitrate of "typical" content
+	MinScale         float64       `mapstructure:"min_scale"`
+	MaxScale         float64       `mapstructure:"max_scale"`
+}
+
+// UploadConfig controls how committed outputs are copied to the NAS
+type UploadConfig struct {
+	Workers      int    `mapstructure:"workers"`       // Files copied concurrently
+	MaxBandwidth string `mapstructure:"max_bandwidth"` // Aggregate cap in bits/s, e.g. "200M". Empty = unlimited
+	Streaming    bool   `mapstructure:"streaming"`     // Publish segments while encoding instead of after
+}
+
+// StorageConfig selects where sources are read from and outputs are committed to.
+// "filesystem" uses nas_mount_path; "s3" uses an S3-compatible object store.
+type StorageConfig struct {
+	Backend string   `mapstructure:"backend"`
+	S3      S3Config `mapstructure:"s3"`
+}
+
+// S3Config configures the S3-compatible backend. Credentials fall back to the
+// standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN env vars.
+type S3Config struct {
+	Endpoint     string `mapstructure:"endpoint"` // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://minio:9000"
+	Region       string `mapstructure:"region"`
+	Bucket       string `mapstructure:"bucket"`
+	Prefix       string `mapstructure:"prefix"` // Prepended to every key
+	AccessKey    string `mapstructure:"access_key"`
+	SecretKey    string `mapstructure:"secret_key"`
+	SessionToken string `mapstructure:"session_token"`
+	UsePathStyle bool   `mapstructure:"use_path_style"` // Bucket in the path instead of the host name (MinIO, Ceph)
+	PartSizeMB   int    `mapstructure:"part_size_mb"`   // Multipart upload part size
+}
+
+// HTTPInputConfig controls jobs whose source_url is an http:// or https:// URL.
+// "prefetch" downloads the source into the job temp dir first, resuming with
+// range requests; "stream" lets ffmpeg read the URL directly.
+type HTTPInputConfig struct {
+	Mode      string        `mapstructure:"mode"`        // "prefetch" or "stream"
+	MaxSizeMB int64         `mapstructure:"max_size_mb"` // Largest accepted source. 0 = unlimited
+	Retries   int           `mapstructure:"retries"`     // Resumed attempts after a download is interrupted
+	Timeout   time.Duration `mapstructure:"timeout"`     // Wait for response headers
+}
+
+// InputCacheConfig controls copying job inputs to fast local disk before
+// encoding. Entries are shared between jobs and evicted least recently used first.
+type InputCacheConfig struct {
+	Enabled   bool   `mapstructure:"enabled"`
+	Dir       string `mapstructure:"dir"`         // Defaults to <temp_dir>/.cache
+	MaxSizeGB int64  `mapstructure:"max_size_gb"` // Capacity of the cache
+}
+
+// DiskSpaceConfig controls the free space check run before a job starts. The
+// temp and destination space a job needs is estimated from the source duration
+// and the output bitrates, multiplied by Margin.
+type DiskSpaceConfig struct {
+	Enabled     bool    `mapstructure:"enabled"`
+	Margin      float64 `mapstructure:"margin"`        // Headroom for muxing overhead and bitrate peaks
+	MinFreeGB   int64   `mapstructure:"min_free_gb"`   // Left free on the temp and NAS disks after the job
+	TempQuotaGB int64   `mapstructure:"temp_quota_gb"` // Most temp space one job may need. 0 = no limit
+}
+
+// PathsConfig limits where jobs may read sources and write outputs. On the
+// filesystem backend roots are absolute directories and default to
+// nas_mount_path; on s3 they are key prefixes and default to the whole prefix.
+type PathsConfig struct {
+	AllowedInputRoots  []string `mapstructure:"allowed_input_roots"`
+	AllowedOutputRoots []string `mapstructure:"allowed_output_roots"`
+	AllowedInputURLs   []string `mapstructure:"allowed_input_urls"` // http(s) URL prefixes. Empty = no URL inputs
+}
+
+// NASHealthConfig controls the periodic check that nas_mount_path is mounted,
+// readable and writable. Jobs aren't taken while the check fails.
+type NASHealthConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Interval     time.Duration `mapstructure:"interval"`
+	Timeout      time.Duration `mapstructure:"timeout"`       // A check taking longer counts as failed
+	RequireMount bool          `mapstructure:"require_mount"` // Must be on a mounted filesystem, not the root one
+}
+
+// OutputConfig controls how committed outputs are named and created. Templates
+// may use the placeholders in OutputPlaceholders; the segment template must also
+// contain {number}, the segment sequence number.
+type OutputConfig struct {
+	FileMode         string `mapstructure:"file_mode"`         // Octal permissions of committed files, e.g. "0644"
+	DirMode          string `mapstructure:"dir_mode"`          // Octal permissions of created dirs, e.g. "0755"
+	UID              int    `mapstructure:"uid"`               // Owner of committed files and dirs. -1 = the worker user
+	GID              int    `mapstructure:"gid"`               // Group of committed files and dirs. -1 = the worker's group
+	RenditionDir     string `mapstructure:"rendition_dir"`     // Subdir of dest_path per rendition. Empty = none
+	PlaylistTemplate string `mapstructure:"playlist_template"` // Media playlist file name
+	SegmentTemplate  string `mapstructure:"segment_template"`  // Segment file name
+}
+
+// OutputPlaceholders are the values output name templates can refer to
+var OutputPlaceholders = []string{"job_id", "movie_id", "resolution", "bitrate", "codec"}
+
+// SlotsConfig sets how many jobs run at once. Jobs encoding with a hardware
+// encoder take a GPU slot, others a CPU slot. Without GPU slots every job takes
+// a CPU slot.
+type SlotsConfig struct {
+	CPU int `mapstructure:"cpu"`
+	GPU int `mapstructure:"gpu"` // e.g. the NVENC sessions the GPU allows
+}
+
+// DrainConfig controls drain mode, entered on SIGTERM, SIGINT or SIGUSR1 or at
+// the orchestrator's request: no new jobs are taken and running ones may finish
+// for up to Timeout before they are cancelled and the worker exits.
+type DrainConfig struct {
+	Timeout time.Duration `mapstructure:"timeout"` // 0 = cancel running jobs right away
+}
+
+// OutboxConfig controls the on-disk outbox of finalize and reject calls, which
+// are retried with exponential backoff until the orchestrator acknowledges them
+type OutboxConfig struct {
+	Dir        string        `mapstructure:"dir"`         // Defaults to <state_dir>/outbox
+	MaxBackoff time.Duration `mapstructure:"max_backoff"` // Longest wait between attempts
+	MaxAge     time.Duration `mapstructure:"max_age"`     // Undelivered calls are dropped after this
+}
+
+// JournalConfig controls the log of job lifecycle transitions that lets a
+// restarted worker report and clean up the jobs it was running when it died
+type JournalConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Path    string `mapstructure:"path"` // Defaults to <state_dir>/journal.jsonl
+}
+
+// AuthConfig controls how the worker and the orchestrator authenticate each
+// other. Secrets can be set directly (e.g. through WORKER_AUTH_TOKEN) or read
+// from a file; config.Load reads the files into Token and HMACSecret.
+type AuthConfig struct {
+	Token           string        `mapstructure:"token"`            // Sent as a bearer token, shared or per worker
+	TokenFile       string        `mapstructure:"token_file"`       // File holding the token
+	HMACSecret      string        `mapstructure:"hmac_secret"`      // Signs requests with HMAC-SHA256. Empty = no signing
+	HMACSecretFile  string        `mapstructure:"hmac_secret_file"` // File holding the secret
+	VerifyResponses bool          `mapstructure:"verify_responses"` // Require signed responses when signing
+	MaxSkew         time.Duration `mapstructure:"max_skew"`         // Largest accepted response timestamp difference
 }
 
 // Load reads configuration from config.yml and environment variables.
@@ -27,8 +222,79 @@ func Load(path string) (*Config, error) {
 
 	// 1. Set Defaults
 	v.SetDefault("temp_dir", "/tmp/transcode")
+	v.SetDefault("state_dir", "")
 	v.SetDefault("sync_interval", "10s")
 	v.SetDefault("log_level", "info")
+	v.SetDefault("chunked_encoding.enabled", false)
+	v.SetDefault("chunked_encoding.chunk_duration", "60s")
+	v.SetDefault("chunked_encoding.max_parallel", 0)
+	v.SetDefault("quality.enabled", false)
+	v.SetDefault("quality.vmaf", true)
+	v.SetDefault("quality.min_psnr", 0)
+	v.SetDefault("quality.min_ssim", 0)
+	v.SetDefault("quality.min_vmaf", 0)
+	v.SetDefault("quality.on_threshold", "flag")
+	v.SetDefault("validation.duration_tolerance", "2s")
+	v.SetDefault("complexity.enabled", false)
+	v.SetDefault("complexity.samples", 6)
+	v.SetDefault("complexity.sample_duration", "4s")
+	v.SetDefault("complexity.probe_height", 360)
+	v.SetDefault("complexity.probe_crf", 23)
+	v.SetDefault("complexity.reference_bitrate", "700k")
+	v.SetDefault("complexity.min_scale", 0.6)
+	v.SetDefault("complexity.max_scale", 1.4)
+	v.SetDefault("upload.workers", 4)
+	v.SetDefault("upload.max_bandwidth", "")
+	v.SetDefault("upload.streaming", false)
+	v.SetDefault("storage.backend", "filesystem")
+	v.SetDefault("storage.s3.endpoint", "")
+	v.SetDefault("storage.s3.region", "us-east-1")
+	v.SetDefault("storage.s3.bucket", "")
+	v.SetDefault("storage.s3.prefix", "")
+	v.SetDefault("storage.s3.access_key", "")
+	v.SetDefault("storage.s3.secret_key", "")
+	v.SetDefault("storage.s3.session_token", "")
+	v.SetDefault("storage.s3.use_path_style", false)
+	v.SetDefault("storage.s3.part_size_mb", 16)
+	v.SetDefault("http_input.mode", "prefetch")
+	v.SetDefault("http_input.max_size_mb", 0)
+	v.SetDefault("http_input.retries", 5)
+	v.SetDefault("http_input.timeout", "30s")
+	v.SetDefault("input_cache.enabled", false)
+	v.SetDefault("input_cache.dir", "")
+	v.SetDefault("input_cache.max_size_gb", 100)
+	v.SetDefault("disk_space.enabled", true)
+	v.SetDefault("disk_space.margin", 1.2)
+	v.SetDefault("disk_space.min_free_gb", 5)
+	v.SetDefault("disk_space.temp_quota_gb", 0)
+	v.SetDefault("paths.allowed_input_roots", []string{})
+	v.SetDefault("paths.allowed_output_roots", []string{})
+	v.SetDefault("paths.allowed_input_urls", []string{})
+	v.SetDefault("nas_health.enabled", true)
+	v.SetDefault("nas_health.interval", "30s")
+	v.SetDefault("nas_health.timeout", "10s")
+	v.SetDefault("nas_health.require_mount", false)
+	v.SetDefault("output.file_mode", "0644")
+	v.SetDefault("output.dir_mode", "0755")
+	v.SetDefault("output.uid", -1)
+	v.SetDefault("output.gid", -1)
+	v.SetDefault("output.rendition_dir", "")
+	v.SetDefault("output.playlist_template", "index.m3u8")
+	v.SetDefault("output.segment_template", "segment_{number}.ts")
+	v.SetDefault("slots.cpu", 1)
+	v.SetDefault("slots.gpu", 0)
+	v.SetDefault("drain.timeout", "30m")
+	v.SetDefault("outbox.dir", "")
+	v.SetDefault("outbox.max_backoff", "5m")
+	v.SetDefault("outbox.max_age", "168h")
+	v.SetDefault("journal.enabled", true)
+	v.SetDefault("journal.path", "")
+	v.SetDefault("auth.token", "")
+	v.SetDefault("auth.token_file", "")
+	v.SetDefault("auth.hmac_secret", "")
+	v.SetDefault("auth.hmac_secret_file", "")
+	v.SetDefault("auth.verify_responses", true)
+	v.SetDefault("auth.max_skew", "5m")
 
 	// 2. Load from File
 	v.SetConfigName("config") // name of config file (without extension)
@@ -60,6 +326,9 @@ func Load(path string) (*Config, error) {
 	}
 
 	// 5. Validation & Post-Processing
+	if cfg.StateDir == "" {
+		cfg.StateDir = defaultStateDir(v.ConfigFileUsed())
+	}
 	if err := validate(&cfg); err != nil {
 		return nil, err
 	}
@@ -67,12 +336,51 @@ func Load(path string) (*Config, error) {
 	return &cfg, nil
 }
 
+// fallbackStateDir is the state_dir of a worker configured by environment
+// variables alone, outside of systemd
+const fallbackStateDir = "/var/lib/transcode-worker"
+
+// defaultStateDir returns where state that must survive a reboot is kept when
+// state_dir isn't set: the dir systemd created for StateDirectory=, a "state"
+// dir next to the config file, or else fallbackStateDir.
+func defaultStateDir(configFile string) string {
+	if dirs := os.Getenv("STATE_DIRECTORY"); dirs != "" {
+		dir, _, _ := strings.Cut(dirs, ":")
+		return dir
+	}
+	if configFile == "" {
+		return fallbackStateDir
+	}
+	if abs, err := filepath.Abs(configFile); err == nil {
+		configFile = abs
+	}
+	return filepath.Join(filepath.Dir(configFile), "state")
+}
+
 func validate(cfg *Config) error {
 	if cfg.OrchestratorURL == "" {
 		return errors.New("configuration 'orchestrator_url' is required")
 	}
-	if cfg.NasMountPath == "" {
-		return errors.New("configuration 'nas_mount_path' is required")
+	switch cfg.Storage.Backend {
+	case "filesystem":
+		if cfg.NasMountPath == "" {
+			return errors.New("configuration 'nas_mount_path' is required")
+		}
+	case "s3":
+		if err := validateS3(&cfg.Storage.S3); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("configuration 'storage.backend' must be 'filesystem' or 's3', got %q", cfg.Storage.Backend)
+	}
+
+	for _, roots := range []*[]string{&cfg.Paths.AllowedInputRoots, &cfg.Paths.AllowedOutputRoots} {
+		if err := validateRoots(roots, cfg); err != nil {
+			return err
+		}
+	}
+	if err := validateURLPrefixes(cfg.Paths.AllowedInputURLs); err != nil {
+		return err
 	}
 
 	// If WorkerID is not set in config, try to get the OS hostname
@@ -84,10 +392,310 @@ func validate(cfg *Config) error {
 		cfg.WorkerID = hostname
 	}
 
+	if cfg.ChunkedEncoding.Enabled {
+		if cfg.ChunkedEncoding.ChunkDuration < 10*time.Second {
+			return errors.New("configuration 'chunked_encoding.chunk_duration' must be at least 10s")
+		}
+		if cfg.ChunkedEncoding.MaxParallel < 0 {
+			return errors.New("configuration 'chunked_encoding.max_parallel' cannot be negative")
+		}
+	}
+
+	switch cfg.Quality.OnThreshold {
+	case "flag", "fail":
+	default:
+		return fmt.Errorf("configuration 'quality.on_threshold' must be 'flag' or 'fail', got %q", cfg.Quality.OnThreshold)
+	}
+
+	if cfg.Validation.DurationTolerance <= 0 {
+		return errors.New("configuration 'validation.duration_tolerance' must be positive")
+	}
+
+	if cfg.Complexity.Enabled {
+		if cfg.Complexity.Samples < 1 {
+			return errors.New("configuration 'complexity.samples' must be at least 1")
+		}
+		if cfg.Complexity.SampleDuration <= 0 {
+			return errors.New("configuration 'complexity.sample_duration' must be positive")
+		}
+		if cfg.Complexity.MinScale <= 0 || cfg.Complexity.MaxScale < cfg.Complexity.MinScale {
+			return errors.New("configuration 'complexity.min_scale' must be positive and not above 'complexity.max_scale'")
+		}
+		if _, err := models.ParseBitrate(cfg.Complexity.ReferenceBitrate); err != nil {
+			return fmt.Errorf("configuration 'complexity.reference_bitrate': %w", err)
+		}
+	}
+
+	if cfg.Upload.Workers < 1 {
+		return errors.New("configuration 'upload.workers' must be at least 1")
+	}
+	if cfg.Upload.MaxBandwidth != "" {
+		if _, err := models.ParseBitrate(cfg.Upload.MaxBandwidth); err != nil {
+			return fmt.Errorf("configuration 'upload.max_bandwidth': %w", err)
+		}
+	}
+
+	switch cfg.HTTPInput.Mode {
+	case "prefetch", "stream":
+	default:
+		return fmt.Errorf("configuration 'http_input.mode' must be 'prefetch' or 'stream', got %q", cfg.HTTPInput.Mode)
+	}
+	if cfg.HTTPInput.MaxSizeMB < 0 || cfg.HTTPInput.Retries < 0 {
+		return errors.New("configuration 'http_input.max_size_mb' and 'http_input.retries' cannot be negative")
+	}
+
+	if cfg.DiskSpace.Enabled {
+		if cfg.DiskSpace.Margin < 1 {
+			return errors.New("configuration 'disk_space.margin' must be at least 1")
+		}
+		if cfg.DiskSpace.MinFreeGB < 0 || cfg.DiskSpace.TempQuotaGB < 0 {
+			return errors.New("configuration 'disk_space.min_free_gb' and 'disk_space.temp_quota_gb' cannot be negative")
+		}
+	}
+
+	// The check only applies to the NAS mount
+	if cfg.Storage.Backend != "filesystem" {
+		cfg.NASHealth.Enabled = false
+	}
+	if cfg.NASHealth.Enabled && (cfg.NASHealth.Interval <= 0 || cfg.NASHealth.Timeout <= 0) {
+		return errors.New("configuration 'nas_health.interval' and 'nas_health.timeout' must be positive")
+	}
+
+	if err := validateOutput(&cfg.Output); err != nil {
+		return err
+	}
+
+	if cfg.Slots.CPU < 0 || cfg.Slots.GPU < 0 {
+		return errors.New("configuration 'slots.cpu' and 'slots.gpu' cannot be negative")
+	}
+	if cfg.Slots.CPU+cfg.Slots.GPU == 0 {
+		return errors.New("configuration 'slots' must allow at least one job")
+	}
+
+	if cfg.Drain.Timeout < 0 {
+		return errors.New("configuration 'drain.timeout' cannot be negative")
+	}
+
 	// Ensure temp dir exists or can be created
 	if err := os.MkdirAll(cfg.TempDir, 0755); err != nil {
 		return fmt.Errorf("unable to create temp_dir at %s: %w", cfg.TempDir, err)
 	}
 
+	if cfg.Outbox.MaxBackoff <= 0 || cfg.Outbox.MaxAge <= 0 {
+		return errors.New("configuration 'outbox.max_backoff' and 'outbox.max_age' must be positive")
+	}
+	if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+		return fmt.Errorf("unable to create state_dir at %s: %w", cfg.StateDir, err)
+	}
+	if cfg.Outbox.Dir == "" {
+		cfg.Outbox.Dir = filepath.Join(cfg.StateDir, "outbox")
+	}
+	if err := os.MkdirAll(cfg.Outbox.Dir, 0755); err != nil {
+		return fmt.Errorf("unable to create outbox.dir at %s: %w", cfg.Outbox.Dir, err)
+	}
+
+	if err := validateAuth(&cfg.Auth); err != nil {
+		return err
+	}
+
+	if cfg.Journal.Enabled && cfg.Journal.Path == "" {
+		cfg.Journal.Path = filepath.Join(cfg.StateDir, "journal.jsonl")
+	}
+
+	if cfg.InputCache.Enabled {
+		if cfg.InputCache.MaxSizeGB < 1 {
+			return errors.New("configuration 'input_cache.max_size_gb' must be at least 1")
+		}
+		if cfg.InputCache.Dir == "" {
+			cfg.InputCache.Dir = filepath.Join(cfg.TempDir, ".cache")
+		}
+		if err := os.MkdirAll(cfg.InputCache.Dir, 0755); err != nil {
+			return fmt.Errorf("unable to create input_cache.dir at %s: %w", cfg.InputCache.Dir, err)
+		}
+	}
+
+	return nil
+}
+
+// validateRoots cleans the allowed roots, defaulting them to the NAS mount
+func validateRoots(roots *[]string, cfg *Config) error {
+	if cfg.Storage.Backend != "filesystem" {
+		for i, root := range *roots {
+			(*roots)[i] = strings.Trim(path.Clean("/"+root), "/")
+		}
+		return nil
+	}
+
+	if len(*roots) == 0 {
+		*roots = []string{cfg.NasMountPath}
+	}
+	for i, root := range *roots {
+		if !filepath.IsAbs(root) {
+			return fmt.Errorf("configuration 'paths' roots must be absolute, got %q", root)
+		}
+		(*roots)[i] = filepath.Clean(root)
+	}
+	return nil
+}
+
+// validateURLPrefixes checks the allowed input URL prefixes
+func validateURLPrefixes(prefixes []string) error {
+	for _, prefix := range prefixes {
+		u, err := url.Parse(prefix)
+		if err != nil || (!strings.EqualFold(u.Scheme, "http") && !strings.EqualFold(u.Scheme, "https")) {
+			return fmt.Errorf("configuration 'paths.allowed_input_urls' entries must be http:// or https:// URLs, got %q", prefix)
+		}
+		if u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("configuration 'paths.allowed_input_urls' entries need a host and no credentials, query or fragment, got %q", prefix)
+		}
+	}
+	return nil
+}
+
+func validateOutput(out *OutputConfig) error {
+	for name, mode := range map[string]string{"file_mode": out.FileMode, "dir_mode": out.DirMode} {
+		if _, err := ParseFileMode(mode); err != nil {
+			return fmt.Errorf("configuration 'output.%s': %w", name, err)
+		}
+	}
+	if out.UID < -1 || out.GID < -1 {
+		return errors.New("configuration 'output.uid' and 'output.gid' must be -1 or a valid id")
+	}
+
+	if err := validateTemplate("rendition_dir", out.RenditionDir, true, false); err != nil {
+		return err
+	}
+	if err := validateTemplate("playlist_template", out.PlaylistTemplate, false, false); err != nil {
+		return err
+	}
+	if err := validateTemplate("segment_template", out.SegmentTemplate, false, true); err != nil {
+		return err
+	}
+
+	if !strings.HasSuffix(out.PlaylistTemplate, ".m3u8") {
+		return errors.New("configuration 'output.playlist_template' must end in .m3u8")
+	}
+	// ffmpeg writes MPEG-TS segments, and resume relies on the extension
+	if !strings.HasSuffix(out.SegmentTemplate, ".ts") {
+		return errors.New("configuration 'output.segment_template' must end in .ts")
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// validateTemplate checks that a name template only uses known placeholders and
+// stays a relative path (or a single file name unless dirs is set)
+func validateTemplate(name, template string, dirs, numbered bool) error {
+	if template == "" && dirs {
+		return nil
+	}
+
+	rest := template
+	numbers := 0
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return fmt.Errorf("configuration 'output.%s' has an unterminated placeholder", name)
+		}
+		placeholder := rest[start+1 : start+end]
+		switch {
+		case placeholder == "number" && numbered:
+			numbers++
+		case !slices.Contains(OutputPlaceholders, placeholder):
+			return fmt.Errorf("configuration 'output.%s' has unknown placeholder {%s}", name, placeholder)
+		}
+		rest = rest[start+end+1:]
+	}
+	if numbered && numbers != 1 {
+		return fmt.Errorf("configuration 'output.%s' must contain {number} once", name)
+	}
+
+	if strings.ContainsAny(template, "%\\") {
+		return fmt.Errorf("configuration 'output.%s' can't contain '%%' or '\\'", name)
+	}
+	if !dirs && strings.Contains(template, "/") {
+		return fmt.Errorf("configuration 'output.%s' must be a file name, not a path", name)
+	}
+	for _, elem := range strings.Split(template, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return fmt.Errorf("configuration 'output.%s' must be a relative path without empty, '.' or '..' elements", name)
+		}
+	}
+	return nil
+}
+
+// ParseFileMode parses octal permission bits such as "0644"
+func ParseFileMode(mode string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || bits > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q", mode)
+	}
+	return os.FileMode(bits), nil
+}
+
+// validateAuth reads secrets from their files
+func validateAuth(auth *AuthConfig) error {
+	if err := readSecret(&auth.Token, auth.TokenFile, "auth.token"); err != nil {
+		return err
+	}
+	if err := readSecret(&auth.HMACSecret, auth.HMACSecretFile, "auth.hmac_secret"); err != nil {
+		return err
+	}
+	if auth.HMACSecret != "" && auth.VerifyResponses && auth.MaxSkew <= 0 {
+		return errors.New("configuration 'auth.max_skew' must be positive")
+	}
+	return nil
+}
+
+// readSecret sets a secret from a file, unless it was set directly. Surrounding
+// whitespace, such as a trailing newline, is not part of the secret.
+func readSecret(secret *string, file, name string) error {
+	if file == "" {
+		return nil
+	}
+	if *secret != "" {
+		return fmt.Errorf("configuration '%s' and '%s_file' cannot both be set", name, name)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("unable to read %s_file: %w", name, err)
+	}
+	*secret = strings.TrimSpace(string(data))
+	if *secret == "" {
+		return fmt.Errorf("configuration '%s_file' %s is empty", name, file)
+	}
+	return nil
+}
+
+func validateS3(s3 *S3Config) error {
+	if s3.Endpoint == "" {
+		return errors.New("configuration 'storage.s3.endpoint' is required for the s3 backend")
+	}
+	if s3.Bucket == "" {
+		return errors.New("configuration 'storage.s3.bucket' is required for the s3 backend")
+	}
+
+	if s3.AccessKey == "" {
+		s3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if s3.SecretKey == "" {
+		s3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if s3.SessionToken == "" {
+		s3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if s3.AccessKey == "" || s3.SecretKey == "" {
+		return errors.New("configuration 'storage.s3.access_key' and 'storage.s3.secret_key' are required for the s3 backend")
+	}
+
+	// S3 rejects multipart parts under 5 MiB, except the last one
+	if s3.PartSizeMB < 5 {
+		return errors.New("configuration 'storage.s3.part_size_mb' must be at least 5")
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"transcode-worker/pkg/models"
+)
+
+// Event is a job lifecycle transition
+type Event string
+
+const (
+	EventAssigned      Event = "assigned"       // Passed the assignment checks, holds a slot
+	EventStarted       Event = "started"        // Accepted, the orchestrator holds a lease
+	EventRenditionDone Event = "rendition_done" // One rendition committed
+	EventCommitted     Event = "committed"      // Every rendition committed
+	EventFinalized     Event = "finalized"      // Finalize queued in the outbox
+	EventReleased      Event = "released"       // Rejected before starting, or its lease was lost
+)
+
+// terminal reports whether nothing more is recorded for a job after the event
+func (e Event) terminal() bool {
+	return e == EventFinalized || e == EventReleased
+}
+
+// Record is one journal line
+type Record struct {
+	Time      time.Time       `json:"time"`
+	JobID     string          `json:"job_id"`
+	Event     Event           `json:"event"`
+	Job       *models.JobSpec `json:"job,omitempty"`       // Resolved spec, on assigned
+	Rendition string          `json:"rendition,omitempty"` // On rendition_done
+	Outputs   []string        `json:"outputs,omitempty"`   // Where each output was committed, on committed
+	Roots     []string        `json:"roots,omitempty"`     // Destination root of each output, on committed
+	Playlists []string        `json:"playlists,omitempty"` // Media playlist of each output, on committed
+	Status    string          `json:"status,omitempty"`    // Reported status, on finalized
+}
+
+// JobState is what the journal knows about a job that didn't reach a terminal event
+type JobState struct {
+	Job        *models.JobSpec
+	Last       Event
+	Renditions []string // Committed renditions
+	Outputs    []string // Set once committed
+	Roots      []string
+	Playlists  []string
+}
+
+// Journal is an append-only log of job lifecycle transitions, synced on every
+// record, so a worker that crashed or lost power can tell on restart which jobs
+// it was running and how far they got. Once no job is open the log is emptied.
+type Journal struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	open map[string]bool // Jobs without a terminal event
+}
+
+// Open opens the journal and returns the jobs an earlier run left unfinished.
+// Those stay open, and in the journal, until a terminal event is recorded for them.
+func Open(path string) (*Journal, []JobState, error) {
+	unfinished, complete, err := replay(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+
+	// Drop a record torn by a crash, new ones would be appended to it
+	if info, err := file.Stat(); err == nil && info.Size() > complete {
+		if err := file.Truncate(complete); err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to repair journal: %w", err)
+		}
+	}
+
+	j := &Journal{
+		path: path,
+		file: file,
+		open: make(map[string]bool),
+	}
+	for _, state := range unfinished {
+		j.open[state.Job.JobID] = true
+	}
+	if len(j.open) == 0 {
+		if err := j.truncate(); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+	return j, unfinished, nil
+}
+
+// replay reads the journal and folds it into the state of each open job. It
+// also returns the length of the journal up to the last complete record.
+func replay(path string) ([]JobState, int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	states := make(map[string]*JobState)
+	var order []string
+
+	var complete int64
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(data) > 0 {
+				slog.Warn("Ignoring incomplete last journal record", "path", path, "line", line)
+			}
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read journal: %w", err)
+		}
+		complete += int64(len(data))
+
+		var rec Record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			slog.Warn("Ignoring unreadable journal record", "path", path, "line", line, "error", err)
+			continue
+		}
+
+		state, ok := states[rec.JobID]
+		if !ok {
+			// A job the journal didn't see being assigned can't be reported without its spec
+			if rec.Event != EventAssigned || rec.Job == nil {
+				continue
+			}
+			state = &JobState{}
+			states[rec.JobID] = state
+			order = append(order, rec.JobID)
+		}
+
+		state.Last = rec.Event
+		switch rec.Event {
+		case EventAssigned:
+			*state = JobState{Job: rec.Job, Last: rec.Event}
+		case EventRenditionDone:
+			state.Renditions = append(state.Renditions, rec.Rendition)
+		case EventCommitted:
+			state.Outputs = rec.Outputs
+			state.Roots = rec.Roots
+			state.Playlists = rec.Playlists
+		}
+	}
+
+	var unfinished []JobState
+	for _, jobID := range order {
+		if state := states[jobID]; !state.Last.terminal() {
+			unfinished = append(unfinished, *state)
+		}
+	}
+	return unfinished, complete, nil
+}
+
+// Record appends a record and syncs it to disk. When it closes the last open
+// job, the journal is emptied.
+func (j *Journal) Record(rec Record) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal record: %w", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+
+	if rec.Event.terminal() {
+		delete(j.open, rec.JobID)
+		if len(j.open) == 0 {
+			return j.truncate()
+		}
+	} else {
+		j.open[rec.JobID] = true
+	}
+	return nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+func (j *Journal) truncate() error {
+	if err := j.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate journal %s: %w", filepath.Base(j.path), err)
+	}
+	return j.file.Sync()
+}
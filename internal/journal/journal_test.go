@@ -0,0 +1,136 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"transcode-worker/pkg/models"
+)
+
+func mustRecord(t *testing.T, j *Journal, rec Record) {
+	t.Helper()
+	if err := j.Record(rec); err != nil {
+		t.Fatalf("Record %s %s: %v", rec.JobID, rec.Event, err)
+	}
+}
+
+func TestReplayUnfinishedJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, unfinished, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished) != 0 {
+		t.Fatalf("new journal has %d unfinished jobs", len(unfinished))
+	}
+
+	for _, id := range []string{"job-1", "job-2", "job-3", "job-4"} {
+		mustRecord(t, j, Record{JobID: id, Event: EventAssigned, Job: &models.JobSpec{JobID: id}})
+	}
+	mustRecord(t, j, Record{JobID: "job-2", Event: EventStarted})
+	mustRecord(t, j, Record{JobID: "job-2", Event: EventRenditionDone, Rendition: "1080p_5000k"})
+	mustRecord(t, j, Record{JobID: "job-2", Event: EventRenditionDone, Rendition: "720p_2500k"})
+	mustRecord(t, j, Record{JobID: "job-3", Event: EventStarted})
+	mustRecord(t, j, Record{JobID: "job-3", Event: EventCommitted, Outputs: []string{"/out/a"}, Roots: []string{"/out"}, Playlists: []string{"index.m3u8"}})
+	mustRecord(t, j, Record{JobID: "job-4", Event: EventReleased})
+	// Never assigned as far as the journal knows, so it can't be reported
+	mustRecord(t, j, Record{JobID: "job-5", Event: EventStarted})
+	j.Close()
+
+	j, unfinished, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if len(unfinished) != 3 {
+		t.Fatalf("replayed %d unfinished jobs, want 3: %+v", len(unfinished), unfinished)
+	}
+	states := make(map[string]JobState)
+	for _, state := range unfinished {
+		states[state.Job.JobID] = state
+	}
+
+	if state := states["job-1"]; state.Last != EventAssigned {
+		t.Errorf("job-1 last event %s, want assigned", state.Last)
+	}
+	if state := states["job-2"]; state.Last != EventRenditionDone || len(state.Renditions) != 2 {
+		t.Errorf("job-2 = %+v, want two renditions done", state)
+	}
+	state := states["job-3"]
+	if state.Last != EventCommitted || len(state.Outputs) != 1 || state.Roots[0] != "/out" || state.Playlists[0] != "index.m3u8" {
+		t.Errorf("job-3 = %+v, want committed with its outputs", state)
+	}
+	if _, ok := states["job-4"]; ok {
+		t.Error("released job-4 replayed as unfinished")
+	}
+}
+
+func TestJournalEmptiedOnceNoJobIsOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, _, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustRecord(t, j, Record{JobID: "job-1", Event: EventAssigned, Job: &models.JobSpec{JobID: "job-1"}})
+	mustRecord(t, j, Record{JobID: "job-2", Event: EventAssigned, Job: &models.JobSpec{JobID: "job-2"}})
+	j.Close()
+
+	// Recovered jobs stay in the journal until they are closed too
+	j, unfinished, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if len(unfinished) != 2 {
+		t.Fatalf("replayed %d jobs, want 2", len(unfinished))
+	}
+
+	mustRecord(t, j, Record{JobID: "job-1", Event: EventFinalized, Status: "INTERRUPTED"})
+	if info, _ := os.Stat(path); info.Size() == 0 {
+		t.Fatal("journal emptied while job-2 is still open")
+	}
+
+	mustRecord(t, j, Record{JobID: "job-2", Event: EventReleased})
+	if info, _ := os.Stat(path); info.Size() != 0 {
+		t.Errorf("journal holds %d bytes with no job open", info.Size())
+	}
+}
+
+func TestJournalRepairsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, _, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustRecord(t, j, Record{JobID: "job-1", Event: EventAssigned, Job: &models.JobSpec{JobID: "job-1"}})
+	j.Close()
+
+	// A crash in the middle of writing the next record
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"job_id":"job-1","event":"sta`)
+	file.Close()
+
+	j, unfinished, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished) != 1 || unfinished[0].Last != EventAssigned {
+		t.Fatalf("replayed %+v, want job-1 assigned", unfinished)
+	}
+	mustRecord(t, j, Record{JobID: "job-1", Event: EventStarted})
+	j.Close()
+
+	// The new record wasn't glued onto the torn one
+	unfinished, _, err = replay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished) != 1 || unfinished[0].Last != EventStarted {
+		t.Errorf("replayed %+v after repair, want job-1 started", unfinished)
+	}
+}
@@ -0,0 +1,137 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"transcode-worker/internal/config"
+)
+
+// MountHealth periodically checks that the NAS share is mounted, readable and
+// writable. Each check runs in its own goroutine with a timeout, so a hung NFS
+// mount marks the share unhealthy instead of blocking the worker; no new check
+// starts while a hung one is still stuck.
+type MountHealth struct {
+	path         string
+	probeName    string
+	requireMount bool
+	interval     time.Duration
+	timeout      time.Duration
+
+	mu      sync.Mutex
+	err     error // nil while healthy
+	running bool  // A check hasn't returned yet
+}
+
+// NewMountHealth creates the checker for the configured NAS mount. It reports
+// healthy until the first check has run.
+func NewMountHealth(cfg *config.Config) *MountHealth {
+	return &MountHealth{
+		path:         cfg.NasMountPath,
+		probeName:    ".health-" + cfg.WorkerID,
+		requireMount: cfg.NASHealth.RequireMount,
+		interval:     cfg.NASHealth.Interval,
+		timeout:      cfg.NASHealth.Timeout,
+	}
+}
+
+// Run checks the mount every interval until stop is closed
+func (h *MountHealth) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.Check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Check runs one check, waiting at most the timeout, and returns the new state
+func (h *MountHealth) Check() error {
+	h.mu.Lock()
+	if h.running {
+		h.mu.Unlock()
+		return h.setErr(fmt.Errorf("NAS mount %s: previous check still hung", h.path))
+	}
+	h.running = true
+	h.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := h.probe()
+		h.mu.Lock()
+		h.running = false
+		h.mu.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return h.setErr(err)
+	case <-time.After(h.timeout):
+		return h.setErr(fmt.Errorf("NAS mount %s: check timed out after %s", h.path, h.timeout))
+	}
+}
+
+// Healthy returns nil while the mount is healthy, otherwise what the last check found
+func (h *MountHealth) Healthy() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+func (h *MountHealth) setErr(err error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.err = err
+	return err
+}
+
+// probe verifies the share is mounted, lists it and writes, reads back and
+// removes a small file
+func (h *MountHealth) probe() error {
+	if h.requireMount {
+		mounted, err := isMounted(h.path)
+		if err != nil {
+			return fmt.Errorf("NAS mount %s: %w", h.path, err)
+		}
+		if !mounted {
+			return fmt.Errorf("NAS mount %s: not a mounted filesystem", h.path)
+		}
+	}
+
+	dir, err := os.Open(h.path)
+	if err != nil {
+		return fmt.Errorf("NAS mount %s: not readable: %w", h.path, err)
+	}
+	_, err = dir.Readdirnames(1)
+	dir.Close()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("NAS mount %s: not readable: %w", h.path, err)
+	}
+
+	probe := filepath.Join(h.path, h.probeName)
+	payload := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := os.WriteFile(probe, payload, 0644); err != nil {
+		return fmt.Errorf("NAS mount %s: not writable: %w", h.path, err)
+	}
+
+	data, err := os.ReadFile(probe)
+	os.Remove(probe)
+	if err != nil {
+		return fmt.Errorf("NAS mount %s: not readable: %w", h.path, err)
+	}
+	if string(data) != string(payload) {
+		return fmt.Errorf("NAS mount %s: read back different data than written", h.path)
+	}
+	return nil
+}
@@ -10,22 +10,32 @@ import (
 	"time"
 
 	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/mem"
+	"transcode-worker/internal/config"
 	"transcode-worker/pkg/models"
 )
 
 type SystemMonitor struct {
 	cachedCaps []string
+	encoders   map[string]bool // Encoder names from the capability check
 	once       sync.Once
 	ffmpegPath string
+	tempDir    string
+	outputDir  string // Empty when outputs go to object storage
 }
 
-func NewSystemMonitor() *SystemMonitor {
+func NewSystemMonitor(cfg *config.Config) *SystemMonitor {
 	// Assume ffmpeg is in PATH. In a real deployment, 
 	// you might want to configure the path via config.yml
-	return &SystemMonitor{
+	m := &SystemMonitor{
 		ffmpegPath: "ffmpeg",
+		tempDir:    cfg.TempDir,
 	}
+	if cfg.Storage.Backend == "filesystem" {
+		m.outputDir = cfg.NasMountPath
+	}
+	return m
 }
 
 // GetCapabilities runs once to discover what this worker can do.
@@ -71,9 +81,29 @@ func (m *SystemMonitor) GetStats(ctx context.Context) (models.HardwareStats, err
 	// If CPU > 80% or RAM > 90%, mark as busy so the scheduler skips us.
 	stats.IsBusy = stats.CPUPercent > 80.0 || stats.RAMPercent > 90.0
 
+	// 4. Free disk space, left at 0 when unknown rather than failing the sync
+	if free, _, err := DiskSpace(ctx, m.tempDir); err == nil {
+		stats.TempFreeBytes = free
+	}
+	if m.outputDir != "" {
+		if free, _, err := DiskSpace(ctx, m.outputDir); err == nil {
+			stats.OutputFreeBytes = free
+		}
+	}
+
 	return stats, nil
 }
 
+// DiskSpace reports the free and total bytes of the filesystem holding path.
+// Free is what an unprivileged process can use, without the root reserve.
+func DiskSpace(ctx context.Context, path string) (free, total uint64, err error) {
+	usage, err := disk.UsageWithContext(ctx, path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get disk usage of %s: %w", path, err)
+	}
+	return usage.Free, usage.Total, nil
+}
+
 // detectFFmpegCapabilities asks FFmpeg what it supports.
 // This is safer than checking drivers because it proves FFmpeg can actually SEE the hardware.
 func (m *SystemMonitor) detectFFmpegCapabilities(ctx context.Context) ([]string, error) {
@@ -87,6 +117,7 @@ func (m *SystemMonitor) detectFFmpegCapabilities(ctx context.Context) ([]string,
 	}
 
 	output := out.String()
+	m.encoders = parseEncoders(output)
 	var caps []string
 
 	// Basic Resolution support (assumed true for any modern CPU, but good to flag)
@@ -117,4 +148,32 @@ func (m *SystemMonitor) detectFFmpegCapabilities(ctx context.Context) ([]string,
 	}
 
 	return caps, nil
-}
\ No newline at end of file
+}
+
+// HasEncoder reports whether FFmpeg has an encoder, by the name used with -c:v
+// or -c:a. Stream copy is always available. Before the capability check has
+// succeeded nothing is known, so every encoder is assumed present.
+func (m *SystemMonitor) HasEncoder(name string) bool {
+	if name == "copy" || m.encoders == nil {
+		return true
+	}
+	return m.encoders[name]
+}
+
+// parseEncoders collects the encoder names from "ffmpeg -encoders" output,
+// which lists one per line after a "------" separator as "<flags> <name> <description>"
+func parseEncoders(output string) map[string]bool {
+	encoders := make(map[string]bool)
+	listed := false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if !listed {
+			listed = len(fields) == 1 && strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders
+}
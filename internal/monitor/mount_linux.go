@@ -0,0 +1,74 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// isMounted reports whether path lies on a mounted filesystem other than the
+// root one, at path itself or at a dir above it. Bind mounts count, as they
+// are listed in /proc/self/mountinfo like any other mount. An unmounted share
+// leaves an empty dir on the root filesystem behind.
+func isMounted(path string) (bool, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return false, err
+	}
+
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	mountPoint, err := containingMount(file, resolved)
+	if err != nil {
+		return false, fmt.Errorf("failed to read /proc/self/mountinfo: %w", err)
+	}
+	return mountPoint != "/", nil
+}
+
+// containingMount returns the deepest mount point in mountinfo at or above path
+func containingMount(mountinfo io.Reader, path string) (string, error) {
+	deepest := "/"
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		// ID, parent ID, major:minor, root, mount point, ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoint := unescapeMountPoint(fields[4])
+		if mountPoint == path || strings.HasPrefix(path, strings.TrimSuffix(mountPoint, "/")+"/") {
+			if len(mountPoint) > len(deepest) {
+				deepest = mountPoint
+			}
+		}
+	}
+	return deepest, scanner.Err()
+}
+
+// unescapeMountPoint decodes the octal escapes mountinfo uses for spaces,
+// tabs, newlines and backslashes
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package monitor
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMountinfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+25 22 0:21 / /proc rw,nosuid shared:12 - proc proc rw
+31 22 0:45 / /mnt/nas rw,relatime shared:20 - nfs4 nas:/export rw,vers=4.2
+32 22 8:1 /srv/media /mnt/bind rw,relatime shared:1 - ext4 /dev/sda1 rw
+33 22 0:46 / /mnt/my\040share rw,relatime shared:21 - cifs //nas/share rw
+`
+
+func TestContainingMount(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/mnt/nas", "/mnt/nas"},
+		{"/mnt/nas/processed/movies", "/mnt/nas"},
+		{"/mnt/nassy", "/"},
+		{"/mnt", "/"},
+		{"/mnt/bind/raw", "/mnt/bind"},
+		{"/mnt/my share/raw", "/mnt/my share"},
+		{"/var/lib", "/"},
+	}
+	for _, tt := range tests {
+		got, err := containingMount(strings.NewReader(testMountinfo), tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("containingMount(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIsMountedCleansPath(t *testing.T) {
+	// /proc is its own filesystem on every Linux system
+	for _, path := range []string{"/proc", "/proc/", "/proc/self/", "/"} {
+		mounted, err := isMounted(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := path != "/"; mounted != want {
+			t.Errorf("isMounted(%q) = %v, want %v", path, mounted, want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package monitor
+
+import "os"
+
+// isMounted can't tell mounted shares from plain dirs on this platform, so
+// any existing dir passes
+func isMounted(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
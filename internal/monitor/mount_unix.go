@@ -0,0 +1,23 @@
+//go:build unix && !linux
+
+package monitor
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+// isMounted reports whether path lies on a filesystem other than the root
+// one, i.e. a mount at path or at a dir above it. An unmounted share leaves an
+// empty dir on the root filesystem behind. Same-device bind mounts can't be
+// told apart here.
+func isMounted(path string) (bool, error) {
+	var self, root syscall.Stat_t
+	if err := syscall.Stat(filepath.Clean(path), &self); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat("/", &root); err != nil {
+		return false, err
+	}
+	return self.Dev != root.Dev, nil
+}
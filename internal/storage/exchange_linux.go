@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Exchange swaps a and b with renameat2(RENAME_EXCHANGE), so both paths exist
+// at every moment. NFS and older kernels don't support it.
+func (f *Filesystem) Exchange(ctx context.Context, a, b string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOSYS), errors.Is(err, unix.EOPNOTSUPP):
+		return errors.ErrUnsupported
+	default:
+		return fmt.Errorf("failed to exchange %s and %s: %w", a, b, err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// Exchange is only available on Linux
+func (f *Filesystem) Exchange(ctx context.Context, a, b string) error {
+	return errors.ErrUnsupported
+}
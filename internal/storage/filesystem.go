@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// Filesystem stores files on a locally mounted filesystem such as the NAS share
+type Filesystem struct {
+	root     string
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	uid      int // -1 = leave as created
+	gid      int // -1 = leave as created
+}
+
+// NewFilesystem creates a backend rooted at root. Relative paths resolve below it.
+func NewFilesystem(root string) *Filesystem {
+	return &Filesystem{root: root, fileMode: 0644, dirMode: 0755, uid: -1, gid: -1}
+}
+
+func (f *Filesystem) Name() string {
+	return "filesystem"
+}
+
+// Resolve prepends the root if the given path is relative
+func (f *Filesystem) Resolve(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+
+	cleanPath := filepath.Clean(path)
+	cleanPath = strings.TrimPrefix(cleanPath, "/")
+
+	return filepath.Join(f.root, cleanPath), nil
+}
+
+// Rel returns path relative to the root. Paths outside of it are returned
+// whole, without the leading separator.
+func (f *Filesystem) Rel(path string) string {
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = path
+	}
+	return strings.TrimPrefix(filepath.ToSlash(rel), "/")
+}
+
+func (f *Filesystem) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (f *Filesystem) Stat(ctx context.Context, path string) (FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		IsDir:   info.IsDir(),
+	}, nil
+}
+
+func (f *Filesystem) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (f *Filesystem) OpenAt(ctx context.Context, info FileInfo, offset int64) (io.ReadCloser, int64, error) {
+	file, err := os.Open(info.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, offset, nil
+}
+
+func (f *Filesystem) LocalPath(path string) (string, bool) {
+	return path, true
+}
+
+// Create writes to a hidden temp file next to path, which is fsynced and
+// renamed over path on Close
+func (f *Filesystem) Create(ctx context.Context, path string, opts WriteOptions) (Writer, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.setOwnership(file.Name(), f.fileMode); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &fileWriter{file: file, path: path}, nil
+}
+
+func (f *Filesystem) Remove(ctx context.Context, path string) error {
+	return os.Remove(path)
+}
+
+func (f *Filesystem) RemoveAll(ctx context.Context, path string) error {
+	return os.RemoveAll(path)
+}
+
+func (f *Filesystem) List(ctx context.Context, dir string) ([]FileInfo, error) {
+	var files []FileInfo
+
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, FileInfo{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// MkdirAll creates path and its missing parents with the dir mode, regardless of
+// the umask, and hands them to the configured owner. Existing dirs are left alone.
+func (f *Filesystem) MkdirAll(ctx context.Context, path string) error {
+	var missing []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		missing = append(missing, dir)
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+
+	if err := os.MkdirAll(path, f.dirMode); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := f.setOwnership(missing[i], f.dirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setOwnership applies the mode, and the owner if one is configured, to a new file or dir
+func (f *Filesystem) setOwnership(path string, mode os.FileMode) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if f.uid >= 0 || f.gid >= 0 {
+		if err := os.Lchown(path, f.uid, f.gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Filesystem) Rename(ctx context.Context, from, to string) error {
+	return os.Rename(from, to)
+}
+
+// SyncDir fsyncs a directory so renames and new entries in it are durable.
+// Filesystems that can't fsync directories report EINVAL, which is ignored.
+func (f *Filesystem) SyncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil // Directory handles can't be flushed on Windows
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
+
+// fileWriter publishes its temp file on Close so a nil error means the data is
+// on disk under its final name
+type fileWriter struct {
+	file *os.File
+	path string
+	done bool
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *fileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *fileWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"transcode-worker/internal/config"
+)
+
+// maxRedirects is how many redirects an input request follows
+const maxRedirects = 10
+
+// HTTP reads job inputs from http:// and https:// URLs. Paths are full URLs.
+// Every redirect must lead to an allowed input URL too.
+type HTTP struct {
+	client *http.Client
+	stream bool
+
+	mu         sync.Mutex
+	redirected map[string]string // URL -> where Stat was redirected to, for streamed inputs
+}
+
+// NewHTTP creates an HTTP input source whose requests, redirects included,
+// only go where policy allows
+func NewHTTP(cfg config.HTTPInputConfig, policy *PathPolicy) *HTTP {
+	return &HTTP{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				IdleConnTimeout:       90 * time.Second,
+				ResponseHeaderTimeout: cfg.Timeout,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxRedirects)
+				}
+				return policy.CheckURL(req.URL.String())
+			},
+		},
+		stream:     cfg.Mode == "stream",
+		redirected: make(map[string]string),
+	}
+}
+
+// IsURL reports whether path is an http:// or https:// URL
+func IsURL(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// Stat issues a HEAD request. Servers that don't allow HEAD are asked for the
+// first byte instead, and the size is taken from Content-Range. Size is -1 when
+// the server doesn't report it.
+func (h *HTTP) Stat(ctx context.Context, url string) (FileInfo, error) {
+	resp, err := h.get(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		resp, err = h.get(ctx, http.MethodGet, url, http.Header{"Range": {"bytes=0-0"}})
+		if err != nil {
+			return FileInfo{}, err
+		}
+		resp.Body.Close()
+	}
+	if err := checkStatus(resp, url); err != nil {
+		return FileInfo{}, err
+	}
+
+	// ffmpeg follows redirects without asking, so it is handed the checked target
+	if final := resp.Request.URL.String(); h.stream && final != url {
+		h.mu.Lock()
+		h.redirected[url] = final
+		h.mu.Unlock()
+	}
+
+	info := FileInfo{Path: url, Size: resp.ContentLength}
+	if resp.StatusCode == http.StatusPartialContent {
+		info.Size = -1
+		if _, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/"); ok {
+			if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+				info.Size = size
+			}
+		}
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modified.UTC()
+	}
+	// Weak tags only promise equivalent content, not the same bytes
+	if etag := resp.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+		info.ETag = etag
+	}
+	return info, nil
+}
+
+func (h *HTTP) Open(ctx context.Context, url string) (io.ReadCloser, error) {
+	resp, err := h.get(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStatus(resp, url); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// OpenAt requests the content from offset on. The range is made conditional
+// on the ETag or Last-Modified Stat saw, so a server whose file changed since
+// answers with the whole new file, as does one without range support; start
+// is 0 then.
+func (h *HTTP) OpenAt(ctx context.Context, file FileInfo, offset int64) (io.ReadCloser, int64, error) {
+	url := file.Path
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	switch {
+	case file.ETag != "":
+		header.Set("If-Range", file.ETag)
+	case !file.ModTime.IsZero():
+		header.Set("If-Range", file.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := h.get(ctx, http.MethodGet, url, header)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkStatus(resp, url); err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return resp.Body, 0, nil
+	}
+	return resp.Body, offset, nil
+}
+
+// LocalPath hands the URL to ffmpeg when inputs are streamed, or the URL Stat
+// was redirected to, which passed the policy
+func (h *HTTP) LocalPath(url string) (string, bool) {
+	if !h.stream {
+		return url, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if final, ok := h.redirected[url]; ok {
+		return final, true
+	}
+	return url, true
+}
+
+func (h *HTTP) get(ctx context.Context, method, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, url, err)
+	}
+	return resp, nil
+}
+
+// checkStatus turns error responses into Go errors; a 404 wraps fs.ErrNotExist
+func checkStatus(resp *http.Response, url string) error {
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("%s %s: %w", resp.Request.Method, url, fs.ErrNotExist)
+	default:
+		return fmt.Errorf("%s %s: unexpected status %s", resp.Request.Method, url, resp.Status)
+	}
+}
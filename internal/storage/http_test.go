@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"transcode-worker/internal/config"
+)
+
+func TestHTTPChecksRedirects(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("redirect to a disallowed host was followed: %s", r.URL)
+	}))
+	defer internal.Close()
+
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/raw/moved.mp4":
+			http.Redirect(w, r, "/raw/movie.mp4", http.StatusFound)
+		case "/raw/escape.mp4":
+			http.Redirect(w, r, internal.URL+"/latest/meta-data", http.StatusFound)
+		case "/raw/movie.mp4":
+			w.Header().Set("Content-Length", "5")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer media.Close()
+
+	policy := NewPathPolicy(&config.Config{Paths: config.PathsConfig{AllowedInputURLs: []string{media.URL + "/raw"}}})
+	h := NewHTTP(config.HTTPInputConfig{Mode: "stream"}, policy)
+
+	if _, err := h.Stat(t.Context(), media.URL+"/raw/escape.mp4"); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("redirect out of the allowed URLs: err = %v, want ErrPathNotAllowed", err)
+	}
+
+	// ffmpeg gets the URL the checked redirect led to
+	info, err := h.Stat(t.Context(), media.URL+"/raw/moved.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 5 {
+		t.Errorf("size = %d, want 5", info.Size)
+	}
+	if got, stream := h.LocalPath(media.URL + "/raw/moved.mp4"); got != media.URL+"/raw/movie.mp4" || !stream {
+		t.Errorf("LocalPath = %s, %v; want the redirect target", got, stream)
+	}
+}
+
+func TestHTTPStatETag(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", r.URL.Query().Get("etag"))
+	}))
+	defer server.Close()
+
+	policy := NewPathPolicy(&config.Config{Paths: config.PathsConfig{AllowedInputURLs: []string{server.URL}}})
+	h := NewHTTP(config.HTTPInputConfig{}, policy)
+	for etag, want := range map[string]string{`"v1"`: `"v1"`, `W/"v1"`: "", "": ""} {
+		info, err := h.Stat(t.Context(), server.URL+"/movie.mp4?etag="+url.QueryEscape(etag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ETag != want {
+			t.Errorf("ETag %s: Stat reported %q, want %q", etag, info.ETag, want)
+		}
+	}
+}
+
+func TestHTTPOpenAtIfRange(t *testing.T) {
+	content := "0123456789"
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "movie.mp4", modified, strings.NewReader(content))
+	}))
+	defer server.Close()
+	h := NewHTTP(config.HTTPInputConfig{}, &PathPolicy{})
+
+	tests := []struct {
+		name      string
+		file      FileInfo
+		wantStart int64
+		want      string
+	}{
+		{"same ETag", FileInfo{ETag: `"v2"`}, 4, "456789"},
+		{"changed ETag", FileInfo{ETag: `"v1"`}, 0, content},
+		{"same Last-Modified", FileInfo{ModTime: modified}, 4, "456789"},
+		{"changed Last-Modified", FileInfo{ModTime: modified.Add(-time.Hour)}, 0, content},
+	}
+	for _, tt := range tests {
+		tt.file.Path = server.URL + "/movie.mp4"
+		r, start, err := h.OpenAt(t.Context(), tt.file, 4)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, _ := io.ReadAll(r)
+		r.Close()
+		if start != tt.wantStart || string(got) != tt.want {
+			t.Errorf("%s: OpenAt = %q from %d, want %q from %d", tt.name, got, start, tt.want, tt.wantStart)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"transcode-worker/internal/config"
+)
+
+// ErrPathNotAllowed is returned for job paths outside the allowed roots
+var ErrPathNotAllowed = errors.New("path not allowed")
+
+// ErrPathIsRoot is returned for an output that is an allowed root itself.
+// Committing there would replace or prune the whole root.
+var ErrPathIsRoot = errors.New("path is an allowed root")
+
+// PathPolicy confines job inputs and outputs to configured roots. On the
+// filesystem backend paths are compared after resolving symlinks, so a link
+// inside a root can't lead out of it; on object storage roots are key prefixes.
+// http(s) inputs must be below one of the allowed input URLs.
+type PathPolicy struct {
+	inputRoots  []string
+	outputRoots []string
+	inputURLs   []*url.URL
+	local       bool
+}
+
+// NewPathPolicy creates the policy for the configured backend. Roots were
+// defaulted and cleaned by config.Load.
+func NewPathPolicy(cfg *config.Config) *PathPolicy {
+	p := &PathPolicy{
+		inputRoots:  cfg.Paths.AllowedInputRoots,
+		outputRoots: cfg.Paths.AllowedOutputRoots,
+		local:       cfg.Storage.Backend == "filesystem",
+	}
+	for _, prefix := range cfg.Paths.AllowedInputURLs {
+		// Checked by config.Load
+		if u, err := url.Parse(prefix); err == nil {
+			p.inputURLs = append(p.inputURLs, u)
+		}
+	}
+	return p
+}
+
+// CheckRaw rejects a path as sent by the orchestrator if it has ".." elements.
+// Resolve cleans those away lexically, which for symlinked dirs isn't where the
+// kernel would go, and no legitimate job needs them.
+func (p *PathPolicy) CheckRaw(raw string) error {
+	for _, elem := range strings.FieldsFunc(raw, isSeparator) {
+		if elem == ".." {
+			return fmt.Errorf("%w: %s contains '..'", ErrPathNotAllowed, raw)
+		}
+	}
+	return nil
+}
+
+// CheckName rejects a name used as a single path element, such as a job ID,
+// that is empty or would reach outside its parent dir
+func (p *PathPolicy) CheckName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.IndexFunc(name, isSeparator) >= 0 {
+		return fmt.Errorf("%w: invalid name %q", ErrPathNotAllowed, name)
+	}
+	return nil
+}
+
+// CheckURL verifies that an http(s) input URL is at or below one of the
+// allowed input URLs: same scheme, host and port, and a path below the allowed
+// one. Without allowed input URLs no URL passes, so the orchestrator can't make
+// the worker fetch arbitrary, possibly internal, addresses. Redirects are
+// checked the same way.
+func (p *PathPolicy) CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%w: invalid input URL", ErrPathNotAllowed)
+	}
+	shown := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String() // Without query tokens
+
+	if u.User != nil {
+		return fmt.Errorf("%w: input URL %s carries credentials", ErrPathNotAllowed, shown)
+	}
+	for _, elem := range strings.Split(u.Path, "/") {
+		if elem == ".." {
+			return fmt.Errorf("%w: input URL %s contains '..'", ErrPathNotAllowed, shown)
+		}
+	}
+
+	origin := urlOrigin(u)
+	for _, allowed := range p.inputURLs {
+		if origin == "" || urlOrigin(allowed) != origin {
+			continue
+		}
+		if sameKey(u.Path, allowed.Path) || within(u.Path, allowed.Path, "/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: input URL %s is not below an allowed input URL", ErrPathNotAllowed, shown)
+}
+
+// CheckInput verifies that a resolved input path is below an allowed input root
+func (p *PathPolicy) CheckInput(resolved string) error {
+	_, err := p.root(resolved, p.inputRoots, "input")
+	return err
+}
+
+// CheckOutput verifies that a resolved output path is strictly below an allowed
+// output root. The root itself fails with ErrPathIsRoot.
+func (p *PathPolicy) CheckOutput(resolved string) error {
+	_, err := p.root(resolved, p.outputRoots, "output")
+	return err
+}
+
+// OutputRoot returns the deepest allowed output root a resolved output path
+// lies below, with symlinks resolved on the filesystem backend. Commits stage
+// there, so nothing they create leaves the allowed tree. It returns "" on
+// object storage without output roots.
+func (p *PathPolicy) OutputRoot(resolved string) (string, error) {
+	return p.root(resolved, p.outputRoots, "output")
+}
+
+// root finds the deepest of roots that resolved is strictly below. Being any
+// of the roots fails with ErrPathIsRoot, even if another root contains it.
+func (p *PathPolicy) root(resolved string, roots []string, kind string) (string, error) {
+	if !p.local {
+		// Keys are already confined below the storage prefix by Resolve
+		if len(roots) == 0 {
+			return "", nil
+		}
+		found := ""
+		for _, root := range roots {
+			if sameKey(resolved, root) {
+				return "", fmt.Errorf("%w: %s %s", ErrPathIsRoot, kind, resolved)
+			}
+			if within(resolved, root, "/") && len(root) > len(found) {
+				found = root
+			}
+		}
+		if found == "" {
+			return "", fmt.Errorf("%w: %s %s is outside the allowed roots", ErrPathNotAllowed, kind, resolved)
+		}
+		return found, nil
+	}
+
+	real, err := realPath(resolved)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", resolved, err)
+	}
+	found := ""
+	for _, root := range roots {
+		realRoot, err := realPath(root)
+		if err != nil {
+			continue
+		}
+		if real == realRoot {
+			return "", fmt.Errorf("%w: %s %s", ErrPathIsRoot, kind, resolved)
+		}
+		if within(real, realRoot, string(filepath.Separator)) && len(realRoot) > len(found) {
+			found = realRoot
+		}
+	}
+	if found != "" {
+		return found, nil
+	}
+	if real != resolved {
+		return "", fmt.Errorf("%w: %s %s (%s) is outside the allowed roots", ErrPathNotAllowed, kind, resolved, real)
+	}
+	return "", fmt.Errorf("%w: %s %s is outside the allowed roots", ErrPathNotAllowed, kind, resolved)
+}
+
+// realPath resolves the symlinks in an absolute path. Outputs usually don't
+// exist yet, so the deepest existing ancestor is resolved and the rest appended.
+func realPath(p string) (string, error) {
+	p = filepath.Clean(p)
+	var missing []string
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{real}, missing...)...), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		missing = append([]string{filepath.Base(p)}, missing...)
+		p = parent
+	}
+}
+
+// within reports whether p is strictly below root, comparing whole path elements
+func within(p, root, sep string) bool {
+	if sep == "/" {
+		p, root = path.Clean("/"+p), path.Clean("/"+root)
+	}
+	if p == root {
+		return false
+	}
+	return strings.HasPrefix(p, strings.TrimSuffix(root, sep)+sep)
+}
+
+// urlOrigin returns the lowercase scheme, host and non-default port of an
+// http(s) URL, or "" for any other URL
+func urlOrigin(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return ""
+	}
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if host == "" {
+		return ""
+	}
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return scheme + "://" + host
+}
+
+// sameKey reports whether two object keys name the same prefix
+func sameKey(a, b string) bool {
+	return path.Clean("/"+a) == path.Clean("/"+b)
+}
+
+func isSeparator(r rune) bool {
+	return r == '/' || r == os.PathSeparator
+}
@@ -0,0 +1,449 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"transcode-worker/internal/config"
+)
+
+// sha256MetaHeader stores the SHA-256 of an object's content next to it, so
+// resumed uploads can be compared without downloading the object
+const sha256MetaHeader = "X-Amz-Meta-Sha256"
+
+// S3 stores files in an S3-compatible object store. Keys are slash-separated
+// paths below the configured prefix; directories don't exist as such.
+type S3 struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	pathStyle bool
+	partSize  int64
+	signer    *signer
+	client    *http.Client
+}
+
+// NewS3 creates an S3 backend from validated configuration
+func NewS3(cfg config.S3Config) (*S3, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+
+	return &S3{
+		endpoint:  endpoint,
+		bucket:    cfg.Bucket,
+		prefix:    strings.Trim(cfg.Prefix, "/"),
+		pathStyle: cfg.UsePathStyle,
+		partSize:  int64(cfg.PartSizeMB) << 20,
+		signer: &signer{
+			accessKey:    cfg.AccessKey,
+			secretKey:    cfg.SecretKey,
+			sessionToken: cfg.SessionToken,
+			region:       cfg.Region,
+			service:      "s3",
+		},
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost:   16,
+				IdleConnTimeout:       90 * time.Second,
+				ResponseHeaderTimeout: 60 * time.Second,
+			},
+		},
+	}, nil
+}
+
+func (s *S3) Name() string {
+	return "s3://" + s.bucket
+}
+
+// Resolve turns an orchestrator path into an object key below the prefix.
+// Cleaning against "/" keeps ".." from escaping the prefix.
+func (s *S3) Resolve(p string) (string, error) {
+	key := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if key == "" {
+		return "", fmt.Errorf("empty object key for path %q", p)
+	}
+	return path.Join(s.prefix, key), nil
+}
+
+// Rel returns key without the prefix
+func (s *S3) Rel(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, s.prefix+"/")
+}
+
+func (s *S3) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (s *S3) LocalPath(key string) (string, bool) {
+	return "", false
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (FileInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	info := FileInfo{
+		Path:   key,
+		Size:   resp.ContentLength,
+		SHA256: resp.Header.Get(sha256MetaHeader),
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modified.UTC()
+	}
+	return info, nil
+}
+
+func (s *S3) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) OpenAt(ctx context.Context, file FileInfo, offset int64) (io.ReadCloser, int64, error) {
+	key := file.Path
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("s3 GET %s: range request was not honoured", key)
+	}
+	return resp.Body, offset, nil
+}
+
+// Create buffers writes in memory. Objects up to the part size are sent with a
+// single PUT on Close; larger ones become a multipart upload, one part per
+// buffer, which is aborted if anything fails.
+func (s *S3) Create(ctx context.Context, key string, opts WriteOptions) (Writer, error) {
+	header := http.Header{}
+	if opts.SHA256 != "" {
+		header.Set(sha256MetaHeader, opts.SHA256)
+	}
+	return &s3Writer{ctx: ctx, s: s, key: key, header: header}, nil
+}
+
+func (s *S3) Remove(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// RemoveAll deletes every object under the key prefix, plus the key itself
+func (s *S3) RemoveAll(ctx context.Context, key string) error {
+	files, err := s.List(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := s.Remove(ctx, path.Join(key, file.Path)); err != nil {
+			return err
+		}
+	}
+
+	// Deleting a missing key succeeds, so this also covers a plain object
+	return s.Remove(ctx, key)
+}
+
+// List returns all objects under dir/ using ListObjectsV2
+func (s *S3) List(ctx context.Context, dir string) ([]FileInfo, error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	var files []FileInfo
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode object listing: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			files = append(files, FileInfo{
+				Path:    strings.TrimPrefix(obj.Key, prefix),
+				Size:    obj.Size,
+				ModTime: obj.LastModified.UTC(),
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// MkdirAll is a no-op; object stores have no directories
+func (s *S3) MkdirAll(ctx context.Context, key string) error {
+	return nil
+}
+
+// do sends a signed request and turns error responses into Go errors.
+// A 404 is reported as fs.ErrNotExist.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	segments := []string{""}
+	if s.pathStyle {
+		segments = append(segments, s.bucket)
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	if key != "" {
+		segments = append(segments, strings.Split(key, "/")...)
+	}
+	u.Path = strings.Join(segments, "/")
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	// Send the path encoded exactly as it is signed
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = uriEncode(segment)
+	}
+	u.RawPath = strings.Join(escaped, "/")
+	if u.RawPath == "" {
+		u.RawPath = "/"
+	}
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		payloadHash = hashHex(body)
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	s.signer.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %s: %w", method, key, err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3 %s %s: %w", method, key, fs.ErrNotExist)
+	}
+
+	var apiErr struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %d %s: %s", method, key, resp.StatusCode, apiErr.Code, apiErr.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: unexpected status %d", method, key, resp.StatusCode)
+}
+
+// s3Writer collects an object's content and uploads it in parts
+type s3Writer struct {
+	ctx    context.Context
+	s      *S3
+	key    string
+	header http.Header
+
+	buf      bytes.Buffer
+	uploadID string
+	parts    []completedPart
+	err      error
+	closed   bool
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, _ := w.buf.Write(p)
+	for int64(w.buf.Len()) >= w.s.partSize {
+		if err := w.flushPart(w.buf.Next(int(w.s.partSize))); err != nil {
+			w.fail(err)
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if w.uploadID == "" {
+		resp, err := w.s.do(w.ctx, http.MethodPut, w.key, nil, w.header, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if w.buf.Len() > 0 {
+		if err := w.flushPart(w.buf.Bytes()); err != nil {
+			w.fail(err)
+			return err
+		}
+	}
+
+	if err := w.complete(); err != nil {
+		w.fail(err)
+		return err
+	}
+	return nil
+}
+
+// flushPart uploads one part, starting the multipart upload on the first call
+func (w *s3Writer) flushPart(data []byte) error {
+	if w.uploadID == "" {
+		query := url.Values{"uploads": {""}}
+		resp, err := w.s.do(w.ctx, http.MethodPost, w.key, query, w.header, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || result.UploadID == "" {
+			return fmt.Errorf("failed to start multipart upload for %s: %v", w.key, err)
+		}
+		w.uploadID = result.UploadID
+	}
+
+	number := len(w.parts) + 1
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {w.uploadID},
+	}
+	resp, err := w.s.do(w.ctx, http.MethodPut, w.key, query, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	w.parts = append(w.parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+func (w *s3Writer) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.s.do(w.ctx, http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// CompleteMultipartUpload can fail after a 200 with an error document in the body
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("failed to complete multipart upload for %s: %s: %s", w.key, result.Code, result.Message)
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() {
+	if !w.closed {
+		w.fail(errors.New("upload aborted"))
+	}
+}
+
+// fail records the first error and aborts the multipart upload so S3 doesn't
+// keep the orphaned parts around
+func (w *s3Writer) fail(err error) {
+	if w.err != nil {
+		return
+	}
+	w.err = err
+
+	if w.uploadID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if resp, err := w.s.do(ctx, http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"transcode-worker/internal/config"
+)
+
+// fakeS3 is an in-memory, path-style S3 bucket that speaks just enough of the
+// API for the backend: objects, multipart uploads and ListObjectsV2
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	meta     map[string]string // SHA-256 metadata by key
+	uploads  map[string]map[int][]byte
+	requests []string // "METHOD key?query" of every request
+	failPart int      // Part number answered with a 500, 0 for none
+	nextID   int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3) {
+	t.Helper()
+	fake := &fakeS3{
+		bucket:  "media",
+		objects: make(map[string][]byte),
+		meta:    make(map[string]string),
+		uploads: make(map[string]map[int][]byte),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	s, err := NewS3(config.S3Config{
+		Endpoint:     server.URL,
+		Region:       "us-east-1",
+		Bucket:       fake.bucket,
+		AccessKey:    "AKID",
+		SecretKey:    "secret",
+		UsePathStyle: true,
+		PartSizeMB:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, s
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+	query := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+key+"?"+r.URL.RawQuery)
+
+	// Every request must be signed over the body it carries
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, "unsigned", http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != hashHex(body) {
+		http.Error(w, "payload hash mismatch", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		f.meta[key] = r.Header.Get(sha256MetaHeader)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if number == f.failPart {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "<Error><Code>InternalError</Code><Message>try again</Message></Error>")
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		id := query.Get("uploadId")
+		var complete struct {
+			Parts []completedPart `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"etag-%d"`, i+1) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			object = append(object, f.uploads[id][part.PartNumber]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, id)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		f.meta[key] = r.Header.Get(sha256MetaHeader)
+
+	case r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+		w.Header().Set("Last-Modified", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat))
+		if sum := f.meta[key]; sum != "" {
+			w.Header().Set(sha256MetaHeader, sum)
+		}
+
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.list(w, query.Get("prefix"), query.Get("continuation-token"))
+
+	case r.Method == http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(object)
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list answers ListObjectsV2 two keys per page, to exercise continuation
+func (f *fakeS3) list(w http.ResponseWriter, prefix, token string) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	truncated := len(keys) > 2
+	if truncated {
+		keys = keys[:2]
+	}
+	var b strings.Builder
+	b.WriteString("<ListBucketResult>")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2024-01-02T03:04:05.000Z</LastModified></Contents>",
+			key, len(f.objects[key]))
+	}
+	if truncated {
+		fmt.Fprintf(&b, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1])
+	}
+	b.WriteString("</ListBucketResult>")
+	io.WriteString(w, b.String())
+}
+
+func (f *fakeS3) requestsMatching(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, request := range f.requests {
+		if strings.HasPrefix(request, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestS3SinglePut(t *testing.T) {
+	fake, s := newFakeS3(t)
+	ctx := context.Background()
+
+	w, err := s.Create(ctx, "movies/movie one/index.m3u8", WriteOptions{SHA256: "abc123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "#EXTM3U\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	w.Abort() // A no-op after Close
+
+	if got := string(fake.objects["movies/movie one/index.m3u8"]); got != "#EXTM3U\n" {
+		t.Errorf("stored %q", got)
+	}
+	if fake.requestsMatching("POST") != 0 {
+		t.Error("small object sent as a multipart upload")
+	}
+
+	info, err := s.Stat(ctx, "movies/movie one/index.m3u8")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != 8 || info.SHA256 != "abc123" || info.ModTime.Year() != 2024 {
+		t.Errorf("Stat = %+v", info)
+	}
+
+	r, err := s.Open(ctx, "movies/movie one/index.m3u8")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "#EXTM3U\n" {
+		t.Errorf("Open read %q", data)
+	}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	fake, s := newFakeS3(t)
+
+	// Two and a half parts, written in chunks that straddle the part boundary
+	content := bytes.Repeat([]byte("0123456789abcdef"), (5<<20)/2/16)
+	w, err := s.Create(context.Background(), "movies/big.ts", WriteOptions{SHA256: "def456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := content; len(rest) > 0; {
+		n := min(len(rest), 300000)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if !bytes.Equal(fake.objects["movies/big.ts"], content) {
+		t.Errorf("stored %d bytes, want the %d written", len(fake.objects["movies/big.ts"]), len(content))
+	}
+	if parts := fake.requestsMatching("PUT movies/big.ts?partNumber="); parts != 3 {
+		t.Errorf("uploaded %d parts, want 3", parts)
+	}
+	if fake.meta["movies/big.ts"] != "def456" {
+		t.Error("SHA-256 metadata not sent with the multipart upload")
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("%d multipart uploads left open", len(fake.uploads))
+	}
+}
+
+func TestS3AbortsFailedMultipartUpload(t *testing.T) {
+	fake, s := newFakeS3(t)
+	fake.failPart = 2
+
+	w, err := s.Create(context.Background(), "movies/big.ts", WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, writeErr := w.Write(make([]byte, 2<<20+1))
+	if writeErr == nil || !strings.Contains(writeErr.Error(), "InternalError") {
+		t.Errorf("Write = %v, want the part upload error", writeErr)
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close after a failed part succeeded")
+	}
+
+	if fake.requestsMatching("DELETE movies/big.ts?uploadId=") != 1 || len(fake.uploads) != 0 {
+		t.Error("failed multipart upload not aborted")
+	}
+	if _, ok := fake.objects["movies/big.ts"]; ok {
+		t.Error("failed upload published an object")
+	}
+
+	// Aborting before Close discards a started upload too
+	fake.failPart = 0
+	w, _ = s.Create(context.Background(), "movies/other.ts", WriteOptions{})
+	w.Write(make([]byte, 1<<20))
+	w.Abort()
+	if err := w.Close(); err == nil {
+		t.Error("Close after Abort succeeded")
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("aborted multipart upload left open")
+	}
+	if _, ok := fake.objects["movies/other.ts"]; ok {
+		t.Error("aborted upload published an object")
+	}
+}
+
+func TestS3ListAndRemove(t *testing.T) {
+	fake, s := newFakeS3(t)
+	ctx := context.Background()
+	for _, key := range []string{"out/a/index.m3u8", "out/a/seg_000.ts", "out/a/seg_001.ts", "out/ab/index.m3u8", "other/x"} {
+		fake.objects[key] = []byte(key)
+	}
+
+	files, err := s.List(ctx, "out/a")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Path)
+	}
+	if got := strings.Join(names, ","); got != "index.m3u8,seg_000.ts,seg_001.ts" {
+		t.Errorf("List = %s", got)
+	}
+	if files[0].Size != int64(len("out/a/index.m3u8")) || files[0].ModTime.Year() != 2024 {
+		t.Errorf("List entry = %+v", files[0])
+	}
+
+	if err := s.Remove(ctx, "out/ab/index.m3u8"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := s.Stat(ctx, "out/ab/index.m3u8"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after Remove = %v, want fs.ErrNotExist", err)
+	}
+
+	if err := s.RemoveAll(ctx, "out/a"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if len(fake.objects) != 1 || fake.objects["other/x"] == nil {
+		t.Errorf("RemoveAll left %d objects, want only other/x", len(fake.objects))
+	}
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"transcode-worker/internal/config"
+)
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	Path    string // Relative to the listed dir for List, the full path for Stat
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+	SHA256  string // Content digest if the backend keeps one on record, "" otherwise
+	ETag    string // Strong entity tag of HTTP sources that send one, "" otherwise
+}
+
+// WriteOptions carries what is known about a file before it is written
+type WriteOptions struct {
+	Size   int64
+	SHA256 string // Stored alongside the object by backends that support metadata
+}
+
+// Writer is a file being written. Close publishes it, Abort discards it.
+// Abort after a successful Close is a no-op, so it is safe to defer.
+type Writer interface {
+	io.Writer
+	Close() error
+	Abort()
+}
+
+// Source is anything job inputs can be read from
+type Source interface {
+	// Stat returns file info, or an error wrapping fs.ErrNotExist
+	Stat(ctx context.Context, path string) (FileInfo, error)
+	// Open returns the file contents for reading
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+	// LocalPath returns a path ffmpeg can read directly, if there is one
+	LocalPath(path string) (string, bool)
+}
+
+// RangeSource can resume reading a file part way through, so an interrupted
+// download continues instead of starting over. file is as returned by Stat; a
+// source that can tell the file changed since returns all of it instead, and
+// start is then 0 rather than offset.
+type RangeSource interface {
+	OpenAt(ctx context.Context, file FileInfo, offset int64) (r io.ReadCloser, start int64, err error)
+}
+
+// Backend reads job sources and stores committed outputs.
+// Paths are backend locations as returned by Resolve.
+type Backend interface {
+	Source
+
+	// Name identifies the backend in logs
+	Name() string
+	// Resolve maps a path sent by the orchestrator to a backend location
+	Resolve(path string) (string, error)
+	// Rel returns the slash-separated path of a backend location relative to
+	// the backend's root, the inverse of Resolve for relative paths
+	Rel(location string) string
+	// Join joins path elements using the backend's separator
+	Join(elem ...string) string
+
+	// Create opens path for writing. Readers never see a partial file: it
+	// appears, or replaces the previous one, when Close returns nil.
+	Create(ctx context.Context, path string, opts WriteOptions) (Writer, error)
+	// Remove deletes a single file
+	Remove(ctx context.Context, path string) error
+	// RemoveAll deletes path and everything below it
+	RemoveAll(ctx context.Context, path string) error
+	// List returns every file below dir, recursively, with slash-separated relative paths
+	List(ctx context.Context, dir string) ([]FileInfo, error)
+	// MkdirAll creates a directory and its parents where the backend has directories
+	MkdirAll(ctx context.Context, path string) error
+}
+
+// Renamer is implemented by backends that can atomically rename directories,
+// which lets commits publish a fully written staging directory in one step
+type Renamer interface {
+	Rename(ctx context.Context, from, to string) error
+	// SyncDir makes entries created in or renamed into a directory durable
+	SyncDir(path string) error
+}
+
+// Exchanger is implemented by backends that can atomically swap two
+// directories. Exchange returns errors.ErrUnsupported where the filesystem
+// holding them can't.
+type Exchanger interface {
+	Exchange(ctx context.Context, a, b string) error
+}
+
+// New creates the backend selected in the configuration
+func New(cfg *config.Config) (Backend, error) {
+	switch cfg.Storage.Backend {
+	case "", "filesystem":
+		nas := NewFilesystem(cfg.NasMountPath)
+		// Validated by config.Load
+		nas.fileMode, _ = config.ParseFileMode(cfg.Output.FileMode)
+		nas.dirMode, _ = config.ParseFileMode(cfg.Output.DirMode)
+		nas.uid, nas.gid = cfg.Output.UID, cfg.Output.GID
+		return nas, nil
+	case "s3":
+		return NewS3(cfg.Storage.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+}
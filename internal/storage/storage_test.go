@@ -0,0 +1,31 @@
+package storage
+
+import "testing"
+
+func TestRelInvertsResolve(t *testing.T) {
+	nas := NewFilesystem("/mnt/nas")
+	prefixed := &S3{prefix: "media"}
+	bare := &S3{}
+
+	tests := []struct {
+		store Backend
+		path  string
+		want  string
+	}{
+		{nas, "processed/movie/720p", "processed/movie/720p"},
+		{nas, "/mnt/nas/processed/movie", "processed/movie"},
+		{nas, "/mnt/nas2/processed/movie", "mnt/nas2/processed/movie"},
+		{prefixed, "processed/movie/720p", "processed/movie/720p"},
+		{prefixed, "/processed/movie", "processed/movie"},
+		{bare, "processed/movie", "processed/movie"},
+	}
+	for _, tt := range tests {
+		location, err := tt.store.Resolve(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.store.Rel(location); got != tt.want {
+			t.Errorf("%s: Rel(Resolve(%q)) = %q, want %q", tt.store.Name(), tt.path, got, tt.want)
+		}
+	}
+}
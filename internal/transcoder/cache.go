@@ -0,0 +1,206 @@
+package transcoder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"transcode-worker/internal/config"
+	"transcode-worker/internal/storage"
+)
+
+// inputCache keeps copies of job inputs on fast local disk. Entries are keyed by
+// source path, size, modification time and entity tag, so a changed source is
+// fetched again, and least recently used entries are evicted to stay under the
+// capacity. The
+// last use is recorded as the entry's mtime, so the order survives restarts.
+type inputCache struct {
+	dir      string
+	capacity int64
+
+	mu       sync.Mutex
+	inUse    map[string]int           // Entry path -> jobs reading it
+	fetching map[string]chan struct{} // Entry path -> closed once its fetch ends
+}
+
+// newInputCache returns the cache, or nil when it is disabled
+func newInputCache(cfg config.InputCacheConfig) *inputCache {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &inputCache{
+		dir:      cfg.Dir,
+		capacity: cfg.MaxSizeGB << 30,
+		inUse:    make(map[string]int),
+		fetching: make(map[string]chan struct{}),
+	}
+}
+
+// skipReason returns why a source isn't cached, or "" if it is. A URL whose
+// server sends neither Last-Modified nor a strong ETag could change without its
+// key changing, so it is fetched for each job instead.
+func (c *inputCache) skipReason(source storage.FileInfo) string {
+	switch {
+	case source.Size > c.capacity:
+		return "larger than the input cache"
+	case storage.IsURL(source.Path) && source.ModTime.IsZero() && source.ETag == "":
+		return "server sends neither Last-Modified nor ETag"
+	}
+	return ""
+}
+
+// entryPath returns where the cached copy of a source lives
+func (c *inputCache) entryPath(source storage.FileInfo) string {
+	key := fmt.Sprintf("%s\n%d\n%d", source.Path, source.Size, source.ModTime.UnixNano())
+	if source.ETag != "" {
+		key += "\n" + source.ETag
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:16])+inputExt(source.Path))
+}
+
+// cachedInput returns the cached copy of a source, fetching it first on a miss.
+// Jobs asking for a source that is being fetched wait for that fetch rather
+// than starting another. The entry can't be evicted until release is called.
+func (t *FFmpegTranscoder) cachedInput(ctx context.Context, src storage.Source, source storage.FileInfo, expectedSHA256 string) (string, func(), error) {
+	c := t.cache
+	entry := c.entryPath(source)
+
+	for {
+		c.mu.Lock()
+		if wait, ok := c.fetching[entry]; ok {
+			c.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return "", nil, ctx.Err()
+			}
+		}
+
+		if _, err := os.Stat(entry); err == nil {
+			c.inUse[entry]++
+			c.mu.Unlock()
+
+			now := time.Now()
+			if err := os.Chtimes(entry, now, now); err != nil {
+				log.Printf("Failed to update input cache entry %s: %v", entry, err)
+			}
+			log.Printf("Input cache hit for %s: %s", source.Path, entry)
+			return entry, c.releaser(entry), nil
+		}
+
+		done := make(chan struct{})
+		c.fetching[entry] = done
+		c.inUse[entry]++
+		c.mu.Unlock()
+
+		log.Printf("Input cache miss for %s, fetching %d bytes", source.Path, source.Size)
+
+		// Sources of unknown size are accounted for once they are complete
+		needed := source.Size
+		if needed < 0 {
+			needed = 0
+		}
+		c.makeRoom(needed)
+
+		err := t.download(ctx, src, source, entry, expectedSHA256)
+
+		c.mu.Lock()
+		delete(c.fetching, entry)
+		close(done)
+		c.mu.Unlock()
+
+		if err != nil {
+			c.releaser(entry)()
+			return "", nil, err
+		}
+
+		c.makeRoom(0)
+		return entry, c.releaser(entry), nil
+	}
+}
+
+// releaser returns the function that marks an entry as no longer read by a job
+func (c *inputCache) releaser(entry string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.inUse[entry]--; c.inUse[entry] <= 0 {
+				delete(c.inUse, entry)
+			}
+		})
+	}
+}
+
+// makeRoom evicts least recently used entries until needed more bytes fit.
+// Entries in use are never evicted, so the cache may run over capacity while
+// jobs hold them. Partial fetches left by a crash are always removed.
+func (c *inputCache) makeRoom(needed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Printf("Failed to read input cache: %v", err)
+		return
+	}
+
+	type cached struct {
+		path    string
+		size    int64
+		lastUse time.Time
+	}
+
+	var files []cached
+	var total int64
+	for _, entry := range entries {
+		path := filepath.Join(c.dir, entry.Name())
+		if entry.IsDir() {
+			continue
+		}
+
+		if strings.HasSuffix(entry.Name(), ".part") {
+			if _, ok := c.fetching[strings.TrimSuffix(path, ".part")]; !ok {
+				os.Remove(path)
+			}
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, cached{path: path, size: info.Size(), lastUse: info.ModTime()})
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].lastUse.Before(files[j].lastUse)
+	})
+
+	for _, file := range files {
+		if total+needed <= c.capacity {
+			return
+		}
+		if c.inUse[file.path] > 0 {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil {
+			log.Printf("Failed to evict input cache entry %s: %v", file.path, err)
+			continue
+		}
+		log.Printf("Evicted input cache entry %s (%d bytes)", file.path, file.size)
+		total -= file.size
+	}
+}
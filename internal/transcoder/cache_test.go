@@ -0,0 +1,39 @@
+package transcoder
+
+import (
+	"testing"
+	"time"
+
+	"transcode-worker/internal/config"
+	"transcode-worker/internal/storage"
+)
+
+func TestInputCacheKey(t *testing.T) {
+	cache := newInputCache(config.InputCacheConfig{Enabled: true, Dir: t.TempDir(), MaxSizeGB: 1})
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		source storage.FileInfo
+		skip   bool
+	}{
+		{"file", storage.FileInfo{Path: "/mnt/nas/raw/movie.mp4", Size: 1000, ModTime: modified}, false},
+		{"url with Last-Modified", storage.FileInfo{Path: "https://media.example.com/movie.mp4", Size: 1000, ModTime: modified}, false},
+		{"url with ETag", storage.FileInfo{Path: "https://media.example.com/movie.mp4", Size: 1000, ETag: `"v1"`}, false},
+		{"url with neither", storage.FileInfo{Path: "https://media.example.com/movie.mp4", Size: 1000}, true},
+		{"too large", storage.FileInfo{Path: "/mnt/nas/raw/movie.mp4", Size: 2 << 30, ModTime: modified}, true},
+	}
+	for _, tt := range tests {
+		if got := cache.skipReason(tt.source); (got != "") != tt.skip {
+			t.Errorf("%s: skipReason = %q, want skipped %v", tt.name, got, tt.skip)
+		}
+	}
+
+	// A new ETag is a new entry, even with the same size and no modification time
+	v1 := storage.FileInfo{Path: "https://media.example.com/movie.mp4", Size: 1000, ETag: `"v1"`}
+	v2 := v1
+	v2.ETag = `"v2"`
+	if cache.entryPath(v1) == cache.entryPath(v2) {
+		t.Error("sources with different ETags share a cache entry")
+	}
+}
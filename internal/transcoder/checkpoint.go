@@ -0,0 +1,237 @@
+package transcoder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"transcode-worker/internal/storage"
+	"transcode-worker/pkg/models"
+)
+
+// checkpointFileName is the checkpoint file kept at the root of each job temp dir
+const checkpointFileName = "checkpoint.json"
+
+// sourceFingerprint identifies the exact input a checkpoint was produced from.
+// A resumed job must read the same bytes, otherwise old segments would be mixed with new ones.
+type sourceFingerprint struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	ETag    string    `json:"etag,omitempty"` // URLs whose server sends one
+}
+
+// renditionCheckpoint tracks how far a single rendition got
+type renditionCheckpoint struct {
+	Encoded   bool    `json:"encoded"`            // ffmpeg finished the whole rendition
+	Committed bool    `json:"committed"`          // output was copied to its destination
+	Segments  int     `json:"segments,omitempty"` // complete segments on disk when last resumed
+	Offset    float64 `json:"offset,omitempty"`   // source seconds covered by those segments
+	Commit    string  `json:"commit,omitempty"`   // "staged" or "streaming", decided when the rendition starts
+
+	Metrics *models.RenditionMetrics `json:"metrics,omitempty"` // kept so resumed jobs still report them
+}
+
+// checkpoint is persisted in the job temp dir so a restarted worker can resume a
+// reassigned job instead of encoding it again from zero.
+type checkpoint struct {
+	JobID      string                          `json:"job_id"`
+	Source     sourceFingerprint               `json:"source"`
+	Renditions map[string]*renditionCheckpoint `json:"renditions"`
+	Complexity *models.ComplexityReport        `json:"complexity,omitempty"`
+	UpdatedAt  time.Time                       `json:"updated_at"`
+
+	// Rendition key -> where it is committed, decided once by the overwrite policy
+	Destinations map[string]string `json:"destinations,omitempty"`
+
+	path string
+}
+
+// loadCheckpoint returns the checkpoint stored in jobTempDir.
+// If there is none, or it belongs to a different job or source, the temp dir is
+// emptied and a fresh checkpoint is returned. The boolean reports whether an
+// existing checkpoint is being resumed.
+func loadCheckpoint(jobTempDir string, job *models.JobSpec, input storage.FileInfo) (*checkpoint, bool, error) {
+	source := sourceFingerprint{
+		Path:    input.Path,
+		Size:    input.Size,
+		ModTime: input.ModTime,
+		ETag:    input.ETag,
+	}
+
+	fresh := &checkpoint{
+		JobID:      job.JobID,
+		Source:     source,
+		Renditions: make(map[string]*renditionCheckpoint),
+		path:       filepath.Join(jobTempDir, checkpointFileName),
+	}
+
+	data, err := os.ReadFile(fresh.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, false, fmt.Errorf("failed to read checkpoint: %w", err)
+		}
+		return fresh, false, emptyDir(jobTempDir)
+	}
+
+	var existing checkpoint
+	if err := json.Unmarshal(data, &existing); err != nil {
+		log.Printf("Discarding unreadable checkpoint for job %s: %v", job.JobID, err)
+		return fresh, false, emptyDir(jobTempDir)
+	}
+
+	if existing.JobID != job.JobID || existing.Source != source {
+		log.Printf("Discarding checkpoint for job %s: source changed since it was written", job.JobID)
+		return fresh, false, emptyDir(jobTempDir)
+	}
+
+	if existing.Renditions == nil {
+		existing.Renditions = make(map[string]*renditionCheckpoint)
+	}
+	existing.path = fresh.path
+
+	return &existing, true, nil
+}
+
+// readCheckpoint returns the checkpoint stored in jobTempDir as is, or an error
+// wrapping fs.ErrNotExist if there is none
+func readCheckpoint(jobTempDir string) (*checkpoint, error) {
+	path := filepath.Join(jobTempDir, checkpointFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint: %w", err)
+	}
+	cp.path = path
+	return &cp, nil
+}
+
+// emptyDir removes everything inside dir but keeps the dir itself
+func emptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to clean directory: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// rendition returns the state for a rendition key, creating it if needed
+func (c *checkpoint) rendition(key string) *renditionCheckpoint {
+	state, ok := c.Renditions[key]
+	if !ok {
+		state = &renditionCheckpoint{}
+		c.Renditions[key] = state
+	}
+	return state
+}
+
+// save atomically writes the checkpoint so a crash never leaves a torn file behind
+func (c *checkpoint) save() error {
+	c.UpdatedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+
+	tmpPath := c.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint: %w", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync checkpoint: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close checkpoint: %w", err)
+	}
+
+	return os.Rename(tmpPath, c.path)
+}
+
+// resumePoint inspects a partially encoded rendition dir and returns the number of
+// complete segments and the source time they cover. Segments that ffmpeg did not
+// get to list in the playlist are partial and get deleted, and the playlist is
+// rewritten so ffmpeg can append to it cleanly. done is true when the playlist was
+// already finished. When segments are streamed, a listed segment may already have
+// moved to publishedDir in the storage backend; pass "" otherwise.
+func (t *FFmpegTranscoder) resumePoint(ctx context.Context, renditionDir, playlistName, publishedDir string) (segments int, offset float64, done bool, err error) {
+	playlistPath := filepath.Join(renditionDir, playlistName)
+
+	playlist, err := parseMediaPlaylist(playlistPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Discarding unreadable playlist %s: %v", playlistPath, err)
+		}
+		return 0, 0, false, emptyDir(renditionDir)
+	}
+
+	// Only trust segments that are listed and actually on disk, in order
+	listed := make(map[string]bool)
+	var complete []mediaSegment
+	for _, seg := range playlist.Segments {
+		info, statErr := t.local.Stat(ctx, filepath.Join(renditionDir, seg.URI))
+		if (statErr != nil || info.Size == 0) && publishedDir != "" {
+			info, statErr = t.store.Stat(ctx, t.store.Join(publishedDir, seg.URI))
+		}
+		if statErr != nil || info.Size == 0 {
+			break
+		}
+		complete = append(complete, seg)
+		listed[seg.URI] = true
+	}
+
+	if playlist.EndList && len(complete) == len(playlist.Segments) {
+		return len(complete), playlist.TotalDuration(), true, nil
+	}
+
+	// Remove partial or unlisted segments (and temp files) left behind by the interrupted run
+	entries, err := os.ReadDir(renditionDir)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to read rendition dir: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		partial := strings.HasSuffix(name, ".ts") || strings.HasSuffix(name, ".tmp")
+		if name == playlistName || listed[name] || !partial {
+			continue
+		}
+		if err := os.Remove(filepath.Join(renditionDir, name)); err != nil {
+			return 0, 0, false, fmt.Errorf("failed to remove partial segment %s: %w", name, err)
+		}
+	}
+
+	if len(complete) == 0 {
+		return 0, 0, false, emptyDir(renditionDir)
+	}
+
+	playlist.Segments = complete
+	playlist.EndList = false
+	if err := writeMediaPlaylist(playlistPath, playlist); err != nil {
+		return 0, 0, false, fmt.Errorf("failed to rewrite playlist: %w", err)
+	}
+
+	return len(complete), playlist.TotalDuration(), false, nil
+}
@@ -0,0 +1,167 @@
+package transcoder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"transcode-worker/internal/storage"
+	"transcode-worker/pkg/models"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	jobTempDir := t.TempDir()
+	job := &models.JobSpec{JobID: "job-1"}
+	input := storage.FileInfo{Path: "/nas/raw/movie.mp4", Size: 1 << 30, ModTime: time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)}
+
+	writeFiles(t, jobTempDir, map[string]string{"stale/segment_000.ts": "x"})
+	cp, resumed, err := loadCheckpoint(jobTempDir, job, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed {
+		t.Error("no checkpoint on disk, but resumed")
+	}
+	if got := listFiles(t, jobTempDir); len(got) != 0 {
+		t.Errorf("fresh job temp dir holds %v", got)
+	}
+
+	state := cp.rendition("720p_2500k")
+	state.Segments, state.Offset, state.Commit = 12, 72.5, commitStreaming
+	state.Metrics = &models.RenditionMetrics{Resolution: "720p", Bitrate: "2500k"}
+	cp.rendition("1080p_5000k").Encoded = true
+	cp.Destinations = map[string]string{"720p_2500k": "/nas/out/720p"}
+	if err := cp.save(); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, jobTempDir, map[string]string{"720p_2500k/segment_000.ts": "x"})
+
+	loaded, resumed, err := loadCheckpoint(jobTempDir, job, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed {
+		t.Fatal("saved checkpoint not resumed")
+	}
+	got := loaded.Renditions["720p_2500k"]
+	if got == nil || got.Segments != 12 || got.Offset != 72.5 || got.Commit != commitStreaming || got.Metrics == nil || got.Metrics.Resolution != "720p" {
+		t.Errorf("rendition = %+v, want it as saved", got)
+	}
+	if !loaded.Renditions["1080p_5000k"].Encoded || loaded.Destinations["720p_2500k"] != "/nas/out/720p" {
+		t.Errorf("checkpoint = %+v, want it as saved", loaded)
+	}
+	if len(listFiles(t, filepath.Join(jobTempDir, "720p_2500k"))) != 1 {
+		t.Error("resuming removed encoded segments")
+	}
+
+	// Saving again goes through the loaded checkpoint's path
+	loaded.rendition("720p_2500k").Segments = 13
+	if err := loaded.save(); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := readCheckpoint(jobTempDir); err != nil || read.Renditions["720p_2500k"].Segments != 13 {
+		t.Errorf("readCheckpoint = %+v, %v", read, err)
+	}
+}
+
+func TestCheckpointDiscarded(t *testing.T) {
+	job := &models.JobSpec{JobID: "job-1"}
+	input := storage.FileInfo{Path: "/nas/raw/movie.mp4", Size: 1000, ModTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	tests := []struct {
+		name  string
+		job   *models.JobSpec
+		input storage.FileInfo
+	}{
+		{"other job", &models.JobSpec{JobID: "job-2"}, input},
+		{"source resized", job, storage.FileInfo{Path: input.Path, Size: 2000, ModTime: input.ModTime}},
+		{"source modified", job, storage.FileInfo{Path: input.Path, Size: input.Size, ModTime: input.ModTime.Add(time.Second)}},
+		{"other source", job, storage.FileInfo{Path: "/nas/raw/other.mp4", Size: input.Size, ModTime: input.ModTime}},
+		{"source retagged", job, storage.FileInfo{Path: input.Path, Size: input.Size, ModTime: input.ModTime, ETag: `"v2"`}},
+	}
+	for _, tt := range tests {
+		jobTempDir := t.TempDir()
+		cp, _, err := loadCheckpoint(jobTempDir, job, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp.rendition("720p_2500k").Segments = 3
+		if err := cp.save(); err != nil {
+			t.Fatal(err)
+		}
+		writeFiles(t, jobTempDir, map[string]string{"720p_2500k/segment_000.ts": "x"})
+
+		fresh, resumed, err := loadCheckpoint(jobTempDir, tt.job, tt.input)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if resumed || len(fresh.Renditions) != 0 {
+			t.Errorf("%s: checkpoint resumed", tt.name)
+		}
+		if got := listFiles(t, jobTempDir); len(got) != 0 {
+			t.Errorf("%s: job temp dir still holds %v", tt.name, got)
+		}
+	}
+
+	// An unreadable checkpoint starts over too
+	jobTempDir := t.TempDir()
+	writeFiles(t, jobTempDir, map[string]string{checkpointFileName: `{"job_id":`})
+	if _, resumed, err := loadCheckpoint(jobTempDir, job, input); err != nil || resumed {
+		t.Errorf("torn checkpoint: resumed = %v, err = %v", resumed, err)
+	}
+}
+
+func TestResumePoint(t *testing.T) {
+	tr, _ := newTestTranscoder(t)
+	dir := t.TempDir()
+
+	listed := &mediaPlaylist{Segments: []mediaSegment{
+		{URI: "segment_000.ts", Duration: 6},
+		{URI: "segment_001.ts", Duration: 6},
+		{URI: "segment_002.ts", Duration: 6}, // Listed, but empty on disk
+	}}
+	if err := writeMediaPlaylist(filepath.Join(dir, "index.m3u8"), listed); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{
+		"segment_000.ts": "a",
+		"segment_001.ts": "b",
+		"segment_002.ts": "",
+		"segment_003.ts": "partial",
+		"notes.txt":      "kept",
+	})
+
+	segments, offset, done, err := tr.resumePoint(context.Background(), dir, "index.m3u8", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segments != 2 || offset != 12 || done {
+		t.Errorf("resumePoint = %d segments, %vs, done %v; want 2, 12s, not done", segments, offset, done)
+	}
+	if got := strings.Join(listFiles(t, dir), ","); got != "index.m3u8,notes.txt,segment_000.ts,segment_001.ts" {
+		t.Errorf("rendition dir holds %s", got)
+	}
+	rewritten, err := parseMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+	if err != nil || len(rewritten.Segments) != 2 {
+		t.Errorf("rewritten playlist = %+v, %v", rewritten, err)
+	}
+
+	// A finished playlist whose segments are all there needs no encoding
+	rewritten.EndList = true
+	writeMediaPlaylist(filepath.Join(dir, "index.m3u8"), rewritten)
+	if segments, _, done, _ := tr.resumePoint(context.Background(), dir, "index.m3u8", ""); segments != 2 || !done {
+		t.Errorf("finished rendition: %d segments, done %v", segments, done)
+	}
+
+	// Without a playlist nothing can be trusted
+	os.Remove(filepath.Join(dir, "index.m3u8"))
+	if segments, _, _, err := tr.resumePoint(context.Background(), dir, "index.m3u8", ""); err != nil || segments != 0 {
+		t.Errorf("no playlist: %d segments, %v", segments, err)
+	}
+	if got := listFiles(t, dir); len(got) != 0 {
+		t.Errorf("rendition dir without playlist still holds %v", got)
+	}
+}
@@ -0,0 +1,462 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"transcode-worker/internal/config"
+	"transcode-worker/pkg/models"
+)
+
+// chunkDoneSuffix marks a chunk whose encode finished, so a resumed job can skip it
+const chunkDoneSuffix = ".done"
+
+// hardwareCodecSuffixes identify encoders that run on dedicated hardware.
+// Those are limited by encoder sessions, not CPU cores, so they are never chunked.
+var hardwareCodecSuffixes = []string{"_nvenc", "_qsv", "_vaapi", "_v4l2m2m", "_videotoolbox", "_amf"}
+
+// IsHardwareCodec reports whether a video encoder runs on dedicated hardware
+func IsHardwareCodec(codec string) bool {
+	for _, suffix := range hardwareCodecSuffixes {
+		if strings.HasSuffix(codec, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeChunk is a keyframe-aligned time range of the source
+type encodeChunk struct {
+	Index int
+	Start float64
+	End   float64
+}
+
+func (c encodeChunk) Duration() float64 {
+	return c.End - c.Start
+}
+
+// useChunkedEncoding reports whether a rendition should be encoded in parallel chunks
+func (t *FFmpegTranscoder) useChunkedEncoding(output models.OutputSpec, duration float64) bool {
+	if !t.chunked.Enabled {
+		return false
+	}
+
+	if IsHardwareCodec(output.Codec) {
+		return false
+	}
+
+	// Not worth the extra concat pass unless there are at least two chunks
+	return duration >= 2*t.chunked.ChunkDuration.Seconds()
+}
+
+// slotCPUBudget splits the CPUs evenly between the jobs that may run at once,
+// so concurrent jobs don't each size their encoders for the whole machine
+func slotCPUBudget(slots config.SlotsConfig) int {
+	budget := runtime.NumCPU()
+	if jobs := slots.CPU + slots.GPU; jobs > 1 {
+		budget /= jobs
+	}
+	if budget < 1 {
+		budget = 1
+	}
+	return budget
+}
+
+// chunkParallelism returns how many chunk encoders may run at once
+func (t *FFmpegTranscoder) chunkParallelism() int {
+	if t.chunked.MaxParallel > 0 {
+		return t.chunked.MaxParallel
+	}
+
+	parallel := t.cpuBudget / 4
+	if parallel < 2 {
+		parallel = 2
+	}
+	return parallel
+}
+
+// transcodeChunked encodes a rendition by splitting the source at keyframes into
+// time chunks, encoding the video of each chunk concurrently, and then
+// concatenating them into one continuous HLS rendition. Audio is encoded once in
+// the final pass so there are no priming gaps at chunk boundaries.
+func (t *FFmpegTranscoder) transcodeChunked(
+	ctx context.Context,
+	job *models.JobSpec,
+	output models.OutputSpec,
+	outputDir string,
+	chunkDir string,
+	duration float64,
+	progressCh chan<- models.JobProgress,
+) error {
+	keyframes, err := t.getKeyframeTimes(ctx, job.GetInputSource())
+	if err != nil {
+		return fmt.Errorf("failed to read keyframes: %w", err)
+	}
+
+	chunks := planChunks(keyframes, duration, t.chunked.ChunkDuration.Seconds())
+	parallel := t.chunkParallelism()
+	log.Printf("Chunked encoding: %d chunks, %d in parallel", len(chunks), parallel)
+
+	if err := os.MkdirAll(chunkDir, 0755); err != nil {
+		return fmt.Errorf("failed to create chunk dir: %w", err)
+	}
+
+	// Split the job's threads evenly so parallel encoders don't oversubscribe the CPU
+	threads := t.cpuBudget / parallel
+	if threads < 1 {
+		threads = 1
+	}
+
+	chunkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := newChunkProgress(chunks, duration, progressCh)
+	sem := make(chan struct{}, parallel)
+	errCh := make(chan error, len(chunks))
+	var wg sync.WaitGroup
+
+	for _, chunk := range chunks {
+		chunkPath := filepath.Join(chunkDir, fmt.Sprintf("chunk_%04d.mkv", chunk.Index))
+
+		// Chunks finished before an interruption are reused as-is
+		if _, err := os.Stat(chunkPath + chunkDoneSuffix); err == nil {
+			progress.complete(chunk.Index)
+			continue
+		}
+
+		wg.Add(1)
+		go func(chunk encodeChunk, chunkPath string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-chunkCtx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			if err := t.encodeChunk(chunkCtx, job, output, chunk, chunkPath, threads, progress); err != nil {
+				errCh <- fmt.Errorf("chunk %d: %w", chunk.Index, err)
+				cancel() // Fail fast, the rendition can't be assembled anyway
+				return
+			}
+			progress.complete(chunk.Index)
+		}(chunk, chunkPath)
+	}
+
+	wg.Wait()
+	close(errCh)
+
+	if err := <-errCh; err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return t.concatChunks(ctx, job, output, chunks, chunkDir, outputDir)
+}
+
+// encodeChunk encodes the video of a single chunk into an intermediate file
+func (t *FFmpegTranscoder) encodeChunk(
+	ctx context.Context,
+	job *models.JobSpec,
+	output models.OutputSpec,
+	chunk encodeChunk,
+	chunkPath string,
+	threads int,
+	progress *chunkProgress,
+) error {
+	args := []string{
+		"-y",
+		"-ss", fmt.Sprintf("%.6f", chunk.Start),
+	}
+	args = append(args, inputArgs(job.GetInputSource())...)
+	args = append(args,
+		"-t", fmt.Sprintf("%.6f", chunk.Duration()),
+		"-map", "0:v:0",
+		"-an", "-sn",
+		"-c:v", output.Codec,
+		"-b:v", output.Bitrate,
+		"-threads", strconv.Itoa(threads),
+	)
+
+	if output.Resolution != "" {
+		scale := t.getScaleFilter(output.Resolution)
+		if scale != "" {
+			args = append(args, "-vf", scale)
+		}
+	}
+
+	// Force keyframes on the global segment grid so the HLS muxer can cut the
+	// concatenated stream at the same points a single encode would have
+	if forced := segmentKeyframes(chunk, job.GetSegmentTime()); forced != "" {
+		args = append(args, "-force_key_frames", forced)
+	}
+
+	args = append(args, chunkPath)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stderr pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	chunkProgressCh := make(chan models.JobProgress, 10)
+	parseDone := make(chan struct{})
+	go func() {
+		defer close(parseDone)
+		for p := range chunkProgressCh {
+			progress.update(chunk.Index, p)
+		}
+	}()
+
+	t.parseProgress(stderr, chunk.Duration(), 0, chunkProgressCh)
+	close(chunkProgressCh)
+	<-parseDone
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w", err)
+	}
+
+	if err := os.WriteFile(chunkPath+chunkDoneSuffix, nil, 0644); err != nil {
+		return fmt.Errorf("failed to mark chunk done: %w", err)
+	}
+
+	return nil
+}
+
+// concatChunks joins the encoded chunks with the concat demuxer and segments the
+// result into HLS. Video is stream-copied, audio is encoded from the source in one go.
+func (t *FFmpegTranscoder) concatChunks(
+	ctx context.Context,
+	job *models.JobSpec,
+	output models.OutputSpec,
+	chunks []encodeChunk,
+	chunkDir string,
+	outputDir string,
+) error {
+	var list bytes.Buffer
+	for _, chunk := range chunks {
+		chunkPath := filepath.Join(chunkDir, fmt.Sprintf("chunk_%04d.mkv", chunk.Index))
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(chunkPath, "'", `'\''`))
+	}
+
+	listPath := filepath.Join(chunkDir, "concat.txt")
+	if err := os.WriteFile(listPath, list.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write concat list: %w", err)
+	}
+
+	// Anything from an earlier non-chunked attempt would corrupt the playlist
+	if err := emptyDir(outputDir); err != nil {
+		return err
+	}
+
+	args := []string{"-f", "concat", "-safe", "0", "-i", listPath}
+	args = append(args, inputArgs(job.GetInputSource())...)
+	args = append(args,
+		"-map", "0:v:0",
+		"-map", "1:a:0?",
+		"-c:v", "copy",
+		"-c:a", job.GetAudioCodec(&output),
+		"-b:a", job.GetAudioBitrate(&output),
+		"-f", "hls",
+		"-hls_time", fmt.Sprintf("%d", job.GetSegmentTime()),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outputDir, t.segmentPattern(job, output)),
+		filepath.Join(outputDir, t.playlistFile(job, output)),
+	)
+
+	log.Printf("FFmpeg concat command: ffmpeg %s", strings.Join(args, " "))
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg concat failed: %w: %s", err, lastLine(stderr.String()))
+	}
+
+	return nil
+}
+
+// getKeyframeTimes lists the times of all video keyframes from the start of the
+// input, as -ss takes them, using ffprobe.
+// It only reads packet headers, so it is fast even for very large files.
+func (t *FFmpegTranscoder) getKeyframeTimes(ctx context.Context, inputPath string) ([]float64, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,flags:format=start_time",
+		"-of", "csv=p=1",
+		inputPath,
+	)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+	return parseKeyframes(out), nil
+}
+
+// parseKeyframes reads the keyframe times from ffprobe's packet list and makes
+// them relative to the format's start time. Packet timestamps are absolute,
+// while -ss seeks from the start of the file, which for MPEG-TS sources and
+// many camera files is well past zero.
+func parseKeyframes(out []byte) []float64 {
+	var keyframes []float64
+	startTime := 0.0
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+		switch {
+		case len(fields) == 2 && fields[0] == "format":
+			if start, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				startTime = start
+			}
+		case len(fields) == 3 && fields[0] == "packet" && strings.Contains(fields[2], "K"):
+			pts, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				continue // N/A timestamps
+			}
+			keyframes = append(keyframes, pts)
+		}
+	}
+
+	// The format section comes after the packets
+	relative := keyframes[:0]
+	for _, pts := range keyframes {
+		if pts -= startTime; pts >= 0 {
+			relative = append(relative, pts)
+		}
+	}
+	sort.Float64s(relative)
+	return relative
+}
+
+// planChunks cuts [0, duration) into chunks of roughly chunkDuration seconds,
+// moving each boundary forward to the next source keyframe.
+func planChunks(keyframes []float64, duration, chunkDuration float64) []encodeChunk {
+	var chunks []encodeChunk
+	start := 0.0
+
+	for start < duration {
+		end := duration
+		target := start + chunkDuration
+
+		// Avoid a tiny trailing chunk
+		if target+chunkDuration/2 < duration {
+			idx := sort.SearchFloat64s(keyframes, target)
+			if idx < len(keyframes) && keyframes[idx] < duration {
+				end = keyframes[idx]
+			}
+		}
+
+		chunks = append(chunks, encodeChunk{Index: len(chunks), Start: start, End: end})
+		start = end
+	}
+
+	return chunks
+}
+
+// segmentKeyframes returns the chunk-relative keyframe times that fall on the
+// global HLS segment grid, formatted for -force_key_frames.
+func segmentKeyframes(chunk encodeChunk, segmentTime int) string {
+	if segmentTime <= 0 {
+		return ""
+	}
+
+	var times []string
+	step := float64(segmentTime)
+	for boundary := step * float64(int(chunk.Start/step)+1); boundary < chunk.End; boundary += step {
+		times = append(times, fmt.Sprintf("%.6f", boundary-chunk.Start))
+	}
+
+	return strings.Join(times, ",")
+}
+
+// lastLine returns the last non-empty line of ffmpeg output for error messages
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// chunkProgress aggregates per-chunk progress into a single rendition progress
+type chunkProgress struct {
+	mu       sync.Mutex
+	chunks   []encodeChunk
+	done     []float64 // seconds encoded per chunk
+	fps      []float64
+	duration float64
+	out      chan<- models.JobProgress
+}
+
+func newChunkProgress(chunks []encodeChunk, duration float64, out chan<- models.JobProgress) *chunkProgress {
+	return &chunkProgress{
+		chunks:   chunks,
+		done:     make([]float64, len(chunks)),
+		fps:      make([]float64, len(chunks)),
+		duration: duration,
+		out:      out,
+	}
+}
+
+// update records the progress of one chunk and publishes the combined progress
+func (p *chunkProgress) update(index int, progress models.JobProgress) {
+	p.mu.Lock()
+	p.done[index] = p.chunks[index].Duration() * progress.Percent / 100
+	p.fps[index] = progress.FPS
+	p.publish()
+	p.mu.Unlock()
+}
+
+// complete marks a chunk as fully encoded
+func (p *chunkProgress) complete(index int) {
+	p.mu.Lock()
+	p.done[index] = p.chunks[index].Duration()
+	p.fps[index] = 0
+	p.publish()
+	p.mu.Unlock()
+}
+
+func (p *chunkProgress) publish() {
+	var encoded, fps float64
+	for i := range p.chunks {
+		encoded += p.done[i]
+		fps += p.fps[i]
+	}
+
+	percent := encoded / p.duration * 100
+	if percent > 100 {
+		percent = 100
+	}
+
+	// Same ETA estimate as parseProgress, using the combined fps
+	var eta int
+	if fps > 0 {
+		eta = int((p.duration - encoded) / fps)
+	}
+
+	select {
+	case p.out <- models.JobProgress{Percent: percent, FPS: fps, ETA: eta}:
+	default:
+		// Channel full, skip this update
+	}
+}
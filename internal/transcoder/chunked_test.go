@@ -0,0 +1,94 @@
+package transcoder
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"transcode-worker/internal/config"
+)
+
+func TestSlotCPUBudget(t *testing.T) {
+	cpus := runtime.NumCPU()
+	tests := []struct {
+		slots config.SlotsConfig
+		want  int
+	}{
+		{config.SlotsConfig{CPU: 1}, cpus},
+		{config.SlotsConfig{CPU: 2, GPU: 2}, max(cpus/4, 1)},
+		{config.SlotsConfig{CPU: 4 * cpus}, 1},
+	}
+	for _, tt := range tests {
+		if got := slotCPUBudget(tt.slots); got != tt.want {
+			t.Errorf("slotCPUBudget(%+v) = %d, want %d", tt.slots, got, tt.want)
+		}
+	}
+}
+
+func TestChunkParallelism(t *testing.T) {
+	tr, _ := newTestTranscoder(t)
+	tests := []struct {
+		budget, maxParallel, want int
+	}{
+		{16, 0, 4},
+		{4, 0, 2},
+		{1, 0, 2},
+		{16, 3, 3},
+	}
+	for _, tt := range tests {
+		tr.cpuBudget, tr.chunked.MaxParallel = tt.budget, tt.maxParallel
+		if got := tr.chunkParallelism(); got != tt.want {
+			t.Errorf("chunkParallelism with budget %d, max %d = %d, want %d", tt.budget, tt.maxParallel, got, tt.want)
+		}
+	}
+}
+
+func TestParseKeyframes(t *testing.T) {
+	// An MPEG-TS source, whose timestamps start at 1.4s
+	out := "packet,1.400000,K__\n" +
+		"packet,1.440000,___\n" +
+		"packet,N/A,K__\n" +
+		"packet,3.400000,K_\n" +
+		"packet,1.360000,K__\n" +
+		"packet,5.400000,K__\n" +
+		"format,1.400000\n"
+	got := parseKeyframes([]byte(out))
+	want := []float64{0, 2, 4}
+	if len(got) != len(want) {
+		t.Fatalf("parseKeyframes = %v, want %v", got, want)
+	}
+	for i := range want {
+		if diff := got[i] - want[i]; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("parseKeyframes = %v, want %v", got, want)
+			break
+		}
+	}
+
+	// Chunks are cut at the relative keyframe times -ss expects
+	chunks := planChunks(got, 6, 3)
+	if len(chunks) != 2 || chunks[0].End != 4 || chunks[1].Start != 4 || chunks[1].End != 6 {
+		t.Errorf("planChunks = %+v", chunks)
+	}
+}
+
+func TestGetKeyframeTimesOffsetSource(t *testing.T) {
+	requireFFmpeg(t)
+	path := filepath.Join(t.TempDir(), "source.ts")
+	cmd := exec.Command("ffmpeg", "-v", "error",
+		"-f", "lavfi", "-i", "testsrc=duration=6:size=320x180:rate=25",
+		"-c:v", "libx264", "-preset", "ultrafast", "-g", "50", "-f", "mpegts", path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to generate source: %v: %s", err, out)
+	}
+
+	tr, _ := newTestTranscoder(t)
+	keyframes, err := tr.getKeyframeTimes(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyframes) < 3 || keyframes[0] > 0.05 || keyframes[1] < 1.9 || keyframes[1] > 2.1 {
+		t.Errorf("keyframes = %v, want 0, 2, 4 relative to the start time", keyframes)
+	}
+}
@@ -0,0 +1,572 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"transcode-worker/internal/storage"
+	"transcode-worker/pkg/models"
+)
+
+// stagingRegistryName is the dir under state_dir holding one marker per staging
+// dir that currently exists next to a destination. The NAS is never scanned;
+// markers left behind by a crash tell the next startup exactly what to remove,
+// so they are kept where a reboot doesn't clear them.
+const stagingRegistryName = ".staging"
+
+// checksumManifestName is written into every committed output and lists the
+// SHA-256 of each file in sha256sum format
+const checksumManifestName = "checksums.sha256"
+
+// commitDirectory publishes src at dst atomically. Files are copied into a hidden
+// staging dir in the allowed output root holding dst and fsynced along with the
+// dir, then the staging dir is renamed into place, so players only ever see the
+// complete previous output or the complete new one. It returns the SHA-256 of
+// the checksum manifest.
+//
+// The staging dir is named after the job and dst, and kept when the commit is
+// interrupted, so a retry only copies the files that are not there yet.
+// Backends that can't rename directories get commitInPlace instead.
+func (t *FFmpegTranscoder) commitDirectory(ctx context.Context, jobID, src, dst string) (manifestHash string, upload models.UploadMetrics, err error) {
+	renamer, ok := t.store.(storage.Renamer)
+	if !ok {
+		return t.commitInPlace(ctx, src, dst)
+	}
+
+	// Never swap out a root itself, and never stage outside of one
+	root, err := t.paths.OutputRoot(dst)
+	if err != nil {
+		return "", upload, fmt.Errorf("refusing to commit to %s: %w", dst, err)
+	}
+
+	parent := filepath.Dir(dst)
+	if err := t.store.MkdirAll(ctx, parent); err != nil {
+		return "", upload, fmt.Errorf("failed to create destination parent: %w", err)
+	}
+
+	staging := filepath.Join(root, fmt.Sprintf(".%s.staging-%s", stagingName(dst), jobID))
+	marker, err := t.registerStaging(staging, jobID, "")
+	if err != nil {
+		return "", upload, err
+	}
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			log.Printf("Commit interrupted, keeping staging dir for resume: %s", staging)
+			return
+		}
+		// No-op once the rename succeeded
+		t.store.RemoveAll(ctx, staging)
+		t.unregisterStaging(marker)
+	}()
+
+	digests, upload, err := t.copyDirectory(ctx, src, staging)
+	if err != nil {
+		return "", upload, err
+	}
+
+	// A resumed staging dir may hold files from an attempt that produced different output
+	if err := t.pruneOutput(ctx, staging, digests); err != nil {
+		return "", upload, fmt.Errorf("failed to prune staging dir: %w", err)
+	}
+
+	manifestHash, err = t.writeChecksumManifest(ctx, staging, digests)
+	if err != nil {
+		return "", upload, fmt.Errorf("failed to write checksum manifest: %w", err)
+	}
+
+	if err := t.syncTree(ctx, renamer, staging); err != nil {
+		return "", upload, fmt.Errorf("failed to sync staging dir: %w", err)
+	}
+
+	if err := t.swapIntoPlace(ctx, renamer, root, staging, dst); err != nil {
+		return "", upload, err
+	}
+	if err := renamer.SyncDir(parent); err != nil {
+		return "", upload, fmt.Errorf("failed to sync destination parent: %w", err)
+	}
+
+	log.Printf("Committed %s (manifest sha256 %s)", dst, manifestHash)
+	return manifestHash, upload, nil
+}
+
+// commitInPlace publishes src at dst on backends without directory renames,
+// such as object stores. Each file is replaced atomically on its own; media is
+// uploaded before playlists so a playlist never references a missing segment,
+// and files left over from a previous output are removed afterwards.
+// Overwriting an existing output is therefore not atomic as a whole.
+func (t *FFmpegTranscoder) commitInPlace(ctx context.Context, src, dst string) (string, models.UploadMetrics, error) {
+	digests, upload, err := t.copyDirectory(ctx, src, dst)
+	if err != nil {
+		return "", upload, err
+	}
+
+	if err := t.pruneOutput(ctx, dst, digests); err != nil {
+		return "", upload, fmt.Errorf("failed to remove stale output files: %w", err)
+	}
+
+	manifestHash, err := t.writeChecksumManifest(ctx, dst, digests)
+	if err != nil {
+		return "", upload, fmt.Errorf("failed to write checksum manifest: %w", err)
+	}
+
+	log.Printf("Committed %s to %s (manifest sha256 %s)", dst, t.store.Name(), manifestHash)
+	return manifestHash, upload, nil
+}
+
+// writeChecksumManifest writes the digests in sha256sum format, sorted by path,
+// and returns the SHA-256 of the manifest itself
+func (t *FFmpegTranscoder) writeChecksumManifest(ctx context.Context, dir string, digests map[string]string) (string, error) {
+	paths := make([]string, 0, len(digests))
+	for path := range digests {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var manifest bytes.Buffer
+	for _, path := range paths {
+		fmt.Fprintf(&manifest, "%s  %s\n", digests[path], path)
+	}
+
+	return t.writeStored(ctx, t.store.Join(dir, checksumManifestName), manifest.Bytes())
+}
+
+// pruneOutput removes files in dir that are not part of the copied set
+func (t *FFmpegTranscoder) pruneOutput(ctx context.Context, dir string, digests map[string]string) error {
+	files, err := t.store.List(ctx, dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, file := range files {
+		if _, ok := digests[file.Path]; ok {
+			continue
+		}
+		log.Printf("Removing leftover output file: %s", file.Path)
+		if err := t.store.Remove(ctx, t.store.Join(dir, file.Path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapIntoPlace renames staging to dst. An existing output is exchanged with
+// the new one in a single step where the filesystem can, so dst always holds
+// one of them. Elsewhere, NFS included, it is moved aside into root first and
+// dst is missing until the second rename; should the worker die in between,
+// the next startup moves the previous output back. Once the new output is in
+// place, only the files the previous commit wrote are removed.
+func (t *FFmpegTranscoder) swapIntoPlace(ctx context.Context, renamer storage.Renamer, root, staging, dst string) error {
+	info, err := t.store.Stat(ctx, dst)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return renameDir(ctx, renamer, staging, dst)
+	case err != nil:
+		return fmt.Errorf("failed to stat destination: %w", err)
+	case !info.IsDir:
+		return fmt.Errorf("destination %s exists and is not a directory", dst)
+	}
+
+	// An empty dir (e.g. created up front by the worker) is simply replaced
+	if err := t.store.Remove(ctx, dst); err == nil {
+		return renameDir(ctx, renamer, staging, dst)
+	}
+
+	previous := filepath.Join(root, fmt.Sprintf(".%s.old-%d", stagingName(dst), time.Now().UnixNano()))
+	marker, err := t.registerStaging(previous, "", dst)
+	if err != nil {
+		return err
+	}
+	defer t.unregisterStaging(marker)
+
+	exchanged, err := t.exchangeDirs(ctx, renamer, staging, previous, dst)
+	if err != nil {
+		return err
+	}
+	if exchanged {
+		if err := t.removePrevious(ctx, renamer, previous, dst); err != nil {
+			log.Printf("Failed to remove previous output %s: %v", previous, err)
+		}
+		return nil
+	}
+
+	if err := renameDir(ctx, renamer, dst, previous); err != nil {
+		return err
+	}
+	if err := renameDir(ctx, renamer, staging, dst); err != nil {
+		// Put the previous output back rather than leave nothing at dst
+		if rollbackErr := renamer.Rename(ctx, previous, dst); rollbackErr != nil {
+			log.Printf("Failed to restore previous output %s: %v", dst, rollbackErr)
+		}
+		return err
+	}
+
+	if err := t.removePrevious(ctx, renamer, previous, dst); err != nil {
+		log.Printf("Failed to remove previous output %s: %v", previous, err)
+	}
+	return nil
+}
+
+// exchangeDirs publishes staging at dst in one step, leaving the previous
+// output at previous. The staging dir is renamed to previous first, so a crash
+// at any point leaves only complete outputs behind: the marker of previous
+// removes whichever one isn't at dst. It reports false, with staging as it
+// was, if the backend or filesystem can't exchange directories.
+func (t *FFmpegTranscoder) exchangeDirs(ctx context.Context, renamer storage.Renamer, staging, previous, dst string) (bool, error) {
+	exchanger, ok := renamer.(storage.Exchanger)
+	if !ok {
+		return false, nil
+	}
+
+	if err := renameDir(ctx, renamer, staging, previous); err != nil {
+		return false, err
+	}
+	err := exchanger.Exchange(ctx, previous, dst)
+	if err == nil {
+		return true, nil
+	}
+
+	if rollbackErr := renameDir(ctx, renamer, previous, staging); rollbackErr != nil {
+		return false, rollbackErr
+	}
+	if errors.Is(err, errors.ErrUnsupported) {
+		return false, nil
+	}
+	return false, err
+}
+
+// removePrevious deletes an output that swapIntoPlace moved aside. Only the
+// files listed in its checksum manifest, which its commit wrote, are deleted.
+// Any other file is moved back to restore if that is set and the new output
+// has no file of the same name, or else left where it is.
+func (t *FFmpegTranscoder) removePrevious(ctx context.Context, renamer storage.Renamer, previous, restore string) error {
+	written, err := t.readChecksumManifest(ctx, previous)
+	if err != nil {
+		return fmt.Errorf("failed to read checksum manifest: %w", err)
+	}
+	written[checksumManifestName] = true
+
+	files, err := t.store.List(ctx, previous)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	kept := 0
+	for _, file := range files {
+		path := filepath.Join(previous, filepath.FromSlash(file.Path))
+		if written[file.Path] {
+			if err := t.store.Remove(ctx, path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if restore != "" {
+			target := filepath.Join(restore, filepath.FromSlash(file.Path))
+			if _, err := t.store.Stat(ctx, target); errors.Is(err, fs.ErrNotExist) {
+				if err := t.store.MkdirAll(ctx, filepath.Dir(target)); err != nil {
+					return err
+				}
+				if err := renamer.Rename(ctx, path, target); err != nil {
+					return fmt.Errorf("failed to restore %s: %w", target, err)
+				}
+				log.Printf("Kept %s, it wasn't written by the previous commit", target)
+				continue
+			}
+		}
+		kept++
+	}
+
+	if kept > 0 {
+		log.Printf("Left %d files not written by a commit in %s", kept, previous)
+		return nil
+	}
+	// Only the emptied dirs are left
+	return t.store.RemoveAll(ctx, previous)
+}
+
+// readChecksumManifest returns the set of files listed in the checksum manifest
+// of dir, which is empty if there is none
+func (t *FFmpegTranscoder) readChecksumManifest(ctx context.Context, dir string) (map[string]bool, error) {
+	listed := make(map[string]bool)
+
+	reader, err := t.store.Open(ctx, t.store.Join(dir, checksumManifestName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return listed, nil
+		}
+		return nil, err
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		// sha256sum format: digest, two spaces, path
+		if _, path, ok := strings.Cut(scanner.Text(), "  "); ok && path != "" {
+			listed[path] = true
+		}
+	}
+	return listed, scanner.Err()
+}
+
+// stagingName identifies dst in the names of its staging dirs. Those live in
+// the output root, so the base name alone could be shared by several outputs.
+func stagingName(dst string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(dst)))
+	return filepath.Base(dst) + "-" + hex.EncodeToString(sum[:4])
+}
+
+// CleanupStaleStaging removes staging dirs left on the NAS by a worker that
+// crashed mid-commit. Staging dirs of jobs that still have a checkpoint are kept
+// so a reassignment can resume the upload. Call it once on startup, before any
+// job runs.
+func (t *FFmpegTranscoder) CleanupStaleStaging() (int, error) {
+	return t.removeStaging(func(jobID string) bool {
+		// Resumable jobs keep their partially uploaded staging dir
+		if jobID == "" {
+			return true
+		}
+		_, err := os.Stat(filepath.Join(t.tempDir, jobID, checkpointFileName))
+		return err != nil
+	})
+}
+
+// CleanupJobTemp removes the temp dir of a job the worker was running when it
+// died, unless a checkpoint in it lets the job resume if it is assigned here
+// again. Staging dirs on the NAS are left alone: the job may have been
+// reassigned to another worker since, which would be using them now.
+func (t *FFmpegTranscoder) CleanupJobTemp(jobID string) (resumable bool, err error) {
+	jobTempDir := filepath.Join(t.tempDir, jobID)
+	if _, err := os.Stat(filepath.Join(jobTempDir, checkpointFileName)); err == nil {
+		return true, nil
+	}
+	if err := os.RemoveAll(jobTempDir); err != nil {
+		return false, fmt.Errorf("failed to remove job temp dir: %w", err)
+	}
+	return false, nil
+}
+
+// DiscardJob removes what an interrupted job kept for a resume: its temp dir,
+// the staging dirs of a commit in progress, and what was streamed of renditions
+// that didn't finish, so players aren't left with a playlist that never ends.
+// Renditions already committed stay at their destination.
+func (t *FFmpegTranscoder) DiscardJob(job *models.JobSpec) error {
+	jobTempDir := filepath.Join(t.tempDir, job.JobID)
+	if err := t.discardStreamed(job, jobTempDir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(jobTempDir); err != nil {
+		return fmt.Errorf("failed to remove job temp dir: %w", err)
+	}
+	if _, err := t.removeStaging(func(owner string) bool { return owner == job.JobID }); err != nil {
+		return err
+	}
+	return nil
+}
+
+// discardStreamed removes the streamed output of every rendition the job's
+// checkpoint shows was streaming but not committed. The segments are those
+// listed in the local playlist, which holds every segment that was published.
+func (t *FFmpegTranscoder) discardStreamed(job *models.JobSpec, jobTempDir string) error {
+	cp, err := readCheckpoint(jobTempDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	ctx := context.Background()
+	for _, output := range job.Outputs {
+		key := renditionKey(output)
+		state, ok := cp.Renditions[key]
+		dest := cp.Destinations[key]
+		if !ok || state.Commit != commitStreaming || state.Committed || dest == "" {
+			continue
+		}
+
+		playlist := t.playlistFile(job, output)
+		var segments []string
+		if local, err := parseMediaPlaylist(filepath.Join(jobTempDir, key, playlist)); err == nil {
+			for _, seg := range local.Segments {
+				segments = append(segments, seg.URI)
+			}
+		}
+
+		if err := t.removeStreamed(ctx, dest, playlist, segments); err != nil {
+			return fmt.Errorf("failed to remove streamed output %s: %w", dest, err)
+		}
+		log.Printf("Removed streamed output of unfinished rendition: %s", dest)
+	}
+	return nil
+}
+
+// removeStaging removes the registered staging dirs for which remove returns
+// true, given the job owning them ("" for none)
+func (t *FFmpegTranscoder) removeStaging(remove func(jobID string) bool) (int, error) {
+	ctx := context.Background()
+	registry := filepath.Join(t.stateDir, stagingRegistryName)
+
+	entries, err := os.ReadDir(registry)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read staging registry: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		marker := filepath.Join(registry, entry.Name())
+
+		data, err := os.ReadFile(marker)
+		if err != nil {
+			return removed, fmt.Errorf("failed to read staging marker: %w", err)
+		}
+
+		// Path, owning job and, for previous outputs, the destination they were moved from
+		fields := strings.SplitN(strings.TrimSpace(string(data)), "\n", 3)
+		path, jobID, dst := fields[0], "", ""
+		if len(fields) > 1 {
+			jobID = fields[1]
+		}
+		if len(fields) > 2 {
+			dst = fields[2]
+		}
+		if !remove(jobID) {
+			continue
+		}
+
+		// Only ever delete dirs that carry our staging naming. A previous output
+		// moved aside may hold files no commit wrote, which are kept.
+		name := filepath.Base(path)
+		switch {
+		case !strings.HasPrefix(name, "."):
+		case strings.Contains(name, ".staging-"):
+			if err := t.store.RemoveAll(ctx, path); err != nil {
+				return removed, fmt.Errorf("failed to remove stale staging dir %s: %w", path, err)
+			}
+			log.Printf("Removed stale staging dir: %s", path)
+			removed++
+		case strings.Contains(name, ".old-"):
+			renamer, ok := t.store.(storage.Renamer)
+			if !ok {
+				break
+			}
+			// The worker died between moving the previous output aside and
+			// renaming the new one into place
+			if restored, err := t.restorePrevious(ctx, renamer, path, dst); err != nil {
+				return removed, err
+			} else if restored {
+				break
+			}
+			if err := t.removePrevious(ctx, renamer, path, dst); err != nil {
+				return removed, fmt.Errorf("failed to remove stale previous output %s: %w", path, err)
+			}
+			log.Printf("Removed stale previous output: %s", path)
+			removed++
+		}
+
+		if err := os.Remove(marker); err != nil {
+			return removed, fmt.Errorf("failed to remove staging marker: %w", err)
+		}
+	}
+
+	return removed, nil
+}
+
+// restorePrevious moves a previous output back to dst if nothing took its place
+func (t *FFmpegTranscoder) restorePrevious(ctx context.Context, renamer storage.Renamer, previous, dst string) (bool, error) {
+	if dst == "" {
+		return false, nil
+	}
+	if _, err := t.store.Stat(ctx, dst); !errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if _, err := t.store.Stat(ctx, previous); err != nil {
+		return false, nil
+	}
+	if err := renameDir(ctx, renamer, previous, dst); err != nil {
+		return false, fmt.Errorf("failed to restore previous output: %w", err)
+	}
+	log.Printf("Restored previous output left aside by an interrupted commit: %s", dst)
+	return true, nil
+}
+
+// registerStaging records a staging dir, the job owning it if any, and for a
+// previous output moved aside the destination it came from, before it is created
+func (t *FFmpegTranscoder) registerStaging(path, jobID, dst string) (string, error) {
+	registry := filepath.Join(t.stateDir, stagingRegistryName)
+	if err := os.MkdirAll(registry, 0755); err != nil {
+		return "", fmt.Errorf("failed to create staging registry: %w", err)
+	}
+
+	sum := sha256.Sum256([]byte(path))
+	marker := filepath.Join(registry, hex.EncodeToString(sum[:16]))
+
+	file, err := os.Create(marker)
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging marker: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(path + "\n" + jobID + "\n" + dst); err != nil {
+		return "", fmt.Errorf("failed to write staging marker: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return "", fmt.Errorf("failed to sync staging marker: %w", err)
+	}
+
+	return marker, nil
+}
+
+// unregisterStaging drops the marker once its staging dir is gone
+func (t *FFmpegTranscoder) unregisterStaging(marker string) {
+	if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove staging marker %s: %v", marker, err)
+	}
+}
+
+// renameDir renames a directory, wrapping the error with both paths
+func renameDir(ctx context.Context, renamer storage.Renamer, from, to string) error {
+	if err := renamer.Rename(ctx, from, to); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", from, to, err)
+	}
+	return nil
+}
+
+// syncTree fsyncs root and every directory holding a file below it
+func (t *FFmpegTranscoder) syncTree(ctx context.Context, renamer storage.Renamer, root string) error {
+	files, err := t.store.List(ctx, root)
+	if err != nil {
+		return err
+	}
+
+	dirs := map[string]bool{root: true}
+	for _, file := range files {
+		dirs[filepath.Dir(filepath.Join(root, filepath.FromSlash(file.Path)))] = true
+	}
+	for dir := range dirs {
+		if err := renamer.SyncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
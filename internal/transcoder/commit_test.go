@@ -0,0 +1,215 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"transcode-worker/internal/config"
+	"transcode-worker/internal/storage"
+)
+
+// newTestTranscoder returns a transcoder committing to a temp NAS dir, which is
+// also the only allowed output root
+func newTestTranscoder(t *testing.T) (*FFmpegTranscoder, string) {
+	t.Helper()
+	nas := t.TempDir()
+	cfg := &config.Config{TempDir: t.TempDir(), StateDir: t.TempDir(), NasMountPath: nas}
+	cfg.Storage.Backend = "filesystem"
+	cfg.Paths.AllowedOutputRoots = []string{nas}
+	cfg.Upload.Workers = 2
+	return NewTranscoder(cfg, storage.NewFilesystem(nas)), nas
+}
+
+// renameOnly is a filesystem backend that can't exchange directories, as on NFS
+type renameOnly struct {
+	*storage.Filesystem
+}
+
+func (renameOnly) Exchange(ctx context.Context, a, b string) error {
+	return errors.ErrUnsupported
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listFiles returns the slash-separated paths of the files below dir
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestCommitDirectory(t *testing.T) {
+	tr, nas := newTestTranscoder(t)
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"playlist.m3u8":  "#EXTM3U\n",
+		"segment_000.ts": "a",
+		"sub/extra.vtt":  "WEBVTT\n",
+	})
+
+	dst := filepath.Join(nas, "movie", "720p")
+	hash, _, err := tr.commitDirectory(context.Background(), "job-1", src, dst)
+	if err != nil {
+		t.Fatalf("commitDirectory: %v", err)
+	}
+	if hash == "" {
+		t.Error("no manifest hash returned")
+	}
+
+	want := []string{checksumManifestName, "playlist.m3u8", "segment_000.ts", "sub/extra.vtt"}
+	if got := listFiles(t, dst); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("committed files = %v, want %v", got, want)
+	}
+
+	// Nothing but the output itself is left in the root
+	entries, err := os.ReadDir(nas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "movie" {
+		t.Errorf("root holds %v, want only movie", entries)
+	}
+}
+
+func TestCommitDirectoryReplaceKeepsForeignFiles(t *testing.T) {
+	t.Run("exchange", func(t *testing.T) {
+		tr, nas := newTestTranscoder(t)
+		testReplaceKeepsForeignFiles(t, tr, nas)
+	})
+	t.Run("rename", func(t *testing.T) {
+		tr, nas := newTestTranscoder(t)
+		tr.store = renameOnly{storage.NewFilesystem(nas)}
+		testReplaceKeepsForeignFiles(t, tr, nas)
+	})
+}
+
+func testReplaceKeepsForeignFiles(t *testing.T, tr *FFmpegTranscoder, nas string) {
+	ctx := context.Background()
+	dst := filepath.Join(nas, "movie", "720p")
+
+	first := t.TempDir()
+	writeFiles(t, first, map[string]string{"playlist.m3u8": "old", "segment_000.ts": "old", "segment_001.ts": "old"})
+	if _, _, err := tr.commitDirectory(ctx, "job-1", first, dst); err != nil {
+		t.Fatalf("first commit: %v", err)
+	}
+
+	// Dropped into the output by someone else
+	writeFiles(t, dst, map[string]string{"notes.txt": "keep me", "thumbs/poster.jpg": "keep me too"})
+
+	second := t.TempDir()
+	writeFiles(t, second, map[string]string{"playlist.m3u8": "new", "segment_000.ts": "new"})
+	if _, _, err := tr.commitDirectory(ctx, "job-2", second, dst); err != nil {
+		t.Fatalf("second commit: %v", err)
+	}
+
+	want := []string{checksumManifestName, "notes.txt", "playlist.m3u8", "segment_000.ts", "thumbs/poster.jpg"}
+	if got := listFiles(t, dst); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("files after replace = %v, want %v", got, want)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "segment_000.ts")); string(data) != "new" {
+		t.Errorf("segment_000.ts = %q, want the new output", data)
+	}
+
+	// The previous output was emptied and removed
+	entries, err := os.ReadDir(nas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("left %s in the root", entry.Name())
+		}
+	}
+}
+
+func TestCommitDirectoryRefusesRoot(t *testing.T) {
+	tr, nas := newTestTranscoder(t)
+	writeFiles(t, nas, map[string]string{"other/playlist.m3u8": "untouched"})
+
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"playlist.m3u8": "new"})
+
+	_, _, err := tr.commitDirectory(context.Background(), "job-1", src, nas)
+	if !errors.Is(err, storage.ErrPathIsRoot) {
+		t.Fatalf("commitDirectory to the root = %v, want ErrPathIsRoot", err)
+	}
+	if got := listFiles(t, nas); len(got) != 1 || got[0] != "other/playlist.m3u8" {
+		t.Errorf("root holds %v after a refused commit", got)
+	}
+}
+
+func TestCleanupStaleStagingAfterReboot(t *testing.T) {
+	tr, nas := newTestTranscoder(t)
+	ctx := context.Background()
+	dst := filepath.Join(nas, "movie", "720p")
+
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"playlist.m3u8": "old", "segment_000.ts": "old"})
+	if _, _, err := tr.commitDirectory(ctx, "job-1", src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// A worker died between moving the output aside and renaming the new one
+	// into place, while another job's upload was staged
+	previous := filepath.Join(nas, "."+stagingName(dst)+".old-1")
+	if _, err := tr.registerStaging(previous, "", dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(dst, previous); err != nil {
+		t.Fatal(err)
+	}
+	staging := filepath.Join(nas, "."+stagingName(dst)+".staging-job-2")
+	if _, err := tr.registerStaging(staging, "job-2", ""); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, staging, map[string]string{"segment_000.ts": "partial"})
+
+	// The reboot cleared the temp dir, checkpoints included
+	tr.tempDir = t.TempDir()
+	removed, err := tr.CleanupStaleStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d staging dirs, want 1", removed)
+	}
+
+	want := []string{checksumManifestName, "playlist.m3u8", "segment_000.ts"}
+	if got := listFiles(t, dst); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("destination after cleanup = %v, want the previous output %v", got, want)
+	}
+	if got := listFiles(t, nas); len(got) != len(want) {
+		t.Errorf("root holds %v after cleanup", got)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(tr.stateDir, stagingRegistryName)); len(entries) != 0 {
+		t.Errorf("%d staging markers left", len(entries))
+	}
+}
@@ -0,0 +1,161 @@
+package transcoder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+
+	"transcode-worker/pkg/models"
+)
+
+// byteCounter is an io.Writer that only counts what is written to it
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// analyzeComplexity probe-encodes sampled scenes of the source at low resolution
+// with a fixed CRF. Hard content (grain, motion) needs more bits at the same CRF,
+// so the average probe bitrate relative to the reference is the complexity score.
+func (t *FFmpegTranscoder) analyzeComplexity(ctx context.Context, job *models.JobSpec, duration float64, outputs []models.OutputSpec) (*models.ComplexityReport, error) {
+	referenceBps, err := models.ParseBitrate(t.complexity.ReferenceBitrate)
+	if err != nil {
+		return nil, err
+	}
+
+	sampleDuration := t.complexity.SampleDuration.Seconds()
+	samples := t.complexity.Samples
+	if duration <= sampleDuration*float64(samples) {
+		// Short source, a single pass over all of it is just as cheap
+		samples = 1
+		sampleDuration = duration
+	}
+
+	var totalBytes int64
+	var totalSeconds float64
+	for i := 0; i < samples; i++ {
+		start := 0.0
+		if samples > 1 {
+			// Spread samples evenly, centred in each slice of the source
+			slice := duration / float64(samples)
+			start = slice*float64(i) + (slice-sampleDuration)/2
+		}
+
+		size, err := t.probeEncode(ctx, job.GetInputSource(), start, sampleDuration)
+		if err != nil {
+			return nil, fmt.Errorf("probe encode at %.2fs failed: %w", start, err)
+		}
+
+		totalBytes += size
+		totalSeconds += sampleDuration
+	}
+
+	if totalSeconds <= 0 || totalBytes == 0 {
+		return nil, fmt.Errorf("probe encodes produced no output")
+	}
+
+	probeBps := float64(totalBytes*8) / totalSeconds
+	score := probeBps / float64(referenceBps)
+
+	scale := score
+	if scale < t.complexity.MinScale {
+		scale = t.complexity.MinScale
+	}
+	if scale > t.complexity.MaxScale {
+		scale = t.complexity.MaxScale
+	}
+
+	report := &models.ComplexityReport{
+		Score: score,
+		Scale: scale,
+	}
+
+	for _, output := range outputs {
+		adjusted := models.AdjustedRendition{
+			Resolution:       output.Resolution,
+			RequestedBitrate: output.Bitrate,
+			Bitrate:          output.Bitrate,
+		}
+
+		if requested, err := models.ParseBitrate(output.Bitrate); err == nil {
+			adjusted.Bitrate = models.FormatBitrate(int64(float64(requested) * scale))
+		} else {
+			log.Printf("Keeping bitrate %q for %s unchanged: %v", output.Bitrate, output.Resolution, err)
+		}
+
+		report.Ladder = append(report.Ladder, adjusted)
+	}
+
+	log.Printf("Complexity analysis: probe %.0f kbps, score %.2f, bitrate scale %.2f",
+		probeBps/1000, score, scale)
+
+	return report, nil
+}
+
+// probeEncode encodes a short piece of the source with a fixed CRF and returns
+// the size of the raw video bitstream in bytes
+func (t *FFmpegTranscoder) probeEncode(ctx context.Context, inputPath string, start, length float64) (int64, error) {
+	args := []string{
+		"-hide_banner", "-nostats", "-v", "error",
+		"-ss", fmt.Sprintf("%.3f", start),
+	}
+	args = append(args, inputArgs(inputPath)...)
+	args = append(args,
+		"-t", fmt.Sprintf("%.3f", length),
+		"-map", "0:v:0",
+		"-an", "-sn",
+		"-vf", fmt.Sprintf("scale=-2:%d", t.complexity.ProbeHeight),
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", strconv.Itoa(t.complexity.ProbeCRF),
+		"-f", "h264", "-",
+	)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	var counter byteCounter
+	if _, err := io.Copy(&counter, stdout); err != nil {
+		cmd.Wait()
+		return 0, fmt.Errorf("failed to read probe output: %w", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return 0, fmt.Errorf("ffmpeg failed: %w", err)
+	}
+
+	return counter.n, nil
+}
+
+// applyComplexity returns a copy of outputs with bitrates taken from the adjusted ladder
+func applyComplexity(outputs []models.OutputSpec, report *models.ComplexityReport) []models.OutputSpec {
+	adjusted := make([]models.OutputSpec, len(outputs))
+	copy(adjusted, outputs)
+
+	if report == nil {
+		return adjusted
+	}
+
+	for i := range adjusted {
+		if i < len(report.Ladder) {
+			adjusted[i].Bitrate = report.Ladder[i].Bitrate
+		}
+	}
+
+	return adjusted
+}
@@ -0,0 +1,260 @@
+package transcoder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"transcode-worker/internal/storage"
+)
+
+// inputDirName is the dir in the job temp dir holding a downloaded input
+const inputDirName = "input"
+
+// errInputTooLarge is returned when a download grows past the size limit
+var errInputTooLarge = errors.New("input exceeds the size limit")
+
+// inputSource returns where the job input is read from: the http source for
+// http(s) URLs, the storage backend for everything else
+func (t *FFmpegTranscoder) inputSource(input string) storage.Source {
+	if storage.IsURL(input) {
+		return t.http
+	}
+	return t.store
+}
+
+// checkInputSize enforces the configured size limit on http(s) inputs
+func (t *FFmpegTranscoder) checkInputSize(source storage.FileInfo) error {
+	if !storage.IsURL(source.Path) || t.httpInput.MaxSizeMB == 0 {
+		return nil
+	}
+	if limit := t.httpInput.MaxSizeMB << 20; source.Size > limit {
+		return fmt.Errorf("input is %d bytes, above the %d MB limit", source.Size, t.httpInput.MaxSizeMB)
+	}
+	return nil
+}
+
+// inputArgs returns the ffmpeg arguments that open the job input. Streamed
+// http(s) inputs reconnect after a dropped connection instead of ending early.
+func inputArgs(input string) []string {
+	if storage.IsURL(input) {
+		return []string{
+			"-reconnect", "1",
+			"-reconnect_on_network_error", "1",
+			"-reconnect_delay_max", "30",
+			"-i", input,
+		}
+	}
+	return []string{"-i", input}
+}
+
+// localInput returns a path ffmpeg can read the input from, and a function to
+// call once the job no longer needs it. With the input cache enabled, inputs are
+// copied into it unless they are streamed. Otherwise inputs without a local path
+// are downloaded into the job temp dir; a resumed job reuses a download that
+// completed in an earlier attempt. expectedSHA256, if set, is verified on the
+// download, so URLs that carry one are never streamed.
+func (t *FFmpegTranscoder) localInput(ctx context.Context, src storage.Source, jobTempDir string, source storage.FileInfo, expectedSHA256 string) (string, func(), error) {
+	local, ok := src.LocalPath(source.Path)
+	streamed := ok && storage.IsURL(source.Path) && expectedSHA256 == ""
+
+	if t.cache != nil && !streamed {
+		reason := t.cache.skipReason(source)
+		if reason == "" {
+			return t.cachedInput(ctx, src, source, expectedSHA256)
+		}
+		log.Printf("Not caching input %s: %s", source.Path, reason)
+	}
+
+	if ok && (expectedSHA256 == "" || !storage.IsURL(source.Path)) {
+		return local, func() {}, nil
+	}
+
+	dir := filepath.Join(jobTempDir, inputDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create input dir: %w", err)
+	}
+
+	local = filepath.Join(dir, "source"+inputExt(source.Path))
+	if info, err := os.Stat(local); err == nil && info.Size() == source.Size {
+		log.Printf("Reusing downloaded input: %s", local)
+		return local, func() {}, nil
+	}
+
+	log.Printf("Downloading input %s (%d bytes)", source.Path, source.Size)
+
+	if err := t.download(ctx, src, source, local, expectedSHA256); err != nil {
+		return "", nil, err
+	}
+
+	return local, func() {}, nil
+}
+
+// download copies a source to a local file. The data goes to a .part file that
+// is only renamed into place once complete and verified. Sources that support
+// ranges resume an interrupted transfer, including a .part file left by an
+// earlier attempt, instead of starting over.
+func (t *FFmpegTranscoder) download(ctx context.Context, src storage.Source, source storage.FileInfo, local, expectedSHA256 string) error {
+	partPath := local + ".part"
+	ranged, canResume := src.(storage.RangeSource)
+
+	out, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create local input: %w", err)
+	}
+	defer out.Close()
+
+	start := time.Now()
+	hasher := sha256.New()
+	var offset int64
+	if canResume {
+		if offset, err = io.Copy(hasher, out); err != nil {
+			return fmt.Errorf("failed to read partial input: %w", err)
+		}
+		if source.Size >= 0 && offset > source.Size {
+			offset = 0
+		}
+	}
+	if offset == 0 {
+		if err := restartFetch(out, hasher); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Resuming input download at %d bytes", offset)
+	}
+
+	limit := int64(-1)
+	if storage.IsURL(source.Path) && t.httpInput.MaxSizeMB > 0 {
+		limit = t.httpInput.MaxSizeMB << 20
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := t.fetchInput(ctx, src, ranged, source, limit, out, hasher, &offset)
+		if err == nil && source.Size >= 0 && offset != source.Size {
+			err = fmt.Errorf("got %d of %d bytes", offset, source.Size)
+		}
+		if err == nil {
+			break
+		}
+
+		if errors.Is(err, errInputTooLarge) {
+			out.Close()
+			os.Remove(partPath)
+			return err
+		}
+		// Missing sources won't appear by retrying
+		if ctx.Err() != nil || !canResume || errors.Is(err, fs.ErrNotExist) || attempt >= t.httpInput.Retries {
+			return fmt.Errorf("failed to download input: %w", err)
+		}
+
+		backoff := time.Duration(1<<attempt) * time.Second
+		log.Printf("Input download interrupted at %d bytes, retrying in %s: %v", offset, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if expectedSHA256 != "" {
+		if digest := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(digest, expectedSHA256) {
+			out.Close()
+			os.Remove(partPath)
+			return fmt.Errorf("input checksum mismatch: expected %s, got %s", expectedSHA256, digest)
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to sync local input: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write local input: %w", err)
+	}
+
+	if err := os.Rename(partPath, local); err != nil {
+		return err
+	}
+
+	log.Printf("Fetched input in %s", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// fetchInput appends the source from *offset on to out, advancing *offset by
+// what was written even when the transfer fails part way. If the source changed
+// since it was stat'ed, what was fetched before is dropped and it starts over.
+func (t *FFmpegTranscoder) fetchInput(
+	ctx context.Context,
+	src storage.Source,
+	ranged storage.RangeSource,
+	source storage.FileInfo,
+	limit int64,
+	out *os.File,
+	hasher hash.Hash,
+	offset *int64,
+) error {
+	var in io.ReadCloser
+	var err error
+	if *offset > 0 {
+		var start int64
+		in, start, err = ranged.OpenAt(ctx, source, *offset)
+		if err == nil && start == 0 {
+			log.Printf("Input %s changed or can't be resumed, fetching it from the start", source.Path)
+			if err = restartFetch(out, hasher); err != nil {
+				in.Close()
+				return err
+			}
+			*offset = 0
+		}
+	} else {
+		in, err = src.Open(ctx, source.Path)
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	if limit >= 0 {
+		// Read one byte past the limit to tell "exactly at" from "above" it
+		r = io.LimitReader(in, limit-*offset+1)
+	}
+
+	n, err := io.Copy(io.MultiWriter(out, hasher), r)
+	*offset += n
+	if limit >= 0 && *offset > limit {
+		return fmt.Errorf("%w of %d MB", errInputTooLarge, t.httpInput.MaxSizeMB)
+	}
+	return err
+}
+
+// restartFetch empties a partial download so it can be fetched again from the start
+func restartFetch(out *os.File, hasher hash.Hash) error {
+	hasher.Reset()
+	if err := out.Truncate(0); err != nil {
+		return fmt.Errorf("failed to reset partial input: %w", err)
+	}
+	_, err := out.Seek(0, io.SeekStart)
+	return err
+}
+
+// inputExt returns the file extension of a source path or URL, ignoring any query string
+func inputExt(source string) string {
+	if storage.IsURL(source) {
+		if u, err := url.Parse(source); err == nil {
+			return path.Ext(u.Path)
+		}
+	}
+	return path.Ext(source)
+}
@@ -0,0 +1,42 @@
+package transcoder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"transcode-worker/internal/storage"
+)
+
+func TestDownloadRestartsWhenSourceChanged(t *testing.T) {
+	content := strings.Repeat("new source ", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "movie.mp4", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	tr, _ := newTestTranscoder(t)
+	local := filepath.Join(t.TempDir(), "source.mp4")
+
+	// The source was replaced after it was stat'ed and its start fetched
+	if err := os.WriteFile(local+".part", []byte("old source "), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := storage.FileInfo{Path: server.URL + "/movie.mp4", Size: int64(len(content)), ETag: `"v1"`}
+	sum := sha256.Sum256([]byte(content))
+
+	if err := tr.download(context.Background(), tr.http, source, local, hex.EncodeToString(sum[:])); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if got, _ := os.ReadFile(local); string(got) != content {
+		t.Errorf("downloaded %d bytes mixing both versions, want the new source", len(got))
+	}
+}
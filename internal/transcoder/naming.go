@@ -0,0 +1,58 @@
+package transcoder
+
+import (
+	"strings"
+
+	"transcode-worker/pkg/models"
+)
+
+// renderName fills in an output name template. Values come from the job, so
+// path separators in them are replaced and they can't add dirs or climb out of
+// one. The templates themselves were validated by config.Load.
+func renderName(template string, job *models.JobSpec, output models.OutputSpec) string {
+	values := map[string]string{
+		"job_id":     job.JobID,
+		"movie_id":   job.MovieID,
+		"resolution": output.Resolution,
+		"bitrate":    output.Bitrate,
+		"codec":      output.Codec,
+	}
+
+	pairs := []string{"{number}", "%03d"} // ffmpeg's segment sequence number
+	for name, value := range values {
+		value = strings.NewReplacer("/", "_", "\\", "_", "%", "_").Replace(value)
+		if value == "" || value == "." || value == ".." {
+			value = "_"
+		}
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// playlistFile returns the media playlist name of a rendition
+func (t *FFmpegTranscoder) playlistFile(job *models.JobSpec, output models.OutputSpec) string {
+	return renderName(t.naming.PlaylistTemplate, job, output)
+}
+
+// segmentPattern returns the ffmpeg segment file pattern of a rendition
+func (t *FFmpegTranscoder) segmentPattern(job *models.JobSpec, output models.OutputSpec) string {
+	return renderName(t.naming.SegmentTemplate, job, output)
+}
+
+// destinationRoot returns the dir a rendition committed to dest belongs in:
+// dest itself, which may be versioned, or its dest_path when it has a
+// rendition dir, which is what gets versioned then
+func (t *FFmpegTranscoder) destinationRoot(job *models.JobSpec, output models.OutputSpec, dest string) string {
+	if t.renditionSubdir(job, output) == "" {
+		return dest
+	}
+	return output.DestPath
+}
+
+// renditionSubdir returns the dir below dest_path a rendition is committed to, "" for dest_path itself
+func (t *FFmpegTranscoder) renditionSubdir(job *models.JobSpec, output models.OutputSpec) string {
+	if t.naming.RenditionDir == "" {
+		return ""
+	}
+	return renderName(t.naming.RenditionDir, job, output)
+}
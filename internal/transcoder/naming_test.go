@@ -0,0 +1,64 @@
+package transcoder
+
+import (
+	"testing"
+
+	"transcode-worker/pkg/models"
+)
+
+func TestRenderName(t *testing.T) {
+	job := &models.JobSpec{JobID: "job-42", MovieID: "movie-7"}
+	output := models.OutputSpec{Resolution: "720p", Bitrate: "2500k", Codec: "libx264"}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"index.m3u8", "index.m3u8"},
+		{"segment_{number}.ts", "segment_%03d.ts"},
+		{"{movie_id}_{resolution}_{number}.ts", "movie-7_720p_%03d.ts"},
+		{"{job_id}/{codec}_{bitrate}", "job-42/libx264_2500k"},
+		{"{unknown}.m3u8", "{unknown}.m3u8"},
+	}
+	for _, tt := range tests {
+		if got := renderName(tt.template, job, output); got != tt.want {
+			t.Errorf("renderName(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestRenderNameSanitizesValues(t *testing.T) {
+	tests := []struct {
+		movieID string
+		want    string
+	}{
+		{"../../etc", ".._.._etc"},
+		{`a\b/c`, "a_b_c"},
+		{"100%", "100_"}, // Would be an ffmpeg pattern otherwise
+		{"..", "_"},
+		{".", "_"},
+		{"", "_"},
+	}
+	for _, tt := range tests {
+		job := &models.JobSpec{MovieID: tt.movieID}
+		if got := renderName("{movie_id}", job, models.OutputSpec{}); got != tt.want {
+			t.Errorf("renderName with movie_id %q = %q, want %q", tt.movieID, got, tt.want)
+		}
+	}
+}
+
+func TestDestinationRoot(t *testing.T) {
+	tr, _ := newTestTranscoder(t)
+	job := &models.JobSpec{JobID: "job-1"}
+	output := models.OutputSpec{Resolution: "720p", DestPath: "/nas/movie"}
+
+	// Without a rendition dir the destination is the root, versioned or not
+	if got := tr.destinationRoot(job, output, "/nas/movie-v2"); got != "/nas/movie-v2" {
+		t.Errorf("destinationRoot = %q, want /nas/movie-v2", got)
+	}
+
+	tr.naming.RenditionDir = "{resolution}"
+	if got := tr.destinationRoot(job, output, "/nas/movie/720p-v2"); got != "/nas/movie" {
+		t.Errorf("destinationRoot with rendition dir = %q, want /nas/movie", got)
+	}
+}
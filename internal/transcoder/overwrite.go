@@ -0,0 +1,111 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+
+	"transcode-worker/pkg/models"
+)
+
+// ErrOutputExists is returned when a job with the "fail" overwrite policy
+// targets a destination that already holds output
+var ErrOutputExists = errors.New("output already exists")
+
+// maxOutputVersions bounds the search for a free versioned destination
+const maxOutputVersions = 1000
+
+// planDestinations decides where each rendition is committed: its dest_path,
+// plus the configured rendition dir if any. The job's overwrite policy is
+// enforced here, before anything is fetched or encoded:
+//
+//   - "replace" commits over an existing output, atomically where the backend can rename dirs
+//   - "fail" fails the job if a destination already holds output
+//   - "version" commits to the first free "<dest>-v2", "<dest>-v3", ... instead
+//
+// The choice is kept in the checkpoint, so a resumed job keeps committing to
+// the same place even though its own earlier renditions now exist there.
+func (t *FFmpegTranscoder) planDestinations(ctx context.Context, job *models.JobSpec, cp *checkpoint) error {
+	if cp.Destinations != nil {
+		return nil
+	}
+
+	policy := job.GetOverwritePolicy()
+	switch policy {
+	case "replace", "fail", "version":
+	default:
+		return fmt.Errorf("unknown overwrite policy %q", policy)
+	}
+
+	destinations := make(map[string]string, len(job.Outputs))
+	taken := make(map[string]bool, len(job.Outputs))
+	for _, output := range job.Outputs {
+		dest := output.DestPath
+		if subdir := t.renditionSubdir(job, output); subdir != "" {
+			dest = t.store.Join(dest, subdir)
+		}
+
+		exists, err := t.outputExists(ctx, dest)
+		if err != nil {
+			return fmt.Errorf("failed to check destination %s: %w", dest, err)
+		}
+
+		if exists {
+			switch policy {
+			case "fail":
+				return fmt.Errorf("%w: %s", ErrOutputExists, dest)
+			case "version":
+				existing := dest
+				if dest, err = t.nextVersion(ctx, existing, taken); err != nil {
+					return err
+				}
+				log.Printf("Destination %s exists, committing to %s", existing, dest)
+			}
+		}
+
+		destinations[renditionKey(output)] = dest
+		taken[dest] = true
+	}
+
+	cp.Destinations = destinations
+	return cp.save()
+}
+
+// outputExists reports whether dest holds anything. An empty dir doesn't count,
+// it is replaced by the commit like a missing one.
+func (t *FFmpegTranscoder) outputExists(ctx context.Context, dest string) (bool, error) {
+	if info, err := t.store.Stat(ctx, dest); err == nil && !info.IsDir {
+		return true, nil
+	}
+
+	files, err := t.store.List(ctx, dest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(files) > 0, nil
+}
+
+// nextVersion returns the first "<dest>-vN" that holds no output and isn't
+// already planned for another rendition of the job
+func (t *FFmpegTranscoder) nextVersion(ctx context.Context, dest string, taken map[string]bool) (string, error) {
+	for version := 2; version <= maxOutputVersions; version++ {
+		candidate := fmt.Sprintf("%s-v%d", dest, version)
+		if taken[candidate] {
+			continue
+		}
+
+		exists, err := t.outputExists(ctx, candidate)
+		if err != nil {
+			return "", fmt.Errorf("failed to check destination %s: %w", candidate, err)
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free version of %s below v%d", dest, maxOutputVersions)
+}
@@ -0,0 +1,165 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"transcode-worker/pkg/models"
+)
+
+func newTestCheckpoint(t *testing.T) *checkpoint {
+	t.Helper()
+	return &checkpoint{
+		JobID:      "job-1",
+		Renditions: make(map[string]*renditionCheckpoint),
+		path:       filepath.Join(t.TempDir(), checkpointFileName),
+	}
+}
+
+func TestPlanDestinations(t *testing.T) {
+	outputs := []models.OutputSpec{
+		{Resolution: "1080p", Bitrate: "5000k"},
+		{Resolution: "720p", Bitrate: "2500k"},
+	}
+
+	tests := []struct {
+		policy   string
+		existing []string // Dest dirs holding output before the job
+		empty    []string // Dest dirs that exist but are empty
+		want     []string // Planned destination of each output
+		wantErr  error
+	}{
+		{
+			policy: "replace",
+			want:   []string{"a", "b"},
+		},
+		{
+			policy:   "replace",
+			existing: []string{"a"},
+			want:     []string{"a", "b"},
+		},
+		{
+			policy:   "fail",
+			existing: []string{"b"},
+			wantErr:  ErrOutputExists,
+		},
+		{
+			policy: "fail",
+			empty:  []string{"a", "b"},
+			want:   []string{"a", "b"},
+		},
+		{
+			policy:   "version",
+			existing: []string{"a", "a-v2"},
+			want:     []string{"a-v3", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		tr, nas := newTestTranscoder(t)
+		for _, dir := range tt.existing {
+			writeFiles(t, filepath.Join(nas, dir), map[string]string{"playlist.m3u8": "#EXTM3U\n"})
+		}
+		for _, dir := range tt.empty {
+			if err := os.MkdirAll(filepath.Join(nas, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		job := &models.JobSpec{JobID: "job-1", OverwritePolicy: tt.policy, Outputs: append([]models.OutputSpec(nil), outputs...)}
+		job.Outputs[0].DestPath = filepath.Join(nas, "a")
+		job.Outputs[1].DestPath = filepath.Join(nas, "b")
+
+		cp := newTestCheckpoint(t)
+		err := tr.planDestinations(context.Background(), job, cp)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s with %v: err = %v, want %v", tt.policy, tt.existing, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s with %v: %v", tt.policy, tt.existing, err)
+			continue
+		}
+
+		for i, output := range job.Outputs {
+			want := filepath.Join(nas, tt.want[i])
+			if got := cp.Destinations[renditionKey(output)]; got != want {
+				t.Errorf("%s with %v: %s planned at %s, want %s", tt.policy, tt.existing, output.Resolution, got, want)
+			}
+		}
+	}
+}
+
+func TestPlanDestinationsVersionsEachRendition(t *testing.T) {
+	tr, nas := newTestTranscoder(t)
+	tr.naming.RenditionDir = "{resolution}"
+	writeFiles(t, filepath.Join(nas, "movie", "720p"), map[string]string{"playlist.m3u8": "#EXTM3U\n"})
+
+	job := &models.JobSpec{
+		JobID:           "job-1",
+		OverwritePolicy: "version",
+		Outputs: []models.OutputSpec{
+			{Resolution: "1080p", Bitrate: "5000k", DestPath: filepath.Join(nas, "movie")},
+			{Resolution: "720p", Bitrate: "2500k", DestPath: filepath.Join(nas, "movie")},
+		},
+	}
+	cp := newTestCheckpoint(t)
+	if err := tr.planDestinations(context.Background(), job, cp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"1080p_5000k": filepath.Join(nas, "movie", "1080p"),
+		"720p_2500k":  filepath.Join(nas, "movie", "720p-v2"),
+	}
+	for key, dest := range want {
+		if got := cp.Destinations[key]; got != dest {
+			t.Errorf("%s planned at %s, want %s", key, got, dest)
+		}
+	}
+
+	// A resumed job keeps its plan even though the destinations exist by now
+	writeFiles(t, filepath.Join(nas, "movie", "1080p"), map[string]string{"playlist.m3u8": "#EXTM3U\n"})
+	if err := tr.planDestinations(context.Background(), job, cp); err != nil {
+		t.Fatal(err)
+	}
+	if got := cp.Destinations["1080p_5000k"]; got != want["1080p_5000k"] {
+		t.Errorf("resumed plan moved 1080p to %s", got)
+	}
+}
+
+func TestPlanDestinationsUnknownPolicy(t *testing.T) {
+	tr, _ := newTestTranscoder(t)
+	job := &models.JobSpec{JobID: "job-1", OverwritePolicy: "merge"}
+	if err := tr.planDestinations(context.Background(), job, newTestCheckpoint(t)); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestChooseStreaming(t *testing.T) {
+	tr, nas := newTestTranscoder(t)
+	tr.streaming = true
+	writeFiles(t, filepath.Join(nas, "taken"), map[string]string{"playlist.m3u8": "#EXTM3U\n"})
+
+	cp := newTestCheckpoint(t)
+	free := models.OutputSpec{Resolution: "720p", Bitrate: "2500k", DestPath: filepath.Join(nas, "free")}
+	taken := models.OutputSpec{Resolution: "1080p", Bitrate: "5000k", DestPath: filepath.Join(nas, "taken")}
+
+	if streaming, err := tr.chooseStreaming(context.Background(), cp, cp.rendition("free"), free, 60); err != nil || !streaming {
+		t.Errorf("empty destination: streaming = %v, err = %v, want streaming", streaming, err)
+	}
+	if streaming, err := tr.chooseStreaming(context.Background(), cp, cp.rendition("taken"), taken, 60); err != nil || streaming {
+		t.Errorf("destination with output: streaming = %v, err = %v, want staged", streaming, err)
+	}
+
+	// Published segments of its own don't turn a resumed rendition into a staged one
+	writeFiles(t, free.DestPath, map[string]string{"segment_000.ts": "a"})
+	if streaming, _ := tr.chooseStreaming(context.Background(), cp, cp.rendition("free"), free, 60); !streaming {
+		t.Error("resumed streaming rendition switched to staged")
+	}
+}
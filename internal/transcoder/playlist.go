@@ -0,0 +1,180 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mediaSegment is a single segment entry from an HLS media playlist.
+type mediaSegment struct {
+	URI      string
+	Duration float64
+}
+
+// mediaPlaylist is the subset of an HLS media playlist the worker cares about.
+type mediaPlaylist struct {
+	TargetDuration int
+	MediaSequence  int
+	PlaylistType   string
+	Segments       []mediaSegment
+	EndList        bool
+}
+
+// TotalDuration returns the sum of all segment durations in seconds.
+func (p *mediaPlaylist) TotalDuration() float64 {
+	var total float64
+	for _, seg := range p.Segments {
+		total += seg.Duration
+	}
+	return total
+}
+
+// parseMediaPlaylist reads an HLS media playlist from disk.
+// A playlist that was cut off mid-write (e.g. ffmpeg was killed) is parsed up to
+// the last complete segment entry rather than rejected.
+func parseMediaPlaylist(path string) (*mediaPlaylist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readMediaPlaylist(file)
+}
+
+// readMediaPlaylist parses an HLS media playlist from r
+func readMediaPlaylist(r io.Reader) (*mediaPlaylist, error) {
+	playlist := &mediaPlaylist{}
+	scanner := bufio.NewScanner(r)
+
+	sawHeader := false
+	pendingDuration := -1.0
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if !sawHeader {
+			if line != "#EXTM3U" {
+				return nil, fmt.Errorf("missing #EXTM3U header")
+			}
+			sawHeader = true
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimPrefix(line, "#EXTINF:")
+			if idx := strings.Index(value, ","); idx >= 0 {
+				value = value[:idx]
+			}
+			duration, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXTINF duration %q: %w", value, err)
+			}
+			pendingDuration = duration
+
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			playlist.TargetDuration, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"))
+
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			playlist.MediaSequence, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+
+		case strings.HasPrefix(line, "#EXT-X-PLAYLIST-TYPE:"):
+			playlist.PlaylistType = strings.TrimPrefix(line, "#EXT-X-PLAYLIST-TYPE:")
+
+		case line == "#EXT-X-ENDLIST":
+			playlist.EndList = true
+
+		case strings.HasPrefix(line, "#"):
+			// Other tags are not needed by the worker
+
+		default:
+			if pendingDuration < 0 {
+				return nil, fmt.Errorf("segment %q has no EXTINF", line)
+			}
+			playlist.Segments = append(playlist.Segments, mediaSegment{
+				URI:      line,
+				Duration: pendingDuration,
+			})
+			pendingDuration = -1
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read playlist: %w", err)
+	}
+	if !sawHeader {
+		return nil, fmt.Errorf("playlist is empty")
+	}
+
+	return playlist, nil
+}
+
+// Encode renders the playlist back into m3u8 text.
+func (p *mediaPlaylist) Encode() []byte {
+	var buf bytes.Buffer
+
+	targetDuration := p.TargetDuration
+	for _, seg := range p.Segments {
+		if d := int(math.Ceil(seg.Duration)); d > targetDuration {
+			targetDuration = d
+		}
+	}
+
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&buf, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprintf(&buf, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.MediaSequence)
+	if p.PlaylistType != "" {
+		fmt.Fprintf(&buf, "#EXT-X-PLAYLIST-TYPE:%s\n", p.PlaylistType)
+	}
+	for _, seg := range p.Segments {
+		fmt.Fprintf(&buf, "#EXTINF:%.6f,\n%s\n", seg.Duration, seg.URI)
+	}
+	if p.EndList {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	return buf.Bytes()
+}
+
+// writeMediaPlaylist atomically replaces the playlist at path
+func writeMediaPlaylist(path string, p *mediaPlaylist) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, p.Encode(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// finishPlaylist turns the EVENT playlist ffmpeg keeps while encoding into a VOD
+// playlist. It fails if ffmpeg didn't get to end the playlist.
+func finishPlaylist(path string) error {
+	playlist, err := parseMediaPlaylist(path)
+	if err != nil {
+		return err
+	}
+	if !playlist.EndList {
+		return fmt.Errorf("playlist %s has no #EXT-X-ENDLIST", path)
+	}
+	if playlist.PlaylistType == "VOD" {
+		return nil
+	}
+
+	playlist.PlaylistType = "VOD"
+	return writeMediaPlaylist(path, playlist)
+}
+
+// isPlaylist reports whether a file name is an HLS playlist
+func isPlaylist(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".m3u8")
+}
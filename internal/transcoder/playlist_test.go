@@ -0,0 +1,101 @@
+package transcoder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadMediaPlaylist(t *testing.T) {
+	input := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:4
+#EXT-X-PLAYLIST-TYPE:VOD
+
+#EXTINF:6.006000,
+segment_004.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:5.5,title
+segment_005.ts
+#EXT-X-ENDLIST
+`
+	playlist, err := readMediaPlaylist(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlist.TargetDuration != 6 || playlist.MediaSequence != 4 || playlist.PlaylistType != "VOD" || !playlist.EndList {
+		t.Errorf("header = %+v", playlist)
+	}
+	want := []mediaSegment{{"segment_004.ts", 6.006}, {"segment_005.ts", 5.5}}
+	if len(playlist.Segments) != len(want) {
+		t.Fatalf("segments = %+v, want %+v", playlist.Segments, want)
+	}
+	for i, seg := range want {
+		if playlist.Segments[i] != seg {
+			t.Errorf("segment %d = %+v, want %+v", i, playlist.Segments[i], seg)
+		}
+	}
+	if got := playlist.TotalDuration(); got != 11.506 {
+		t.Errorf("TotalDuration = %v, want 11.506", got)
+	}
+}
+
+func TestReadMediaPlaylistCutOff(t *testing.T) {
+	// ffmpeg was killed after starting the next entry
+	input := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nsegment_000.ts\n#EXTINF:6.0,\n"
+	playlist, err := readMediaPlaylist(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlist.Segments) != 1 || playlist.EndList {
+		t.Errorf("cut-off playlist = %+v, want one segment and no end", playlist)
+	}
+}
+
+func TestReadMediaPlaylistInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"segment_000.ts\n",
+		"#EXTM3U\nsegment_000.ts\n",
+		"#EXTM3U\n#EXTINF:six,\nsegment_000.ts\n",
+	}
+	for _, input := range tests {
+		if _, err := readMediaPlaylist(strings.NewReader(input)); err == nil {
+			t.Errorf("readMediaPlaylist(%q) accepted", input)
+		}
+	}
+}
+
+func TestMediaPlaylistEncodeRoundTrip(t *testing.T) {
+	original := &mediaPlaylist{
+		TargetDuration: 4,
+		MediaSequence:  2,
+		PlaylistType:   "EVENT",
+		Segments: []mediaSegment{
+			{URI: "segment_002.ts", Duration: 4},
+			{URI: "segment_003.ts", Duration: 6.25}, // Longer than the target
+		},
+		EndList: true,
+	}
+
+	encoded := string(original.Encode())
+	if !strings.Contains(encoded, "#EXT-X-TARGETDURATION:7\n") {
+		t.Errorf("target duration not raised to the longest segment:\n%s", encoded)
+	}
+
+	decoded, err := readMediaPlaylist(strings.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TargetDuration != 7 || decoded.MediaSequence != 2 || decoded.PlaylistType != "EVENT" || !decoded.EndList {
+		t.Errorf("decoded header = %+v", decoded)
+	}
+	if len(decoded.Segments) != 2 || decoded.Segments[0] != original.Segments[0] || decoded.Segments[1] != original.Segments[1] {
+		t.Errorf("decoded segments = %+v, want %+v", decoded.Segments, original.Segments)
+	}
+
+	open := &mediaPlaylist{Segments: original.Segments[:1]}
+	if encoded := string(open.Encode()); strings.Contains(encoded, "ENDLIST") || strings.Contains(encoded, "PLAYLIST-TYPE") {
+		t.Errorf("unfinished playlist encoded as:\n%s", encoded)
+	}
+}
@@ -0,0 +1,180 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"transcode-worker/pkg/models"
+)
+
+var (
+	psnrRegex = regexp.MustCompile(`PSNR .*average:(inf|[0-9.]+)`)
+	ssimRegex = regexp.MustCompile(`SSIM .*All:([0-9.]+)`)
+	vmafRegex = regexp.MustCompile(`VMAF score[:=]\s*([0-9.]+)`)
+)
+
+// hasVMAF reports whether the local ffmpeg build includes the libvmaf filter.
+// The answer is cached since the ffmpeg binary doesn't change at runtime.
+func (t *FFmpegTranscoder) hasVMAF() bool {
+	t.vmafOnce.Do(func() {
+		out, err := exec.Command("ffmpeg", "-hide_banner", "-filters").Output()
+		if err != nil {
+			log.Printf("Failed to list ffmpeg filters, VMAF disabled: %v", err)
+			return
+		}
+		t.vmafAvailable = strings.Contains(string(out), " libvmaf ")
+		if !t.vmafAvailable {
+			log.Printf("ffmpeg has no libvmaf filter, measuring PSNR and SSIM only")
+		}
+	})
+	return t.vmafAvailable
+}
+
+// measureQuality compares an encoded rendition against the source scaled to the
+// rendition's size and fills in the scores on metrics.
+func (t *FFmpegTranscoder) measureQuality(ctx context.Context, job *models.JobSpec, renditionDir, playlistName string, metrics *models.RenditionMetrics) error {
+	playlistPath := filepath.Join(renditionDir, playlistName)
+
+	width, height, err := t.getVideoSize(ctx, playlistPath)
+	if err != nil {
+		return fmt.Errorf("failed to probe rendition size: %w", err)
+	}
+
+	useVMAF := t.quality.VMAF && t.hasVMAF()
+	comparisons := 2
+	if useVMAF {
+		comparisons = 3
+	}
+
+	// Both streams start at zero and share pixel format so frames line up one to one
+	filter := fmt.Sprintf(
+		"[0:v]setpts=PTS-STARTPTS,format=yuv420p,split=%[1]d%[2]s;"+
+			"[1:v]scale=%[3]d:%[4]d:flags=bicubic,setpts=PTS-STARTPTS,format=yuv420p,split=%[1]d%[5]s;"+
+			"[d0][r0]psnr;[d1][r1]ssim",
+		comparisons, splitLabels("d", comparisons), width, height, splitLabels("r", comparisons),
+	)
+	if useVMAF {
+		filter += fmt.Sprintf(";[d2][r2]libvmaf=n_threads=%d", t.cpuBudget)
+	}
+
+	args := []string{
+		"-hide_banner", "-nostats",
+		"-i", playlistPath,
+	}
+	args = append(args, inputArgs(job.GetInputSource())...)
+	args = append(args,
+		"-filter_complex", filter,
+		"-f", "null", "-",
+	)
+
+	log.Printf("Measuring quality of %s (%dx%d, vmaf=%t)", renditionDir, width, height, useVMAF)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("quality pass failed: %w: %s", err, lastLine(stderr.String()))
+	}
+
+	output := stderr.String()
+	metrics.PSNR = parseScore(psnrRegex, output)
+	metrics.SSIM = parseScore(ssimRegex, output)
+	if useVMAF {
+		metrics.VMAF = parseScore(vmafRegex, output)
+	}
+
+	if metrics.PSNR == nil || metrics.SSIM == nil || (useVMAF && metrics.VMAF == nil) {
+		return fmt.Errorf("quality pass produced no scores")
+	}
+
+	return nil
+}
+
+// checkQuality returns a description of the first score below its configured threshold
+func (t *FFmpegTranscoder) checkQuality(metrics *models.RenditionMetrics) string {
+	check := func(name string, score *float64, min float64) string {
+		if min <= 0 || score == nil || *score >= min {
+			return ""
+		}
+		return fmt.Sprintf("%s %.3f below threshold %.3f", name, *score, min)
+	}
+
+	if issue := check("VMAF", metrics.VMAF, t.quality.MinVMAF); issue != "" {
+		return issue
+	}
+	if issue := check("SSIM", metrics.SSIM, t.quality.MinSSIM); issue != "" {
+		return issue
+	}
+	return check("PSNR", metrics.PSNR, t.quality.MinPSNR)
+}
+
+// getVideoSize returns the dimensions of the first video stream
+func (t *FFmpegTranscoder) getVideoSize(ctx context.Context, inputPath string) (int, int, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "csv=p=0:s=x",
+		inputPath,
+	)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(out)), "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("unexpected ffprobe output %q", string(out))
+	}
+
+	width, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse width: %w", err)
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse height: %w", err)
+	}
+
+	return width, height, nil
+}
+
+// splitLabels returns filter pad labels like "[d0][d1][d2]"
+func splitLabels(prefix string, n int) string {
+	var labels strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&labels, "[%s%d]", prefix, i)
+	}
+	return labels.String()
+}
+
+// parseScore extracts the last score matched by re, so summary lines win over
+// any per-frame output
+func parseScore(re *regexp.Regexp, output string) *float64 {
+	matches := re.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+
+	value := matches[len(matches)-1][1]
+	if value == "inf" {
+		// Identical frames; cap at a value JSON can carry
+		score := 100.0
+		return &score
+	}
+
+	score, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	return &score
+}
@@ -0,0 +1,106 @@
+package transcoder
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimitChunk bounds how much data is charged to the limiter at once, so
+// concurrent uploads interleave smoothly instead of in large bursts
+const rateLimitChunk = 64 * 1024
+
+// rateLimiter caps aggregate throughput across all upload workers.
+// Each caller reserves transfer time on a shared virtual clock and sleeps until
+// its reservation starts.
+type rateLimiter struct {
+	mu          sync.Mutex
+	bytesPerSec float64
+	next        time.Time
+}
+
+// newRateLimiter returns a limiter for the given bits per second, or nil for unlimited
+func newRateLimiter(bitsPerSecond int64) *rateLimiter {
+	if bitsPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSec: float64(bitsPerSecond) / 8}
+}
+
+// wait blocks until n bytes may be transferred
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return ctx.Err()
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.bytesPerSec * float64(time.Second)))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedWriter charges every write to a rateLimiter
+type limitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > rateLimitChunk {
+			n = rateLimitChunk
+		}
+		if err := lw.limiter.wait(lw.ctx, n); err != nil {
+			return written, err
+		}
+		m, err := lw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// limitedReader charges every read to a rateLimiter
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if waitErr := lr.limiter.wait(lr.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,95 @@
+package transcoder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"transcode-worker/internal/storage"
+	"transcode-worker/pkg/models"
+)
+
+// SpaceEstimate is the disk space a job is expected to need, before any margin
+type SpaceEstimate struct {
+	TempBytes   int64 // Peak use of the job temp dir and input cache
+	OutputBytes int64 // Written to the destination
+}
+
+// EstimateSpace estimates the disk space a job needs from the source duration
+// and the output bitrates. Renditions are staged one at a time and their temp
+// dir is removed once committed, so temp space is sized for the largest one;
+// chunked renditions hold the chunks and the concatenated output together, and
+// streamed ones free temp space as they go. An input that has to be fetched to
+// local disk counts towards temp space too. Sources whose duration can't be
+// probed without fetching them only count the fetch.
+func (t *FFmpegTranscoder) EstimateSpace(ctx context.Context, job *models.JobSpec) (SpaceEstimate, error) {
+	var estimate SpaceEstimate
+
+	src := t.inputSource(job.GetInputSource())
+	source, err := src.Stat(ctx, job.GetInputSource())
+	if err != nil {
+		return estimate, fmt.Errorf("failed to stat input: %w", err)
+	}
+	if t.needsFetch(src, source, job.Input.SHA256) && source.Size > 0 {
+		estimate.TempBytes += source.Size
+	}
+
+	local, ok := src.LocalPath(source.Path)
+	if !ok {
+		log.Printf("Input %s has no local path, estimating disk space without its duration", source.Path)
+		return estimate, nil
+	}
+	duration, err := t.getMediaDuration(ctx, local)
+	if err != nil {
+		return estimate, fmt.Errorf("failed to get media duration: %w", err)
+	}
+
+	// Per-title analysis may raise bitrates up to the max scale
+	scale := 1.0
+	if t.complexity.Enabled {
+		scale = t.complexity.MaxScale
+	}
+
+	var largest int64
+	for i := range job.Outputs {
+		output := &job.Outputs[i]
+		video, err := models.ParseBitrate(output.Bitrate)
+		if err != nil {
+			return estimate, fmt.Errorf("rendition %s: %w", output.Resolution, err)
+		}
+		audio, err := models.ParseBitrate(job.GetAudioBitrate(output))
+		if err != nil {
+			return estimate, fmt.Errorf("rendition %s audio: %w", output.Resolution, err)
+		}
+
+		size := int64((float64(video)*scale + float64(audio)) * duration / 8)
+		estimate.OutputBytes += size
+
+		switch {
+		case t.useChunkedEncoding(*output, duration):
+			size *= 2
+		case t.useStreamingCommit(*output, duration):
+			size = 0
+		}
+		if size > largest {
+			largest = size
+		}
+	}
+	estimate.TempBytes += largest
+
+	return estimate, nil
+}
+
+// needsFetch reports whether localInput will copy the source to local disk,
+// either into the job temp dir or as a new input cache entry
+func (t *FFmpegTranscoder) needsFetch(src storage.Source, source storage.FileInfo, expectedSHA256 string) bool {
+	_, ok := src.LocalPath(source.Path)
+	streamed := ok && storage.IsURL(source.Path) && expectedSHA256 == ""
+
+	if t.cache != nil && !streamed && t.cache.skipReason(source) == "" {
+		_, err := os.Stat(t.cache.entryPath(source))
+		return err != nil
+	}
+	return !ok || (expectedSHA256 != "" && storage.IsURL(source.Path))
+}
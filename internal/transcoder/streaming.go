@@ -0,0 +1,322 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"transcode-worker/internal/storage"
+	"transcode-worker/pkg/models"
+)
+
+// streamPollInterval is how often the rendition playlist is checked for new segments
+const streamPollInterval = time.Second
+
+// How a rendition is committed, as kept in its checkpoint
+const (
+	commitStaged    = "staged"
+	commitStreaming = "streaming"
+)
+
+// useStreamingCommit reports whether a rendition's segments should be published
+// while it is being encoded. Chunked renditions only produce segments in their
+// final concat pass, so they always go through the staged commit. The quality
+// pass reads the published rendition with ffmpeg, so with quality enabled the
+// destination must have a local path.
+func (t *FFmpegTranscoder) useStreamingCommit(output models.OutputSpec, duration float64) bool {
+	if !t.streaming || t.useChunkedEncoding(output, duration) {
+		return false
+	}
+	if _, local := t.store.LocalPath(output.DestPath); t.quality.Enabled && !local {
+		return false
+	}
+	return true
+}
+
+// chooseStreaming decides how a rendition is committed, once: a resumed
+// rendition finishes the way it started. Streaming writes into the destination
+// while encoding, so a destination that already holds output, which only the
+// "replace" policy allows, gets the staged commit that swaps it atomically.
+func (t *FFmpegTranscoder) chooseStreaming(ctx context.Context, cp *checkpoint, state *renditionCheckpoint, output models.OutputSpec, duration float64) (bool, error) {
+	switch state.Commit {
+	case commitStreaming:
+		return true, nil
+	case commitStaged:
+		return false, nil
+	}
+
+	streaming := t.useStreamingCommit(output, duration)
+	if streaming {
+		exists, err := t.outputExists(ctx, output.DestPath)
+		if err != nil {
+			return false, fmt.Errorf("failed to check destination %s: %w", output.DestPath, err)
+		}
+		if exists {
+			log.Printf("Destination %s holds output, committing %s staged instead of streaming", output.DestPath, output.Resolution)
+			streaming = false
+		}
+	}
+
+	state.Commit = commitStaged
+	if streaming {
+		state.Commit = commitStreaming
+	}
+	if err := cp.save(); err != nil {
+		return false, fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return streaming, nil
+}
+
+// streamRendition encodes a rendition while a watcher publishes every segment as
+// soon as ffmpeg closes it. Players see an EVENT playlist that grows during the
+// encode and becomes VOD at the end; temp space is freed segment by segment.
+// Validation and the quality pass run against the published output.
+func (t *FFmpegTranscoder) streamRendition(
+	ctx context.Context,
+	job *models.JobSpec,
+	cp *checkpoint,
+	state *renditionCheckpoint,
+	output models.OutputSpec,
+	key string,
+	renditionTempDir string,
+	duration float64,
+	progressCh chan<- models.JobProgress,
+) (string, models.UploadMetrics, error) {
+	if err := t.store.MkdirAll(ctx, output.DestPath); err != nil {
+		return "", models.UploadMetrics{}, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	streamer := &segmentStreamer{
+		t:        t,
+		localDir: renditionTempDir,
+		destDir:  output.DestPath,
+		playlist: t.playlistFile(job, output),
+		digests:  make(map[string]string),
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- streamer.watch(watchCtx)
+	}()
+
+	err := t.encodeRendition(ctx, job, cp, state, output, key, renditionTempDir, output.DestPath, duration, progressCh)
+
+	cancel()
+	if werr := <-watchErr; werr != nil && err == nil {
+		err = fmt.Errorf("failed to publish segments: %w", werr)
+	}
+	if err != nil {
+		return "", streamer.stats, err
+	}
+
+	manifestHash, err := streamer.finish(ctx)
+	if err != nil {
+		return "", streamer.stats, fmt.Errorf("failed to finish streaming commit: %w", err)
+	}
+
+	// Output that doesn't hold up is taken down again, players already see it
+	if err := t.validateRendition(ctx, t.store, output.DestPath, streamer.playlist, duration); err != nil {
+		if ctx.Err() == nil {
+			streamer.takeDown(ctx)
+		}
+		return "", streamer.stats, fmt.Errorf("output validation failed for %s: %w", output.Resolution, err)
+	}
+	if err := t.scoreRendition(ctx, job, cp, state, output, key, output.DestPath); err != nil {
+		if ctx.Err() == nil {
+			streamer.takeDown(ctx)
+		}
+		return "", streamer.stats, err
+	}
+
+	return manifestHash, streamer.stats, nil
+}
+
+// segmentStreamer publishes finished segments of one rendition to its destination
+type segmentStreamer struct {
+	t        *FFmpegTranscoder
+	localDir string
+	destDir  string
+	playlist string // Media playlist name, locally and at the destination
+
+	digests        map[string]string // Published file -> SHA-256
+	playlistDigest string
+	stats          models.UploadMetrics
+}
+
+// watch publishes new segments until ctx is cancelled
+func (s *segmentStreamer) watch(ctx context.Context) error {
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.publish(ctx, false); err != nil {
+				if ctx.Err() != nil {
+					return nil // Encode finished or was cancelled mid-copy
+				}
+				return err
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// publish uploads every segment listed in ffmpeg's playlist that isn't published
+// yet, then refreshes the destination playlist. ffmpeg rewrites its EVENT
+// playlist as each segment is closed, so anything listed is complete.
+func (s *segmentStreamer) publish(ctx context.Context, final bool) error {
+	playlist, err := parseMediaPlaylist(filepath.Join(s.localDir, s.playlist))
+	if err != nil {
+		if os.IsNotExist(err) && !final {
+			return nil // ffmpeg hasn't finished the first segment yet
+		}
+		return fmt.Errorf("failed to read rendition playlist: %w", err)
+	}
+
+	published := 0
+	for _, seg := range playlist.Segments {
+		if _, ok := s.digests[seg.URI]; ok {
+			continue
+		}
+		if err := s.publishSegment(ctx, seg.URI); err != nil {
+			return err
+		}
+		published++
+	}
+
+	if published == 0 && !final {
+		return nil
+	}
+
+	// Players may load the playlist at any time: EVENT while growing, VOD once done
+	out := *playlist
+	if final {
+		if !playlist.EndList {
+			return fmt.Errorf("rendition playlist is not finished")
+		}
+		out.PlaylistType = "VOD"
+	} else {
+		out.PlaylistType = "EVENT"
+		out.EndList = false
+	}
+
+	digest, err := s.t.writeStored(ctx, s.t.store.Join(s.destDir, s.playlist), out.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to write destination playlist: %w", err)
+	}
+	s.playlistDigest = digest
+
+	return nil
+}
+
+// publishSegment copies one segment to the destination and frees the local copy
+func (s *segmentStreamer) publishSegment(ctx context.Context, uri string) error {
+	local := filepath.Join(s.localDir, uri)
+	dest := s.t.store.Join(s.destDir, uri)
+
+	// A resumed job may find the segment already published by the previous run
+	if _, err := os.Stat(local); os.IsNotExist(err) {
+		info, err := s.t.store.Stat(ctx, dest)
+		var digest string
+		if err == nil {
+			digest, err = s.t.storedDigest(ctx, info)
+		}
+		if err != nil {
+			return fmt.Errorf("segment %s is neither local nor published: %w", uri, err)
+		}
+		s.digests[uri] = digest
+		s.stats.SkippedFiles++
+		return nil
+	}
+
+	start := time.Now()
+	res, err := s.t.copyFile(ctx, local, dest)
+	if err != nil {
+		return fmt.Errorf("failed to publish segment %s: %w", uri, err)
+	}
+
+	s.digests[uri] = res.Digest
+	if res.Skipped {
+		s.stats.SkippedFiles++
+	} else {
+		s.stats.Add(models.UploadMetrics{
+			Files:  1,
+			Bytes:  res.Written,
+			TimeMS: time.Since(start).Milliseconds(),
+		})
+	}
+
+	if err := os.Remove(local); err != nil {
+		log.Printf("Failed to free published segment %s: %v", local, err)
+	}
+
+	log.Printf("Published segment: %s", uri)
+	return nil
+}
+
+// finish publishes the remaining segments and the VOD playlist the encode ended
+// with, then writes the checksum manifest. It returns the manifest's SHA-256.
+func (s *segmentStreamer) finish(ctx context.Context) (string, error) {
+	if err := s.publish(ctx, true); err != nil {
+		return "", err
+	}
+
+	digests := make(map[string]string, len(s.digests)+1)
+	for uri, digest := range s.digests {
+		digests[uri] = digest
+	}
+	digests[s.playlist] = s.playlistDigest
+
+	// A resumed stream may find segments of an earlier attempt that produced different output
+	if err := s.t.pruneOutput(ctx, s.destDir, digests); err != nil {
+		return "", fmt.Errorf("failed to remove stale output files: %w", err)
+	}
+
+	manifestHash, err := s.t.writeChecksumManifest(ctx, s.destDir, digests)
+	if err != nil {
+		return "", fmt.Errorf("failed to write checksum manifest: %w", err)
+	}
+	if renamer, ok := s.t.store.(storage.Renamer); ok {
+		if err := renamer.SyncDir(s.destDir); err != nil {
+			return "", fmt.Errorf("failed to sync destination: %w", err)
+		}
+	}
+
+	log.Printf("Streaming commit finished for %s (manifest sha256 %s)", s.destDir, manifestHash)
+	return manifestHash, nil
+}
+
+// takeDown removes the published rendition after it failed its checks
+func (s *segmentStreamer) takeDown(ctx context.Context) {
+	segments := make([]string, 0, len(s.digests))
+	for uri := range s.digests {
+		segments = append(segments, uri)
+	}
+	if err := s.t.removeStreamed(ctx, s.destDir, s.playlist, segments); err != nil {
+		log.Printf("Failed to take down rendition %s: %v", s.destDir, err)
+		return
+	}
+	log.Printf("Took down rendition that failed its checks: %s", s.destDir)
+}
+
+// removeStreamed removes streamed output from destDir: the playlist first, so
+// players stop loading the rendition, then the checksum manifest and segments
+func (t *FFmpegTranscoder) removeStreamed(ctx context.Context, destDir, playlist string, segments []string) error {
+	files := append([]string{playlist, checksumManifestName}, segments...)
+	for _, name := range files {
+		err := t.store.Remove(ctx, t.store.Join(destDir, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package transcoder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"transcode-worker/pkg/models"
+)
+
+func TestDiscardJobRemovesUnfinishedStreams(t *testing.T) {
+	tr, nas := newTestTranscoder(t)
+	tr.naming.PlaylistTemplate = "playlist.m3u8"
+
+	job := &models.JobSpec{
+		JobID: "job-1",
+		Outputs: []models.OutputSpec{
+			{Resolution: "1080p", Bitrate: "5000k"},
+			{Resolution: "720p", Bitrate: "2500k"},
+		},
+	}
+	done, streaming := renditionKey(job.Outputs[0]), renditionKey(job.Outputs[1])
+	doneDest, streamingDest := filepath.Join(nas, "1080p"), filepath.Join(nas, "720p")
+
+	jobTempDir := filepath.Join(tr.tempDir, job.JobID)
+	cp := &checkpoint{
+		JobID: job.JobID,
+		Renditions: map[string]*renditionCheckpoint{
+			done:      {Encoded: true, Committed: true, Commit: commitStreaming},
+			streaming: {Segments: 2, Commit: commitStreaming},
+		},
+		Destinations: map[string]string{done: doneDest, streaming: streamingDest},
+		path:         filepath.Join(jobTempDir, checkpointFileName),
+	}
+	if err := os.MkdirAll(filepath.Join(jobTempDir, streaming), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ffmpeg's playlist lists the two published segments and the one still local
+	local := &mediaPlaylist{Segments: []mediaSegment{
+		{URI: "segment_000.ts", Duration: 6},
+		{URI: "segment_001.ts", Duration: 6},
+		{URI: "segment_002.ts", Duration: 6},
+	}}
+	if err := writeMediaPlaylist(filepath.Join(jobTempDir, streaming, "playlist.m3u8"), local); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, filepath.Join(jobTempDir, streaming), map[string]string{"segment_002.ts": "c"})
+
+	writeFiles(t, streamingDest, map[string]string{
+		"playlist.m3u8":  "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n",
+		"segment_000.ts": "a",
+		"segment_001.ts": "b",
+		"notes.txt":      "not ours",
+	})
+	writeFiles(t, doneDest, map[string]string{
+		"playlist.m3u8":      "#EXTM3U\n",
+		"segment_000.ts":     "a",
+		checksumManifestName: "",
+	})
+
+	if err := tr.DiscardJob(job); err != nil {
+		t.Fatalf("DiscardJob: %v", err)
+	}
+
+	if got := listFiles(t, streamingDest); strings.Join(got, ",") != "notes.txt" {
+		t.Errorf("unfinished stream left %v, want only notes.txt", got)
+	}
+	if got := listFiles(t, doneDest); len(got) != 3 {
+		t.Errorf("committed rendition holds %v, want it untouched", got)
+	}
+	if _, err := os.Stat(jobTempDir); !os.IsNotExist(err) {
+		t.Errorf("job temp dir still exists: %v", err)
+	}
+}
+
+func TestStreamRenditionPublishesWhileEncoding(t *testing.T) {
+	requireFFmpeg(t)
+	const duration = 90
+	tr, job, output := newEncodeTest(t, testSource(t, duration))
+	tr.streaming = true
+
+	key := renditionKey(output)
+	dir := filepath.Join(t.TempDir(), key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cp := newTestCheckpoint(t)
+
+	// Watch for segments at the destination, and gone locally, while ffmpeg still runs
+	var publishedEarly, freedEarly atomic.Bool
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			local, err := parseMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+			if err != nil || local.EndList {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(output.DestPath, "segment_000.ts")); err == nil {
+				publishedEarly.Store(true)
+				if _, err := os.Stat(filepath.Join(dir, "segment_000.ts")); os.IsNotExist(err) {
+					freedEarly.Store(true)
+				}
+			}
+		}
+	}()
+
+	_, _, err := tr.streamRendition(context.Background(), job, cp, cp.rendition(key), output, key, dir, duration, nil)
+	close(done)
+	<-watched
+	if err != nil {
+		t.Fatalf("streamRendition: %v", err)
+	}
+
+	if !publishedEarly.Load() {
+		t.Error("no segment was published before the encode finished")
+	}
+	if !freedEarly.Load() {
+		t.Error("no published segment was freed locally before the encode finished")
+	}
+
+	published, err := parseMediaPlaylist(filepath.Join(output.DestPath, "index.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published.PlaylistType != "VOD" || !published.EndList || len(published.Segments) < duration/2-1 {
+		t.Errorf("published playlist type %q, ended %v, %d segments", published.PlaylistType, published.EndList, len(published.Segments))
+	}
+	for _, name := range listFiles(t, dir) {
+		if strings.HasSuffix(name, ".ts") {
+			t.Errorf("segment %s left in temp space", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(output.DestPath, checksumManifestName)); err != nil {
+		t.Errorf("no checksum manifest: %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package transcoder
 import (
     "bufio"
     "context"
+    "crypto/sha256"
+    "encoding/hex"
     "fmt"
     "io"
     "log"
@@ -12,67 +14,408 @@ import (
     "regexp"
     "strconv"
     "strings"
-    //"time"
+    "sync"
+    "time"
 
+    "transcode-worker/internal/config"
+    "transcode-worker/internal/storage"
     "transcode-worker/pkg/models"
 )
 
 type FFmpegTranscoder struct {
-    tempDir string
+    tempDir    string
+    stateDir   string // Holds the staging registry
+    store      storage.Backend
+    paths      *storage.PathPolicy // Keeps commits inside the allowed output roots
+    local      *storage.Filesystem // Temp dirs, for checks shared with the backend
+    http       *storage.HTTP
+    httpInput  config.HTTPInputConfig
+    cache      *inputCache // nil when the input cache is disabled
+    chunked    config.ChunkedEncodingConfig
+    quality    config.QualityConfig
+    validation config.ValidationConfig
+    complexity config.ComplexityConfig
+    naming     config.OutputConfig
+    cpuBudget  int // CPU threads one job may use, see slotCPUBudget
+    
+    uploadWorkers int
+    limiter       *rateLimiter // nil when upload bandwidth is unlimited
+    streaming     bool
+    
+    vmafOnce      sync.Once
+    vmafAvailable bool
+    
+    renditionDone func(jobID, rendition string) // nil unless OnRenditionDone was called
 }
 
-func NewTranscoder(tempDir string) *FFmpegTranscoder {
+// Result describes what a job produced beyond success or failure
+type Result struct {
+    Renditions []models.RenditionMetrics
+    Warnings   []string
+    Complexity *models.ComplexityReport
+    Upload     *models.UploadMetrics // nil when nothing was committed by this attempt
+    Outputs    []string              // Where each output is committed, in job order
+    Roots      []string              // Destination root of each output, below which its rendition dir is
+    Playlists  []string              // Media playlist name of each output, in job order
+}
+
+func NewTranscoder(cfg *config.Config, store storage.Backend) *FFmpegTranscoder {
+    // Validated by config.Load, an empty value means unlimited
+    maxBandwidth, _ := models.ParseBitrate(cfg.Upload.MaxBandwidth)
+    
+    paths := storage.NewPathPolicy(cfg)
+    
     return &FFmpegTranscoder{
-        tempDir: tempDir,
+        tempDir:    cfg.TempDir,
+        stateDir:   cfg.StateDir,
+        store:      store,
+        paths:      paths,
+        local:      storage.NewFilesystem(cfg.TempDir),
+        http:       storage.NewHTTP(cfg.HTTPInput, paths),
+        httpInput:  cfg.HTTPInput,
+        cache:      newInputCache(cfg.InputCache),
+        chunked:    cfg.ChunkedEncoding,
+        quality:    cfg.Quality,
+        validation: cfg.Validation,
+        complexity: cfg.Complexity,
+        naming:     cfg.Output,
+        cpuBudget:  slotCPUBudget(cfg.Slots),
+        
+        uploadWorkers: cfg.Upload.Workers,
+        limiter:       newRateLimiter(maxBandwidth),
+        streaming:     cfg.Upload.Streaming,
     }
 }
 
-// Execute runs the transcoding job
-func (t *FFmpegTranscoder) Execute(ctx context.Context, job *models.JobSpec, progressCh chan<- models.JobProgress) error {
+// OnRenditionDone sets a function called each time a rendition is committed.
+// Set it before any job runs.
+func (t *FFmpegTranscoder) OnRenditionDone(fn func(jobID, rendition string)) {
+    t.renditionDone = fn
+}
+
+// Execute runs the transcoding job.
+// Progress is checkpointed in the job temp dir, so if the job is interrupted the
+// temp dir is kept and a reassignment of the same JobID resumes where it stopped.
+func (t *FFmpegTranscoder) Execute(ctx context.Context, job *models.JobSpec, progressCh chan<- models.JobProgress) (result *Result, err error) {
     log.Printf("Starting transcoding job: %s", job.JobID)
     
+    result = &Result{}
+    
     // Create job-specific temp directory
     jobTempDir := filepath.Join(t.tempDir, job.JobID)
     if err := os.MkdirAll(jobTempDir, 0755); err != nil {
-        return fmt.Errorf("failed to create job temp dir: %w", err)
+        return result, fmt.Errorf("failed to create job temp dir: %w", err)
+    }
+    defer func() {
+        // Keep checkpointed work when interrupted so the job can be resumed
+        if err != nil && ctx.Err() != nil {
+            log.Printf("Job interrupted, keeping temp dir for resume: %s", jobTempDir)
+            return
+        }
+        os.RemoveAll(jobTempDir) // Clean up temp files
+    }()
+    
+    src := t.inputSource(job.GetInputSource())
+    source, err := src.Stat(ctx, job.GetInputSource())
+    if err != nil {
+        return result, fmt.Errorf("failed to stat input: %w", err)
+    }
+    if err := t.checkInputSize(source); err != nil {
+        return result, err
+    }
+    
+    cp, resumed, err := loadCheckpoint(jobTempDir, job, source)
+    if err != nil {
+        return result, fmt.Errorf("failed to load checkpoint: %w", err)
+    }
+    if resumed {
+        log.Printf("Resuming job %s from checkpoint", job.JobID)
+    } else if err := cp.save(); err != nil {
+        // Saved up front so a partial input download survives a restart too
+        return result, fmt.Errorf("failed to save checkpoint: %w", err)
+    }
+    
+    if err := t.planDestinations(ctx, job, cp); err != nil {
+        return result, err
+    }
+    for _, output := range job.Outputs {
+        dest := cp.Destinations[renditionKey(output)]
+        result.Outputs = append(result.Outputs, dest)
+        result.Roots = append(result.Roots, t.destinationRoot(job, output, dest))
+        result.Playlists = append(result.Playlists, t.playlistFile(job, output))
+    }
+    
+    // ffmpeg reads the input from a local path, downloading it first if needed
+    input, release, err := t.localInput(ctx, src, jobTempDir, source, job.Input.SHA256)
+    if err != nil {
+        return result, fmt.Errorf("failed to fetch input: %w", err)
+    }
+    defer release()
+    if input != job.GetInputSource() {
+        localJob := *job
+        localJob.SetInputSource(input)
+        job = &localJob
     }
-    defer os.RemoveAll(jobTempDir) // Clean up temp files
     
     // Get media duration for progress calculation
-    duration, err := t.getMediaDuration(job.GetInputSource())
+    duration, err := t.getMediaDuration(ctx, job.GetInputSource())
     if err != nil {
-        return fmt.Errorf("failed to get media duration: %w", err)
+        return result, fmt.Errorf("failed to get media duration: %w", err)
     }
     
     log.Printf("Media duration: %.2f seconds", duration)
     
+    // Per-title analysis runs once, a resumed job keeps the ladder it started with
+    if t.complexity.Enabled && cp.Complexity == nil {
+        report, err := t.analyzeComplexity(ctx, job, duration, job.Outputs)
+        if err != nil {
+            if ctx.Err() != nil {
+                return result, err
+            }
+            log.Printf("Complexity analysis failed, using requested bitrates: %v", err)
+            result.Warnings = append(result.Warnings, fmt.Sprintf("complexity analysis failed: %v", err))
+        } else {
+            cp.Complexity = report
+            if err := cp.save(); err != nil {
+                return result, fmt.Errorf("failed to save checkpoint: %w", err)
+            }
+        }
+    }
+    result.Complexity = cp.Complexity
+    outputs := applyComplexity(job.Outputs, cp.Complexity)
+    for i := range outputs {
+        outputs[i].DestPath = result.Outputs[i]
+    }
+    
     // Process each output rendition
-    for i, output := range job.Outputs {
+    for i, output := range outputs {
+        // Keyed by the requested spec so a resumed job finds its state again
+        key := renditionKey(job.Outputs[i])
+        state := cp.rendition(key)
+        
+        if state.Metrics == nil {
+            state.Metrics = &models.RenditionMetrics{
+                Resolution: output.Resolution,
+                Bitrate:    output.Bitrate,
+            }
+        }
+        
+        if state.Committed {
+            log.Printf("Skipping rendition %d/%d: %s already committed", i+1, len(job.Outputs), key)
+            result.addRendition(*state.Metrics)
+            continue
+        }
+        
         log.Printf("Processing rendition %d/%d: %s (%s)", i+1, len(job.Outputs), output.Resolution, output.Bitrate)
         
         // Create temp output directory for this rendition
-        renditionTempDir := filepath.Join(jobTempDir, fmt.Sprintf("%s_%s", output.Resolution, output.Bitrate))
+        renditionTempDir := filepath.Join(jobTempDir, key)
         if err := os.MkdirAll(renditionTempDir, 0755); err != nil {
-            return fmt.Errorf("failed to create rendition temp dir: %w", err)
+            return result, fmt.Errorf("failed to create rendition temp dir: %w", err)
         }
         
-        // Transcode to temp directory
-        if err := t.transcodeRendition(ctx, job, output, renditionTempDir, duration, progressCh); err != nil {
-            return fmt.Errorf("failed to transcode %s: %w", output.Resolution, err)
+        streaming, err := t.chooseStreaming(ctx, cp, state, output, duration)
+        if err != nil {
+            return result, err
+        }
+        
+        var manifestHash string
+        var upload models.UploadMetrics
+        if streaming {
+            // Segments are published while encoding, checks run on the published output
+            manifestHash, upload, err = t.streamRendition(ctx, job, cp, state, output, key, renditionTempDir, duration, progressCh)
+        } else {
+            manifestHash, upload, err = t.stageRendition(ctx, job, cp, state, output, key, renditionTempDir, duration, progressCh)
+        }
+        if upload.Files+upload.SkippedFiles > 0 {
+            if result.Upload == nil {
+                result.Upload = &models.UploadMetrics{}
+            }
+            result.Upload.Add(upload)
+        }
+        if err != nil {
+            return result, err
         }
         
-        // Copy files from temp to final destination
-        if err := t.copyDirectory(renditionTempDir, output.DestPath); err != nil {
-            return fmt.Errorf("failed to copy output files: %w", err)
+        state.Metrics.ManifestSHA256 = manifestHash
+        state.Committed = true
+        if err := cp.save(); err != nil {
+            return result, fmt.Errorf("failed to save checkpoint: %w", err)
         }
         
+        // Committed renditions are never needed again, free the temp space
+        if err := os.RemoveAll(renditionTempDir); err != nil {
+            log.Printf("Failed to remove rendition temp dir %s: %v", renditionTempDir, err)
+        }
+        
+        result.addRendition(*state.Metrics)
         log.Printf("Successfully completed rendition: %s", output.Resolution)
+        if t.renditionDone != nil {
+            t.renditionDone(job.JobID, key)
+        }
     }
     
     log.Printf("Transcoding job completed: %s", job.JobID)
+    return result, nil
+}
+
+// stageRendition encodes a rendition into its temp dir, checks it, and then
+// commits it atomically to the destination
+func (t *FFmpegTranscoder) stageRendition(
+    ctx context.Context,
+    job *models.JobSpec,
+    cp *checkpoint,
+    state *renditionCheckpoint,
+    output models.OutputSpec,
+    key string,
+    renditionTempDir string,
+    duration float64,
+    progressCh chan<- models.JobProgress,
+) (string, models.UploadMetrics, error) {
+    if err := t.encodeRendition(ctx, job, cp, state, output, key, renditionTempDir, "", duration, progressCh); err != nil {
+        return "", models.UploadMetrics{}, err
+    }
+    
+    // Never commit output that doesn't hold up, whatever ffmpeg's exit code was
+    if err := t.validateRendition(ctx, t.local, renditionTempDir, t.playlistFile(job, output), duration); err != nil {
+        return "", models.UploadMetrics{}, fmt.Errorf("output validation failed for %s: %w", output.Resolution, err)
+    }
+    
+    // Score the rendition before anything is published
+    if err := t.scoreRendition(ctx, job, cp, state, output, key, renditionTempDir); err != nil {
+        return "", models.UploadMetrics{}, err
+    }
+    
+    // Publish the rendition atomically to its final destination
+    manifestHash, upload, err := t.commitDirectory(ctx, job.JobID, renditionTempDir, output.DestPath)
+    if err != nil {
+        return "", upload, fmt.Errorf("failed to commit output files: %w", err)
+    }
+    
+    return manifestHash, upload, nil
+}
+
+// encodeRendition runs ffmpeg for a rendition unless the checkpoint says it is
+// already encoded. publishedDir is where streamed segments live ("" if none).
+func (t *FFmpegTranscoder) encodeRendition(
+    ctx context.Context,
+    job *models.JobSpec,
+    cp *checkpoint,
+    state *renditionCheckpoint,
+    output models.OutputSpec,
+    key string,
+    renditionTempDir string,
+    publishedDir string,
+    duration float64,
+    progressCh chan<- models.JobProgress,
+) error {
+    if state.Encoded {
+        return nil
+    }
+    
+    if publishedDir == "" && t.useChunkedEncoding(output, duration) {
+        // Finished chunks are kept next to the rendition dir and reused on resume
+        chunkDir := renditionTempDir + ".chunks"
+        if err := t.transcodeChunked(ctx, job, output, renditionTempDir, chunkDir, duration, progressCh); err != nil {
+            return fmt.Errorf("failed to transcode %s: %w", output.Resolution, err)
+        }
+        state.Encoded = true
+        if err := cp.save(); err != nil {
+            return fmt.Errorf("failed to save checkpoint: %w", err)
+        }
+        os.RemoveAll(chunkDir)
+        return nil
+    }
+    
+    // Pick up after the last complete segment of an interrupted run
+    segments, offset, done, err := t.resumePoint(ctx, renditionTempDir, t.playlistFile(job, output), publishedDir)
+    if err != nil {
+        return fmt.Errorf("failed to inspect %s for resume: %w", output.Resolution, err)
+    }
+    state.Segments = segments
+    state.Offset = offset
+    
+    if done {
+        state.Encoded = true
+    } else {
+        if segments > 0 {
+            log.Printf("Resuming rendition %s at segment %d (%.2fs)", key, segments, offset)
+        }
+        if err := cp.save(); err != nil {
+            return fmt.Errorf("failed to save checkpoint: %w", err)
+        }
+        
+        // Transcode to temp directory
+        if err := t.transcodeRendition(ctx, job, output, renditionTempDir, duration, segments, offset, publishedDir != "", progressCh); err != nil {
+            return fmt.Errorf("failed to transcode %s: %w", output.Resolution, err)
+        }
+        state.Encoded = true
+    }
+    
+    if err := finishPlaylist(filepath.Join(renditionTempDir, t.playlistFile(job, output))); err != nil {
+        return fmt.Errorf("failed to finish playlist of %s: %w", output.Resolution, err)
+    }
+    
+    if err := cp.save(); err != nil {
+        return fmt.Errorf("failed to save checkpoint: %w", err)
+    }
     return nil
 }
 
+// scoreRendition runs the optional quality pass on the rendition in dir
+func (t *FFmpegTranscoder) scoreRendition(
+    ctx context.Context,
+    job *models.JobSpec,
+    cp *checkpoint,
+    state *renditionCheckpoint,
+    output models.OutputSpec,
+    key string,
+    dir string,
+) error {
+    if !t.quality.Enabled || state.Metrics.PSNR != nil {
+        return nil
+    }
+    
+    if err := t.measureQuality(ctx, job, dir, t.playlistFile(job, output), state.Metrics); err != nil {
+        return fmt.Errorf("failed to measure quality of %s: %w", output.Resolution, err)
+    }
+    log.Printf("Quality of %s: psnr=%s ssim=%s vmaf=%s", key,
+        formatScore(state.Metrics.PSNR), formatScore(state.Metrics.SSIM), formatScore(state.Metrics.VMAF))
+    
+    if issue := t.checkQuality(state.Metrics); issue != "" {
+        if t.quality.OnThreshold == "fail" {
+            return fmt.Errorf("rendition %s failed quality check: %s", output.Resolution, issue)
+        }
+        state.Metrics.QualityIssue = issue
+    }
+    
+    if err := cp.save(); err != nil {
+        return fmt.Errorf("failed to save checkpoint: %w", err)
+    }
+    return nil
+}
+
+// addRendition records a finished rendition and surfaces its quality issue, if any
+func (r *Result) addRendition(metrics models.RenditionMetrics) {
+    r.Renditions = append(r.Renditions, metrics)
+    if metrics.QualityIssue != "" {
+        r.Warnings = append(r.Warnings, fmt.Sprintf("rendition %s: %s", metrics.Resolution, metrics.QualityIssue))
+    }
+}
+
+// formatScore renders an optional quality score for logging
+func formatScore(score *float64) string {
+    if score == nil {
+        return "n/a"
+    }
+    return strconv.FormatFloat(*score, 'f', 3, 64)
+}
+
+// renditionKey identifies a rendition within a job (also its temp dir name)
+func renditionKey(output models.OutputSpec) string {
+    return fmt.Sprintf("%s_%s", output.Resolution, output.Bitrate)
+}
+
 // transcodeRendition processes a single output rendition
 func (t *FFmpegTranscoder) transcodeRendition(
     ctx context.Context,
@@ -80,16 +423,29 @@ func (t *FFmpegTranscoder) transcodeRendition(
     output models.OutputSpec,
     outputDir string,
     duration float64,
+    startSegment int,
+    startOffset float64,
+    streaming bool,
     progressCh chan<- models.JobProgress,
 ) error {
     // Get HLS settings
     segmentTime := job.GetSegmentTime()
     
     // Build FFmpeg command
-    args := []string{
-        "-i", job.GetInputSource(),
+    var args []string
+    
+    // When resuming, seek the input past the segments already on disk
+    if startSegment > 0 {
+        args = append(args, "-ss", fmt.Sprintf("%.3f", startOffset))
+    }
+    
+    args = append(args, inputArgs(job.GetInputSource())...)
+    args = append(args,
         "-c:v", output.Codec,
         "-b:v", output.Bitrate,
+    )
+    if !IsHardwareCodec(output.Codec) {
+        args = append(args, "-threads", strconv.Itoa(t.cpuBudget))
     }
     
     // Add resolution scaling if specified
@@ -108,13 +464,40 @@ func (t *FFmpegTranscoder) transcodeRendition(
         "-b:a", audioBitrate,
     )
     
-    // Add HLS settings
+    // Keep timestamps continuous with the segments already on disk
+    if startSegment > 0 {
+        args = append(args, "-output_ts_offset", fmt.Sprintf("%.3f", startOffset))
+    }
+    
+    // Add HLS settings. ffmpeg only writes a VOD playlist once it exits, an EVENT
+    // playlist after every segment, which is what resuming and streaming read.
+    // It is turned into VOD once the rendition is complete.
     args = append(args,
         "-f", "hls",
         "-hls_time", fmt.Sprintf("%d", segmentTime),
-        "-hls_playlist_type", "vod",
-        "-hls_segment_filename", filepath.Join(outputDir, "segment_%03d.ts"),
-        filepath.Join(outputDir, "index.m3u8"),
+        "-hls_playlist_type", "event",
+    )
+    
+    var hlsFlags []string
+    
+    // Continue numbering and append to the existing playlist when resuming
+    if startSegment > 0 {
+        args = append(args, "-start_number", strconv.Itoa(startSegment))
+        hlsFlags = append(hlsFlags, "append_list")
+    }
+    
+    // Segments and playlist are read while ffmpeg runs, so never expose partial files
+    if streaming {
+        hlsFlags = append(hlsFlags, "temp_file")
+    }
+    
+    if len(hlsFlags) > 0 {
+        args = append(args, "-hls_flags", strings.Join(hlsFlags, "+"))
+    }
+    
+    args = append(args,
+        "-hls_segment_filename", filepath.Join(outputDir, t.segmentPattern(job, output)),
+        filepath.Join(outputDir, t.playlistFile(job, output)),
     )
     
     log.Printf("FFmpeg command: ffmpeg %s", strings.Join(args, " "))
@@ -134,7 +517,7 @@ func (t *FFmpegTranscoder) transcodeRendition(
     }
     
     // Parse progress from stderr
-    go t.parseProgress(stderr, duration, progressCh)
+    go t.parseProgress(stderr, duration, startOffset, progressCh)
     
     // Wait for completion
     if err := cmd.Wait(); err != nil {
@@ -144,73 +527,274 @@ func (t *FFmpegTranscoder) transcodeRendition(
     return nil
 }
 
-// copyDirectory copies all files from src to dst, handling cross-device scenarios
-func (t *FFmpegTranscoder) copyDirectory(src, dst string) error {
+// copyResult describes the outcome of copying a single file
+type copyResult struct {
+    Digest  string // hex SHA-256 of the contents
+    Written int64  // bytes written, 0 when skipped
+    Skipped bool   // destination already had identical contents
+}
+
+// copyDirectory recursively copies all files from src to dst, handling cross-device scenarios.
+// Files are copied by a bounded pool of workers; playlists are copied last so they
+// never reference a segment that isn't there yet. It returns the SHA-256 of every
+// file keyed by slash-separated relative path.
+func (t *FFmpegTranscoder) copyDirectory(ctx context.Context, src, dst string) (map[string]string, models.UploadMetrics, error) {
+    var stats models.UploadMetrics
     log.Printf("Copying files from %s to %s", src, dst)
     
     // Ensure destination directory exists
-    if err := os.MkdirAll(dst, 0755); err != nil {
-        return fmt.Errorf("failed to create destination directory: %w", err)
+    if err := t.store.MkdirAll(ctx, dst); err != nil {
+        return nil, stats, fmt.Errorf("failed to create destination directory: %w", err)
     }
     
-    // Read all files in source directory
-    entries, err := os.ReadDir(src)
+    // Collect all files below src, creating the matching directories in dst
+    var media, playlists []string
+    err := filepath.WalkDir(src, func(path string, entry os.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(src, path)
+        if err != nil {
+            return err
+        }
+        if entry.IsDir() {
+            if rel != "." {
+                return t.store.MkdirAll(ctx, t.store.Join(dst, filepath.ToSlash(rel)))
+            }
+            return nil
+        }
+        if isPlaylist(rel) {
+            playlists = append(playlists, rel)
+        } else {
+            media = append(media, rel)
+        }
+        return nil
+    })
     if err != nil {
-        return fmt.Errorf("failed to read source directory: %w", err)
+        return nil, stats, fmt.Errorf("failed to read source directory: %w", err)
     }
     
-    // Copy each file
-    for _, entry := range entries {
-        if entry.IsDir() {
-            continue // Skip subdirectories for now
+    start := time.Now()
+    digests := make(map[string]string, len(media)+len(playlists))
+    
+    // Media first, playlists only once every segment is in place
+    for _, batch := range [][]string{media, playlists} {
+        if err := t.copyFiles(ctx, src, dst, batch, digests, &stats); err != nil {
+            return nil, stats, err
         }
-        
-        srcFile := filepath.Join(src, entry.Name())
-        dstFile := filepath.Join(dst, entry.Name())
-        
-        if err := t.copyFile(srcFile, dstFile); err != nil {
-            return fmt.Errorf("failed to copy file %s: %w", entry.Name(), err)
+    }
+    
+    stats.TimeMS = time.Since(start).Milliseconds()
+    if stats.TimeMS > 0 {
+        stats.Mbps = float64(stats.Bytes*8) / float64(stats.TimeMS) / 1000
+    }
+    
+    log.Printf("Successfully copied %d files (%d already in place, %.1f Mbps)", stats.Files, stats.SkippedFiles, stats.Mbps)
+    return digests, stats, nil
+}
+
+// copyFiles copies a batch of relative paths using the upload worker pool
+func (t *FFmpegTranscoder) copyFiles(ctx context.Context, src, dst string, files []string, digests map[string]string, stats *models.UploadMetrics) error {
+    copyCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    
+    var mu sync.Mutex
+    var firstErr error
+    
+    jobs := make(chan string)
+    var wg sync.WaitGroup
+    for i := 0; i < t.uploadWorkers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for rel := range jobs {
+                res, err := t.copyFile(copyCtx, filepath.Join(src, rel), t.store.Join(dst, filepath.ToSlash(rel)))
+                
+                mu.Lock()
+                if err != nil {
+                    if firstErr == nil {
+                        firstErr = fmt.Errorf("failed to copy file %s: %w", rel, err)
+                        cancel() // Stop the other workers
+                    }
+                } else {
+                    digests[filepath.ToSlash(rel)] = res.Digest
+                    if res.Skipped {
+                        stats.SkippedFiles++
+                    } else {
+                        stats.Files++
+                        stats.Bytes += res.Written
+                    }
+                }
+                mu.Unlock()
+                
+                if err == nil {
+                    log.Printf("Copied: %s", rel)
+                }
+            }
+        }()
+    }
+    
+feed:
+    for _, rel := range files {
+        select {
+        case jobs <- rel:
+        case <-copyCtx.Done():
+            break feed
         }
-        
-        log.Printf("Copied: %s", entry.Name())
     }
+    close(jobs)
+    wg.Wait()
     
-    log.Printf("Successfully copied %d files", len(entries))
-    return nil
+    if firstErr != nil {
+        return firstErr
+    }
+    return ctx.Err()
 }
 
-// copyFile copies a single file from src to dst
-func (t *FFmpegTranscoder) copyFile(src, dst string) error {
+// copyFile copies a single local file to dst in the storage backend and returns
+// its SHA-256. The digest is stored along with the file where the backend
+// supports it and is checked against what landed at dst, so a short or
+// corrupted write is caught before the commit. A dst that already holds
+// identical contents from an earlier attempt is left untouched.
+func (t *FFmpegTranscoder) copyFile(ctx context.Context, src, dst string) (copyResult, error) {
     // Open source file
     srcFile, err := os.Open(src)
     if err != nil {
-        return fmt.Errorf("failed to open source: %w", err)
+        return copyResult{}, fmt.Errorf("failed to open source: %w", err)
     }
     defer srcFile.Close()
     
+    srcInfo, err := srcFile.Stat()
+    if err != nil {
+        return copyResult{}, fmt.Errorf("failed to stat source: %w", err)
+    }
+    
+    srcDigest, err := hashLocalFile(src)
+    if err != nil {
+        return copyResult{}, fmt.Errorf("failed to hash source: %w", err)
+    }
+    
+    // Resume: skip files that are already in place with the same size and hash
+    if dstInfo, err := t.store.Stat(ctx, dst); err == nil && dstInfo.Size == srcInfo.Size() {
+        if dstDigest, err := t.storedDigest(ctx, dstInfo); err == nil && dstDigest == srcDigest {
+            return copyResult{Digest: srcDigest, Skipped: true}, nil
+        }
+    }
+    
     // Create destination file
-    dstFile, err := os.Create(dst)
+    dstFile, err := t.store.Create(ctx, dst, storage.WriteOptions{Size: srcInfo.Size(), SHA256: srcDigest})
     if err != nil {
-        return fmt.Errorf("failed to create destination: %w", err)
+        return copyResult{}, fmt.Errorf("failed to create destination: %w", err)
     }
-    defer dstFile.Close()
+    defer dstFile.Abort()
     
-    // Copy contents
-    if _, err := io.Copy(dstFile, srcFile); err != nil {
-        return fmt.Errorf("failed to copy contents: %w", err)
+    // Copy contents, hashing as we go, within the bandwidth cap
+    hasher := sha256.New()
+    var out io.Writer = dstFile
+    if t.limiter != nil {
+        out = &limitedWriter{ctx: ctx, w: dstFile, limiter: t.limiter}
+    }
+    written, err := io.Copy(io.MultiWriter(out, hasher), srcFile)
+    if err != nil {
+        return copyResult{}, fmt.Errorf("failed to copy contents: %w", err)
+    }
+    digest := hex.EncodeToString(hasher.Sum(nil))
+    if digest != srcDigest {
+        return copyResult{}, fmt.Errorf("source changed while copying")
     }
     
-    // Sync to ensure data is written
-    if err := dstFile.Sync(); err != nil {
-        return fmt.Errorf("failed to sync destination: %w", err)
+    // Flush and publish the file
+    if err := dstFile.Close(); err != nil {
+        return copyResult{}, fmt.Errorf("failed to write destination: %w", err)
     }
     
-    return nil
+    // Verify what actually landed at the destination
+    dstInfo, err := t.store.Stat(ctx, dst)
+    if err != nil {
+        return copyResult{}, fmt.Errorf("failed to verify destination: %w", err)
+    }
+    if dstInfo.Size != written {
+        return copyResult{}, fmt.Errorf("size mismatch after copy: expected %d bytes, got %d", written, dstInfo.Size)
+    }
+    verified, err := t.storedDigest(ctx, dstInfo)
+    if err != nil {
+        return copyResult{}, fmt.Errorf("failed to verify destination: %w", err)
+    }
+    if verified != digest {
+        return copyResult{}, fmt.Errorf("checksum mismatch after copy: expected %s, got %s", digest, verified)
+    }
+    
+    return copyResult{Digest: digest, Written: written}, nil
+}
+
+// writeStored writes a small generated file, such as a playlist or manifest, to
+// the storage backend and returns its SHA-256
+func (t *FFmpegTranscoder) writeStored(ctx context.Context, path string, data []byte) (string, error) {
+    sum := sha256.Sum256(data)
+    digest := hex.EncodeToString(sum[:])
+    
+    file, err := t.store.Create(ctx, path, storage.WriteOptions{Size: int64(len(data)), SHA256: digest})
+    if err != nil {
+        return "", err
+    }
+    defer file.Abort()
+    
+    if _, err := file.Write(data); err != nil {
+        return "", err
+    }
+    if err := file.Close(); err != nil {
+        return "", err
+    }
+    
+    return digest, nil
+}
+
+// storedDigest returns the SHA-256 of a file in the storage backend. Backends
+// that keep the digest on record answer without a download; otherwise the file
+// is read back, which counts against the bandwidth cap.
+func (t *FFmpegTranscoder) storedDigest(ctx context.Context, info storage.FileInfo) (string, error) {
+    if info.SHA256 != "" {
+        return info.SHA256, nil
+    }
+    
+    file, err := t.store.Open(ctx, info.Path)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+    
+    var in io.Reader = file
+    if t.limiter != nil {
+        in = &limitedReader{ctx: ctx, r: file, limiter: t.limiter}
+    }
+    
+    hasher := sha256.New()
+    if _, err := io.Copy(hasher, in); err != nil {
+        return "", err
+    }
+    
+    return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashLocalFile returns the hex SHA-256 of a local file's contents
+func hashLocalFile(path string) (string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+    
+    hasher := sha256.New()
+    if _, err := io.Copy(hasher, file); err != nil {
+        return "", err
+    }
+    
+    return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 // getMediaDuration extracts total duration from media file using ffprobe
-func (t *FFmpegTranscoder) getMediaDuration(inputPath string) (float64, error) {
-    cmd := exec.Command("ffprobe",
+func (t *FFmpegTranscoder) getMediaDuration(ctx context.Context, inputPath string) (float64, error) {
+    cmd := exec.CommandContext(ctx, "ffprobe",
         "-v", "error",
         "-show_entries", "format=duration",
         "-of", "default=noprint_wrappers=1:nokey=1",
@@ -231,8 +815,9 @@ func (t *FFmpegTranscoder) getMediaDuration(inputPath string) (float64, error) {
     return duration, nil
 }
 
-// parseProgress monitors FFmpeg stderr and extracts progress information
-func (t *FFmpegTranscoder) parseProgress(stderr io.Reader, totalDuration float64, progressCh chan<- models.JobProgress) {
+// parseProgress monitors FFmpeg stderr and extracts progress information.
+// startOffset is the source time the encode started at when resuming.
+func (t *FFmpegTranscoder) parseProgress(stderr io.Reader, totalDuration float64, startOffset float64, progressCh chan<- models.JobProgress) {
     scanner := bufio.NewScanner(stderr)
     
     // Regex to extract time progress (e.g., "time=00:01:23.45")
@@ -248,7 +833,7 @@ func (t *FFmpegTranscoder) parseProgress(stderr io.Reader, totalDuration float64
             minutes, _ := strconv.Atoi(matches[2])
             seconds, _ := strconv.ParseFloat(matches[3], 64)
             
-            currentTime := float64(hours*3600 + minutes*60) + seconds
+            currentTime := startOffset + float64(hours*3600 + minutes*60) + seconds
             percent := (currentTime / totalDuration) * 100
             if percent > 100 {
                 percent = 100
@@ -0,0 +1,122 @@
+package transcoder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"transcode-worker/pkg/models"
+)
+
+// requireFFmpeg skips tests that run the real encoder when it isn't installed
+func requireFFmpeg(t *testing.T) {
+	t.Helper()
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+}
+
+// testSource generates a source with video and audio of the given length
+func testSource(t *testing.T, seconds int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "source.mp4")
+	cmd := exec.Command("ffmpeg", "-v", "error",
+		"-f", "lavfi", "-i", fmt.Sprintf("testsrc=duration=%d:size=640x360:rate=25", seconds),
+		"-f", "lavfi", "-i", fmt.Sprintf("sine=duration=%d", seconds),
+		"-c:v", "libx264", "-preset", "ultrafast", "-g", "25",
+		"-c:a", "aac", "-shortest", path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to generate source: %v: %s", err, out)
+	}
+	return path
+}
+
+// newEncodeTest returns a transcoder, job and output that encode source to
+// 2-second segments
+func newEncodeTest(t *testing.T, source string) (*FFmpegTranscoder, *models.JobSpec, models.OutputSpec) {
+	t.Helper()
+	tr, nas := newTestTranscoder(t)
+	tr.naming.PlaylistTemplate = "index.m3u8"
+	tr.naming.SegmentTemplate = "segment_{number}.ts"
+	tr.validation.DurationTolerance = 2 * time.Second
+
+	job := &models.JobSpec{JobID: "job-1"}
+	job.SetInputSource(source)
+	job.HLSSettings.SegmentTime = 2
+	output := models.OutputSpec{Resolution: "360p", Bitrate: "400k", Codec: "libx264", DestPath: filepath.Join(nas, "out")}
+	return tr, job, output
+}
+
+func TestEncodeResumesKilledRendition(t *testing.T) {
+	requireFFmpeg(t)
+	const duration = 60
+	tr, job, output := newEncodeTest(t, testSource(t, duration))
+
+	key := renditionKey(output)
+	dir := filepath.Join(t.TempDir(), key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cp := newTestCheckpoint(t)
+
+	// Kill ffmpeg once its playlist lists a few segments
+	ctx, cancel := context.WithCancel(context.Background())
+	killed := make(chan struct{})
+	go func() {
+		defer close(killed)
+		for ctx.Err() == nil {
+			if playlist, err := parseMediaPlaylist(filepath.Join(dir, "index.m3u8")); err == nil && len(playlist.Segments) >= 3 {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	err := tr.encodeRendition(ctx, job, cp, cp.rendition(key), output, key, dir, "", duration, nil)
+	cancel()
+	<-killed
+	if err == nil {
+		t.Skip("encode finished before it could be interrupted")
+	}
+
+	// The interrupted run's playlist is still open, with its segments on disk
+	playlist, err := parseMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		t.Fatalf("killed encode left no playlist: %v", err)
+	}
+	if playlist.EndList || len(playlist.Segments) < 3 {
+		t.Fatalf("killed encode left %d segments, ended %v", len(playlist.Segments), playlist.EndList)
+	}
+	first, err := os.Stat(filepath.Join(dir, playlist.Segments[0].URI))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := cp.rendition(key)
+	if err := tr.encodeRendition(context.Background(), job, cp, state, output, key, dir, "", duration, nil); err != nil {
+		t.Fatalf("resumed encode: %v", err)
+	}
+	if state.Segments < 3 || !state.Encoded {
+		t.Errorf("resumed at segment %d, encoded %v; want the killed run's segments kept", state.Segments, state.Encoded)
+	}
+	if again, err := os.Stat(filepath.Join(dir, playlist.Segments[0].URI)); err != nil || !os.SameFile(first, again) || !again.ModTime().Equal(first.ModTime()) {
+		t.Error("first segment was encoded again")
+	}
+
+	finished, err := parseMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finished.PlaylistType != "VOD" || !finished.EndList {
+		t.Errorf("finished playlist type %q, ended %v; want VOD", finished.PlaylistType, finished.EndList)
+	}
+	if err := tr.validateRendition(context.Background(), tr.local, dir, "index.m3u8", duration); err != nil {
+		t.Errorf("resumed rendition invalid: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"transcode-worker/internal/storage"
+)
+
+// validateRendition verifies an encoded rendition before it is committed.
+// ffmpeg can exit 0 and still leave a truncated playlist, missing or empty
+// segments, or a rendition cut short, none of which should reach players.
+// store is where renditionDir lives, playlistName its media playlist.
+func (t *FFmpegTranscoder) validateRendition(ctx context.Context, store storage.Backend, renditionDir, playlistName string, sourceDuration float64) error {
+	file, err := store.Open(ctx, store.Join(renditionDir, playlistName))
+	if err != nil {
+		return fmt.Errorf("playlist %s is invalid: %w", playlistName, err)
+	}
+	playlist, err := readMediaPlaylist(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("playlist %s is invalid: %w", playlistName, err)
+	}
+
+	if !playlist.EndList {
+		return fmt.Errorf("playlist %s has no #EXT-X-ENDLIST, encode did not finish", playlistName)
+	}
+	if len(playlist.Segments) == 0 {
+		return fmt.Errorf("playlist %s lists no segments", playlistName)
+	}
+
+	for _, seg := range playlist.Segments {
+		info, err := store.Stat(ctx, store.Join(renditionDir, seg.URI))
+		if err != nil {
+			return fmt.Errorf("segment %s referenced by playlist is missing: %w", seg.URI, err)
+		}
+		if info.Size == 0 {
+			return fmt.Errorf("segment %s is empty", seg.URI)
+		}
+	}
+
+	total := playlist.TotalDuration()
+	if drift := math.Abs(total - sourceDuration); drift > t.validation.DurationTolerance.Seconds() {
+		return fmt.Errorf("playlist duration %.2fs differs from source duration %.2fs by %.2fs (tolerance %s)",
+			total, sourceDuration, drift, t.validation.DurationTolerance)
+	}
+
+	// Decoding the edges catches broken headers at the start and truncation at the end
+	probe := []string{playlist.Segments[0].URI}
+	if last := playlist.Segments[len(playlist.Segments)-1].URI; last != probe[0] {
+		probe = append(probe, last)
+	}
+	for _, uri := range probe {
+		if err := t.probeStored(ctx, store, store.Join(renditionDir, uri)); err != nil {
+			return fmt.Errorf("segment %s does not decode: %w", uri, err)
+		}
+	}
+
+	return nil
+}
+
+// probeStored decodes a segment in place, or from a temporary local copy when
+// the backend has no local path ffmpeg could read
+func (t *FFmpegTranscoder) probeStored(ctx context.Context, store storage.Backend, path string) error {
+	if local, ok := store.LocalPath(path); ok {
+		return t.probeDecode(ctx, local)
+	}
+
+	src, err := store.Open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(t.tempDir, "probe-*"+filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download segment: %w", err)
+	}
+
+	return t.probeDecode(ctx, tmp.Name())
+}
+
+// probeDecode fully decodes a single segment and fails on the first decode error
+func (t *FFmpegTranscoder) probeDecode(ctx context.Context, segmentPath string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner", "-nostats",
+		"-v", "error",
+		"-xerror",
+		"-i", segmentPath,
+		"-f", "null", "-",
+	)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%w: %s", err, lastLine(stderr.String()))
+		}
+		return err
+	}
+
+	return nil
+}
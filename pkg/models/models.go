@@ -1,5 +1,12 @@
 package models
 
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
 // ===== Worker Registration & Capabilities =====
 
 // RegistrationPayload is sent once on startup to declare worker capabilities
@@ -8,26 +15,44 @@ type RegistrationPayload struct {
 	Capabilities []string `json:"capabilities"` // e.g. ["1080p", "720p", "nvenc", "h264_nvenc", "4k"]
 }
 
+// DeregistrationPayload is sent on a clean exit, after running jobs were finalized
+type DeregistrationPayload struct {
+	WorkerID string `json:"worker_id"`
+}
+
 // ===== Worker Sync (Bidirectional Heartbeat + Job Assignment) =====
 
 // SyncPayload is sent periodically to sync state with orchestrator
 type SyncPayload struct {
 	WorkerID      string        `json:"worker_id"`
-	Status        string        `json:"status"` // "IDLE", "BUSY"
+	Status        string        `json:"status"`                  // "IDLE" (a slot is free), "BUSY", "UNHEALTHY", "DRAINING"
+	StatusReason  string        `json:"status_reason,omitempty"` // Why the worker is UNHEALTHY
 	HardwareStats HardwareStats `json:"hardware_stats"`
-	CurrentJobID  string        `json:"current_job_id,omitempty"`
+	CurrentJobID  string        `json:"current_job_id,omitempty"`  // First of RunningJobIDs
+	RunningJobIDs []string      `json:"running_job_ids,omitempty"` // Every job holding a slot
+	FreeSlots     SlotCounts    `json:"free_slots"`
+}
+
+// SlotCounts counts job slots by type
+type SlotCounts struct {
+	CPU int `json:"cpu"`
+	GPU int `json:"gpu"`
 }
 
 type HardwareStats struct {
-	CPUPercent float64 `json:"cpu_percent"` // 0.0 to 100.0
-	RAMPercent float64 `json:"ram_percent"` // 0.0 to 100.0
-	IsBusy     bool    `json:"is_busy"`     // Computed: CPU > 80% or RAM > 90%
+	CPUPercent      float64 `json:"cpu_percent"`                 // 0.0 to 100.0
+	RAMPercent      float64 `json:"ram_percent"`                 // 0.0 to 100.0
+	IsBusy          bool    `json:"is_busy"`                     // Computed: CPU > 80% or RAM > 90%
+	TempFreeBytes   uint64  `json:"temp_free_bytes"`             // Free space on the temp_dir disk
+	OutputFreeBytes uint64  `json:"output_free_bytes,omitempty"` // Free space on the NAS mount, absent for object storage
 }
 
 // SyncResponse is the orchestrator's response to a sync request
 type SyncResponse struct {
-	Ack         bool     `json:"ack"`
-	AssignedJob *JobSpec `json:"assigned_job,omitempty"` // Present only if IDLE and work exists
+	Ack          bool     `json:"ack"`
+	AssignedJob  *JobSpec `json:"assigned_job,omitempty"`   // Present only if IDLE and work exists
+	CancelJobIDs []string `json:"cancel_job_ids,omitempty"` // Running jobs to stop and finalize as CANCELLED
+	Drain        bool     `json:"drain,omitempty"`          // Finish running jobs, take no new ones, then exit
 }
 
 // ===== Job Specification =====
@@ -41,12 +66,15 @@ type JobSpec struct {
 	Outputs     []OutputSpec    `json:"outputs"`
 	HLSSettings HLSSettingsSpec `json:"hls_settings"`
 	AudioConfig AudioConfigSpec `json:"audio_config,omitempty"`
+
+	OverwritePolicy string `json:"overwrite_policy,omitempty"` // "replace" (default), "fail" or "version"
 }
 
 // InputSpec represents the input source
 type InputSpec struct {
-	SourceURL string `json:"source_url"` // Path to raw file (relative to NAS mount)
+	SourceURL string `json:"source_url"` // Path to raw file (relative to NAS mount), or an http(s) URL
 	Format    string `json:"format,omitempty"`
+	SHA256    string `json:"sha256,omitempty"` // Expected digest, verified when the source is downloaded
 }
 
 // OutputSpec defines a single output rendition
@@ -113,6 +141,14 @@ func (j *JobSpec) GetAudioBitrate(output *OutputSpec) string {
 	return "128k" // Default
 }
 
+// GetOverwritePolicy returns what to do when a destination already holds output
+func (j *JobSpec) GetOverwritePolicy() string {
+	if j.OverwritePolicy != "" {
+		return j.OverwritePolicy
+	}
+	return "replace" // Default
+}
+
 // GetMasterPlaylistName returns the master playlist filename
 func (j *JobSpec) GetMasterPlaylistName() string {
 	if j.HLSSettings.MasterPlaylistName != "" {
@@ -121,6 +157,71 @@ func (j *JobSpec) GetMasterPlaylistName() string {
 	return "index.m3u8" // Default
 }
 
+// ParseBitrate converts an ffmpeg-style bitrate ("2500k", "5M", "800000") to bits per second
+func ParseBitrate(bitrate string) (int64, error) {
+	value := strings.TrimSpace(bitrate)
+	multiplier := 1.0
+
+	switch {
+	case strings.HasSuffix(value, "k"), strings.HasSuffix(value, "K"):
+		multiplier = 1000
+		value = value[:len(value)-1]
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1000 * 1000
+		value = value[:len(value)-1]
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(number > 0) || math.IsInf(number, 0) {
+		return 0, fmt.Errorf("invalid bitrate %q", bitrate)
+	}
+
+	return int64(number * multiplier), nil
+}
+
+// FormatBitrate renders bits per second in the "2500k" form ffmpeg accepts
+func FormatBitrate(bitsPerSecond int64) string {
+	return fmt.Sprintf("%dk", (bitsPerSecond+500)/1000)
+}
+
+// ===== Job Acceptance =====
+
+// JobAcceptPayload is sent when the worker starts an assigned job
+type JobAcceptPayload struct {
+	WorkerID string `json:"worker_id"`
+}
+
+// JobLease is the orchestrator's answer to an accept. The job stays with the
+// worker while progress updates renew the lease within TTLSec; after that the
+// orchestrator may reassign it. A zero TTL means the job isn't leased.
+type JobLease struct {
+	LeaseID string `json:"lease_id"`
+	TTLSec  int    `json:"ttl_sec"`
+}
+
+// JobRejectPayload is sent instead of accepting an assigned job
+type JobRejectPayload struct {
+	WorkerID  string `json:"worker_id"`
+	Reason    string `json:"reason"` // One of the RejectReason* codes
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"` // The job may be assigned again later, here or elsewhere
+}
+
+// Reasons a worker rejects an assigned job
+const (
+	RejectReasonBusy             = "BUSY"
+	RejectReasonDraining         = "DRAINING"
+	RejectReasonInputMissing     = "INPUT_MISSING"
+	RejectReasonUnsupportedCodec = "UNSUPPORTED_CODEC"
+	RejectReasonInsufficientDisk = "INSUFFICIENT_DISK"
+	RejectReasonPathNotAllowed   = "PATH_NOT_ALLOWED"
+	RejectReasonPathIsRoot       = "PATH_IS_ROOT" // An output is an allowed root itself
+	RejectReasonNASUnhealthy     = "NAS_UNHEALTHY"
+	RejectReasonInvalidJob       = "INVALID_JOB"
+	RejectReasonWorkerRestarted  = "WORKER_RESTARTED" // Assigned before the worker restarted, never started
+	RejectReasonAcceptFailed     = "ACCEPT_FAILED"    // The accept call failed, any lease it got is handed back
+)
+
 // ===== Job Progress & Status Updates =====
 
 // JobStatusPayload is sent periodically during transcoding
@@ -130,6 +231,14 @@ type JobStatusPayload struct {
 	Progress   float64 `json:"progress,omitempty"`
 	CurrentFPS int     `json:"current_fps,omitempty"`
 	ETASec     int     `json:"eta_sec,omitempty"`
+	LeaseID    string  `json:"lease_id,omitempty"` // Renewed by every update
+
+	RenditionDone string `json:"rendition_done,omitempty"` // Set on the update sent when a rendition is committed
+}
+
+// JobStatusResponse is the orchestrator's optional reply to a progress update
+type JobStatusResponse struct {
+	Cancel bool `json:"cancel,omitempty"` // Stop the job and finalize it as CANCELLED
 }
 
 // JobProgress represents real-time progress during transcoding
@@ -143,12 +252,68 @@ type JobProgress struct {
 
 // JobResultPayload is sent when a job completes or fails
 type JobResultPayload struct {
-	Status      string     `json:"status"` // "COMPLETED" or "FAILED"
-	ManifestURL string     `json:"manifest_url,omitempty"`
-	ErrorMsg    string     `json:"error_msg,omitempty"`
-	Metrics     JobMetrics `json:"metrics,omitempty"`
+	Status         string     `json:"status"` // "COMPLETED", "FAILED", "CANCELLED" or "INTERRUPTED" (worker shut down, requeue right away)
+	ManifestURL    string     `json:"manifest_url,omitempty"`
+	ManifestSHA256 string     `json:"manifest_sha256,omitempty"` // checksums.sha256 next to the manifest_url playlist, if it is in a rendition dir
+	ErrorMsg       string     `json:"error_msg,omitempty"`
+	ErrorCode      string     `json:"error_code,omitempty"` // Machine-readable cause, see ErrorCode* constants
+	Warnings       []string   `json:"warnings,omitempty"`   // Non-fatal issues, e.g. low quality scores
+	Metrics        JobMetrics `json:"metrics,omitempty"`
+
+	Complexity *ComplexityReport `json:"complexity,omitempty"` // Present when per-title analysis ran
+}
+
+// ErrorCodeOutputExists fails a job with the "fail" overwrite policy whose destination already holds output
+const ErrorCodeOutputExists = "OUTPUT_EXISTS"
+
+// ComplexityReport describes the per-title analysis and the bitrate ladder it produced
+type ComplexityReport struct {
+	Score  float64             `json:"score"` // 1.0 = typical content, higher = harder to encode
+	Scale  float64             `json:"scale"` // Factor applied to requested bitrates (score within bounds)
+	Ladder []AdjustedRendition `json:"ladder"`
+}
+
+// AdjustedRendition pairs a requested bitrate with the one actually encoded
+type AdjustedRendition struct {
+	Resolution       string `json:"resolution"`
+	RequestedBitrate string `json:"requested_bitrate"`
+	Bitrate          string `json:"bitrate"`
 }
 
 type JobMetrics struct {
-	TotalTimeMS int64 `json:"total_time_ms"`
+	TotalTimeMS int64              `json:"total_time_ms"`
+	Renditions  []RenditionMetrics `json:"renditions,omitempty"`
+	Upload      *UploadMetrics     `json:"upload,omitempty"`
+}
+
+// UploadMetrics summarises the copy of committed outputs to their destination
+type UploadMetrics struct {
+	Bytes        int64   `json:"bytes"`         // Bytes written by this attempt
+	Files        int     `json:"files"`         // Files written by this attempt
+	SkippedFiles int     `json:"skipped_files"` // Files already in place from an earlier attempt
+	TimeMS       int64   `json:"time_ms"`       // Wall time spent uploading
+	Mbps         float64 `json:"mbps"`          // Effective throughput in megabits per second
+}
+
+// Add accumulates another upload and recomputes the throughput
+func (u *UploadMetrics) Add(other UploadMetrics) {
+	u.Bytes += other.Bytes
+	u.Files += other.Files
+	u.SkippedFiles += other.SkippedFiles
+	u.TimeMS += other.TimeMS
+	if u.TimeMS > 0 {
+		u.Mbps = float64(u.Bytes*8) / float64(u.TimeMS) / 1000
+	}
+}
+
+// RenditionMetrics holds measurements for a single output rendition
+type RenditionMetrics struct {
+	Resolution   string   `json:"resolution"`
+	Bitrate      string   `json:"bitrate"`
+	PSNR         *float64 `json:"psnr,omitempty"`          // Average PSNR in dB
+	SSIM         *float64 `json:"ssim,omitempty"`          // Average SSIM (0.0 to 1.0)
+	VMAF         *float64 `json:"vmaf,omitempty"`          // Mean VMAF score (0 to 100)
+	QualityIssue string   `json:"quality_issue,omitempty"` // Set when a score is below threshold
+
+	ManifestSHA256 string `json:"manifest_sha256,omitempty"` // Hash of the committed checksums.sha256
 }
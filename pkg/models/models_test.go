@@ -0,0 +1,52 @@
+package models
+
+import "testing"
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		bitrate string
+		want    int64
+		wantErr bool
+	}{
+		{"2500k", 2500000, false},
+		{"2500K", 2500000, false},
+		{"5M", 5000000, false},
+		{"1.5M", 1500000, false},
+		{"800000", 800000, false},
+		{" 700k ", 700000, false},
+		{"", 0, true},
+		{"k", 0, true},
+		{"0k", 0, true},
+		{"-500k", 0, true},
+		{"fast", 0, true},
+		{"5G", 0, true},
+		{"NaN", 0, true},
+		{"Inf", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBitrate(tt.bitrate)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseBitrate(%q) = %d, %v; want %d, error %v", tt.bitrate, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFormatBitrate(t *testing.T) {
+	tests := []struct {
+		bitsPerSecond int64
+		want          string
+	}{
+		{2500000, "2500k"},
+		{1234567, "1235k"},
+		{1234499, "1234k"},
+		{800, "1k"},
+	}
+	for _, tt := range tests {
+		if got := FormatBitrate(tt.bitsPerSecond); got != tt.want {
+			t.Errorf("FormatBitrate(%d) = %s, want %s", tt.bitsPerSecond, got, tt.want)
+		}
+		if parsed, err := ParseBitrate(tt.want); err != nil || FormatBitrate(parsed) != tt.want {
+			t.Errorf("FormatBitrate(%d) = %s doesn't round-trip through ParseBitrate", tt.bitsPerSecond, tt.want)
+		}
+	}
+}